@@ -0,0 +1,190 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/tracker"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const (
+	// externalAnnounceInterval - used when tracker doesn't tell own interval, same as torrent lib's default
+	externalAnnounceInterval = 30 * time.Minute
+	// externalAnnounceRetry - after failed announce
+	externalAnnounceRetry = time.Minute
+)
+
+// validatePort - 0 means "not set"
+func validatePort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port out of range [1, 65535]: %d", port)
+	}
+	return nil
+}
+
+// externalAnnouncer - torrent lib announces its listen port to trackers. Behind NAT with static port forward
+// external port differs: lib's announces are disabled (ClientConfig.DisableTrackers) and MainLoop announces
+// trackers of torrents with Cfg.ExternalPort instead. DHT and PEX still advertise listen port.
+type externalAnnouncer struct {
+	port int
+
+	lock      sync.Mutex
+	torrents  map[metainfo.Hash]*externalAnnounceState
+	latencies map[string]time.Duration // tracker url (with PasskeyPlaceholder) -> round trip of last accepted announce
+}
+
+type externalAnnounceState struct {
+	next     time.Time
+	started  bool
+	inFlight bool
+	results  map[string]string // tracker url -> "N peers" or error, like in status dump of torrent lib
+}
+
+func newExternalAnnouncer(port int) *externalAnnouncer {
+	return &externalAnnouncer{port: port, torrents: map[metainfo.Hash]*externalAnnounceState{}, latencies: map[string]time.Duration{}}
+}
+
+// maybeAnnounce - called by MainLoop every tick for not paused torrents, announces in background when due
+func (a *externalAnnouncer) maybeAnnounce(ctx context.Context, cli *Client, t *torrent.Torrent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	st, ok := a.torrents[t.InfoHash()]
+	if !ok {
+		st = &externalAnnounceState{results: map[string]string{}}
+		a.torrents[t.InfoHash()] = st
+	}
+	if st.inFlight || time.Now().Before(st.next) {
+		return
+	}
+	st.inFlight = true
+	event := tracker.None
+	if !st.started {
+		event = tracker.Started
+	}
+	go func() {
+		interval, announced := a.announce(ctx, cli, t, event, st)
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		st.inFlight, st.next = false, time.Now().Add(interval)
+		st.started = st.started || announced
+	}()
+}
+
+// announce - to all trackers of torrent, returns when to announce next time and whether any tracker accepted it
+func (a *externalAnnouncer) announce(ctx context.Context, cli *Client, t *torrent.Torrent, event tracker.AnnounceEvent, st *externalAnnounceState) (time.Duration, bool) {
+	stats := t.Stats()
+	req := tracker.AnnounceRequest{
+		Event:      event,
+		NumWant:    -1,
+		Port:       uint16(a.port),
+		PeerId:     cli.TorrentClient().PeerID(),
+		InfoHash:   t.InfoHash(),
+		Left:       -1,
+		Uploaded:   stats.BytesWrittenData.Int64(),
+		Downloaded: stats.BytesReadUsefulData.Int64(),
+	}
+	if t.Info() != nil {
+		req.Left = t.BytesMissing()
+	}
+	var next time.Duration
+	mi := t.Metainfo()
+	for _, tier := range mi.UpvertedAnnounceList() {
+		for _, u := range tier {
+			start := time.Now()
+			res, err := tracker.Announce{
+				TrackerUrl: u,
+				Request:    req,
+				HTTPProxy:  cli.cfg.HTTPProxy,
+				UserAgent:  cli.cfg.HTTPUserAgent,
+				Context:    ctx,
+			}.Do()
+			latency := time.Since(start)
+			a.lock.Lock()
+			if err != nil {
+				st.results[u] = err.Error()
+			} else {
+				st.results[u] = fmt.Sprintf("%d peers", len(res.Peers))
+				a.latencies[withoutPasskey(u, cli.cfg.Passkey)] = latency
+			}
+			a.lock.Unlock()
+			if err != nil {
+				log.Debug("[torrent] External port announce", "tracker", u, "err", err)
+				continue
+			}
+			peers := make([]torrent.PeerInfo, 0, len(res.Peers))
+			for _, p := range res.Peers {
+				pi := torrent.PeerInfo{Addr: &net.TCPAddr{IP: p.IP, Port: p.Port}, Source: torrent.PeerSourceTracker}
+				copy(pi.Id[:], p.ID)
+				peers = append(peers, pi)
+			}
+			t.AddPeers(peers)
+			if interval := time.Duration(res.Interval) * time.Second; interval > 0 && (next == 0 || interval < next) {
+				next = interval
+			}
+			if next == 0 {
+				next = externalAnnounceInterval
+			}
+		}
+	}
+	if next == 0 {
+		return externalAnnounceRetry, false
+	}
+	return next, true
+}
+
+// results - like announceResults, but of own announces
+func (a *externalAnnouncer) results() (ok int, errs []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, st := range a.torrents {
+		for _, res := range st.results {
+			if strings.HasSuffix(res, " peers") {
+				ok++
+				continue
+			}
+			errs = append(errs, res)
+		}
+	}
+	return ok, errs
+}
+
+// announceLatencies - copy of latencies
+func (a *externalAnnouncer) announceLatencies() map[string]time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	res := make(map[string]time.Duration, len(a.latencies))
+	for k, v := range a.latencies {
+		res[k] = v
+	}
+	return res
+}
+
+// prune - forgets dropped torrents, called by MainLoop every tick
+func (a *externalAnnouncer) prune(torrents []*torrent.Torrent) {
+	alive := make(map[metainfo.Hash]struct{}, len(torrents))
+	for _, t := range torrents {
+		alive[t.InfoHash()] = struct{}{}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for hash := range a.torrents {
+		if _, ok := alive[hash]; !ok {
+			delete(a.torrents, hash)
+		}
+	}
+}
+
+// trackerResults - last announces of torrent lib, or own ones if Cfg.ExternalPort is used
+func (cli *Client) trackerResults() (ok int, errs []string) {
+	if cli.announcer != nil {
+		return cli.announcer.results()
+	}
+	return announceResults(cli.TorrentClient())
+}
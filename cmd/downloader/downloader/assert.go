@@ -0,0 +1,11 @@
+package downloader
+
+import "fmt"
+
+// assert - checks invariant, panics with context if it's broken. Does nothing unless built with `-tags debug`:
+// ASSERT is constant, so release build compiles checks away (arguments are still evaluated - keep them cheap).
+func assert(cond bool, msg string, ctx ...interface{}) {
+	if ASSERT && !cond {
+		panic(fmt.Sprintf("assertion failed: %s %v", msg, ctx))
+	}
+}
@@ -0,0 +1,28 @@
+//go:build debug
+// +build debug
+
+package downloader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -tags debug ./cmd/downloader/downloader/
+func TestAssert(t *testing.T) {
+	require.NotPanics(t, func() { assert(true, "never") })
+	require.PanicsWithValue(t, "assertion failed: broken [k 1]", func() { assert(false, "broken", "k", 1) })
+}
+
+func TestCalcStatsAssertElapsed(t *testing.T) {
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(t, err)
+	defer cl.Close()
+	require.NotPanics(t, func() { CalcStats(AggStats{}, 500*time.Millisecond, cl, nil) })
+	require.PanicsWithValue(t, "assertion failed: stats elapsed time is not positive [elapsed 0s]", func() {
+		CalcStats(AggStats{}, 0, cl, nil)
+	})
+}
@@ -0,0 +1,56 @@
+package downloader
+
+import (
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// AuditKind - kind of event in audit trail
+type AuditKind string
+
+const (
+	AuditAdded            AuditKind = "added"
+	AuditMetadataResolved AuditKind = "metadata_resolved"
+	AuditCompleted        AuditKind = "completed"
+	AuditVerifyPassed     AuditKind = "verify_passed"
+	AuditVerifyFailed     AuditKind = "verify_failed"
+	AuditRemoved          AuditKind = "removed"
+)
+
+// Sources of AuditAdded event
+const (
+	SourceTorrentFile = "torrent_file"
+	SourceCachedInfo  = "cached_info"
+	SourceMagnet      = "magnet"
+)
+
+// AuditEvent - record of append-only audit trail, persisted in db - survives log rotation
+type AuditEvent struct {
+	Time     time.Time
+	Kind     AuditKind
+	InfoHash metainfo.Hash // zero for events not related to single torrent
+	Source   string        `json:",omitempty"`
+	Err      string        `json:",omitempty"`
+}
+
+// audit - failure to write audit trail is logged, but doesn't fail the audited operation
+func audit(db kv.RwDB, kind AuditKind, infoHash metainfo.Hash, source string, err error) {
+	if db == nil {
+		return
+	}
+	ev := AuditEvent{Time: time.Now(), Kind: kind, InfoHash: infoHash, Source: source}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	if err := saveAuditEvent(db, ev); err != nil {
+		log.Warn("[torrent] Write audit event", "kind", kind, "err", err)
+	}
+}
+
+// AuditEvents - events happened at or after since, oldest first
+func (cli *Client) AuditEvents(since time.Time) ([]AuditEvent, error) {
+	return readAuditEvents(cli.db, since)
+}
@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Bottleneck - what limits download now, see AggStats.Bottleneck
+type Bottleneck string
+
+const (
+	BottleneckNone    Bottleneck = ""        // not downloading
+	BottleneckNetwork Bottleneck = "network" // peers/webseeds or download rate limit
+	// BottleneckDisk - chunks wait for storage writes: received data piles up in memory, peers' reads stall
+	BottleneckDisk Bottleneck = "disk"
+)
+
+// writeBoundLoad - average amount of writes in progress from which download is disk-bound: some chunk always waits
+// for storage
+const writeBoundLoad = 1.0
+
+// sample - called by MainLoop each stats tick. load - average writes in progress since previous sample (time
+// spent in writes / elapsed): queue depth which pending now can't show between ticks.
+func (w *storageWrites) sample(elapsed time.Duration) (pending int64, load float64) {
+	busy := atomic.LoadInt64(&w.busy)
+	if elapsed > 0 {
+		load = float64(busy-w.sampledBusy) / float64(elapsed)
+	}
+	w.sampledBusy = busy
+	return atomic.LoadInt64(&w.inFlight), load
+}
+
+func bottleneck(readBytesPerSec int64, writeLoad float64) Bottleneck {
+	switch {
+	case writeLoad >= writeBoundLoad:
+		return BottleneckDisk
+	case readBytesPerSec > 0:
+		return BottleneckNetwork
+	default:
+		return BottleneckNone
+	}
+}
@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"golang.org/x/time/rate"
+)
+
+// bandwidthShares - per-torrent download rate limiters, global download limit is split between downloading
+// torrents proportionally to their weights (default 1). Torrent lib has only global limiter - per-torrent one
+// is applied to writes of received chunks: they are done by peer connection's read loop, so slow write
+// slows reading from peers of this torrent (TCP backpressure).
+// Shares are fixed, not work-conserving: share of torrent which has no peers is not used by others.
+type bandwidthShares struct {
+	lock     sync.Mutex
+	weights  map[metainfo.Hash]int
+	boosted  map[metainfo.Hash]struct{} // see SchedulingFinishLine
+	limiters map[metainfo.Hash]*rate.Limiter
+}
+
+func newBandwidthShares() *bandwidthShares {
+	return &bandwidthShares{weights: map[metainfo.Hash]int{}, boosted: map[metainfo.Hash]struct{}{}, limiters: map[metainfo.Hash]*rate.Limiter{}}
+}
+
+func (b *bandwidthShares) limiter(infoHash metainfo.Hash) *rate.Limiter {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	l, ok := b.limiters[infoHash]
+	if !ok {
+		l = rate.NewLimiter(rate.Inf, 2*DefaultPieceSize)
+		b.limiters[infoHash] = l
+	}
+	return l
+}
+
+func (b *bandwidthShares) weight(infoHash metainfo.Hash) int {
+	w, ok := b.weights[infoHash]
+	if !ok {
+		w = 1
+	}
+	if _, ok := b.boosted[infoHash]; ok {
+		w *= finishLineBoost
+	}
+	return w
+}
+
+// boost - replaces set of torrents at finish line, applied by next rebalance
+func (b *bandwidthShares) boost(finishing []metainfo.Hash) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.boosted = make(map[metainfo.Hash]struct{}, len(finishing))
+	for _, h := range finishing {
+		b.boosted[h] = struct{}{}
+	}
+}
+
+// rebalance - global is current global download limit, downloading - torrents which are not complete yet.
+// Without weights and boosts (or without global limit) torrents are not limited: library's default fairness.
+func (b *bandwidthShares) rebalance(global rate.Limit, downloading []metainfo.Hash) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	limits := make(map[metainfo.Hash]rate.Limit, len(downloading))
+	if (len(b.weights) > 0 || len(b.boosted) > 0) && global != rate.Inf {
+		var total int
+		for _, h := range downloading {
+			total += b.weight(h)
+		}
+		for _, h := range downloading {
+			limits[h] = global * rate.Limit(b.weight(h)) / rate.Limit(total)
+		}
+	}
+	for h, l := range b.limiters {
+		if limit, ok := limits[h]; ok {
+			l.SetLimit(limit)
+		} else {
+			l.SetLimit(rate.Inf)
+		}
+	}
+}
+
+// SetBandwidthWeight - share of global download rate limit which torrent gets while other torrents are downloading
+// too: torrent with weight 3 gets 3x bandwidth of torrent with weight 1 (default). Applied by MainLoop (or next call
+// of SetBandwidthWeight) - to torrents which are not complete. Has effect only if download rate is limited and
+// storage is created by New (Cfg.DefaultStorage is not set).
+func (cli *Client) SetBandwidthWeight(hash metainfo.Hash, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	cli.bandwidth.lock.Lock()
+	cli.bandwidth.weights[hash] = weight
+	cli.bandwidth.lock.Unlock()
+	cli.rebalanceBandwidth()
+}
+
+// rebalanceBandwidth - re-splits global download limit, called by MainLoop as torrents complete (or reach finish
+// line, see SchedulingFinishLine)
+func (cli *Client) rebalanceBandwidth() {
+	global := rate.Inf
+	if cli.cfg.DownloadRateLimiter != nil {
+		global = cli.cfg.DownloadRateLimiter.Limit()
+	}
+	var downloading, finishing []metainfo.Hash
+	for _, t := range cli.TorrentClient().Torrents() {
+		select {
+		case <-t.GotInfo():
+			if t.BytesMissing() == 0 {
+				continue
+			}
+			if cli.atFinishLine(t) {
+				finishing = append(finishing, t.InfoHash())
+			}
+		default:
+		}
+		downloading = append(downloading, t.InfoHash())
+	}
+	cli.bandwidth.boost(finishing)
+	cli.bandwidth.rebalance(global, downloading)
+}
+
+// throttledPiece - see bandwidthShares. Also counts writes, see storageWrites
+type throttledPiece struct {
+	storage.PieceImpl
+	limiter *rate.Limiter
+	writes  *storageWrites
+}
+
+func (p throttledPiece) WriteAt(b []byte, off int64) (int, error) {
+	_ = p.limiter.WaitN(context.Background(), len(b)) // fails only if chunk exceeds burst - then not throttled
+	atomic.AddInt64(&p.writes.inFlight, 1)
+	defer atomic.AddInt64(&p.writes.inFlight, -1)
+	start := time.Now()
+	n, err := p.PieceImpl.WriteAt(b, off)
+	atomic.AddInt64(&p.writes.busy, int64(time.Since(start)))
+	atomic.AddInt64(&p.writes.bytes, int64(n))
+	return n, err
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/c2h5oh/datasize"
+)
+
+// BenchVerifyLimit - BenchmarkVerify reads not more than this amount of data
+const BenchVerifyLimit = 1 * datasize.GB
+
+type BenchResult struct {
+	Bytes     int64
+	Pieces    int
+	BadPieces int
+	ReadTime  time.Duration // time spent reading pieces from disk (or page cache)
+	HashTime  time.Duration // time spent hashing already-read pieces, CPU-bound
+	ReadMBps  float64
+	HashMBps  float64
+}
+
+func (r BenchResult) String() string {
+	return fmt.Sprintf("read: %.1f MB/s, hash: %.1f MB/s (%s in %d pieces, bad: %d)",
+		r.ReadMBps, r.HashMBps, datasize.ByteSize(r.Bytes).HumanReadable(), r.Pieces, r.BadPieces)
+}
+
+// BenchmarkVerify - measures how fast this host can verify snapshots: disk read and sha1 hashing
+// separately. Reads evenly spread pieces of each torrent, not more than BenchVerifyLimit in total.
+// Data which is already in page cache will show unrealistically high read speed.
+func BenchmarkVerify(snapshotsDir string) (BenchResult, error) {
+	var res BenchResult
+	files, err := AllTorrentPaths(snapshotsDir)
+	if err != nil {
+		return res, err
+	}
+	if len(files) == 0 {
+		return res, fmt.Errorf("no .torrent files in %s", snapshotsDir)
+	}
+	limit := int64(BenchVerifyLimit.Bytes())
+	budgetPerTorrent := limit / int64(len(files))
+	buf := make([]byte, DefaultPieceSize)
+	for _, f := range files {
+		if res.Bytes >= limit { // many torrents: one piece of each may be already too much
+			break
+		}
+		mi, err := metainfo.LoadFromFile(f)
+		if err != nil {
+			return res, err
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			return res, err
+		}
+		if err := benchTorrent(&info, snapshotsDir, budgetPerTorrent, buf, &res); err != nil {
+			return res, err
+		}
+	}
+	if res.ReadTime > 0 {
+		res.ReadMBps = float64(res.Bytes) / float64(datasize.MB) / res.ReadTime.Seconds()
+	}
+	if res.HashTime > 0 {
+		res.HashMBps = float64(res.Bytes) / float64(datasize.MB) / res.HashTime.Seconds()
+	}
+	return res, nil
+}
+
+func benchTorrent(info *metainfo.Info, root string, budget int64, buf []byte, res *BenchResult) error {
+	span, err := openSpan(info, root)
+	if err != nil {
+		return err
+	}
+	defer span.Close()
+
+	numPieces := info.NumPieces()
+	if numPieces == 0 {
+		return nil
+	}
+	step := 1
+	if want := int(budget / info.PieceLength); want == 0 {
+		step = numPieces // budget is smaller than piece - read only first one
+	} else if want < numPieces {
+		step = numPieces / want
+	}
+	for i := 0; i < numPieces; i += step {
+		p := info.Piece(i)
+		if int64(cap(buf)) < p.Length() {
+			buf = make([]byte, p.Length())
+		}
+		data := buf[:p.Length()]
+
+		start := time.Now()
+		if _, err := io.ReadFull(io.NewSectionReader(span, p.Offset(), p.Length()), data); err != nil {
+			return err
+		}
+		res.ReadTime += time.Since(start)
+
+		start = time.Now()
+		sum := sha1.Sum(data)
+		res.HashTime += time.Since(start)
+
+		if metainfo.Hash(sum) != p.Hash() {
+			res.BadPieces++
+		}
+		res.Bytes += p.Length()
+		res.Pieces++
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// VerifyCheckpointFile - default name of VerifyOptions.Checkpoint inside snapshots dir
+const VerifyCheckpointFile = ".verify-checkpoint.json"
+
+// verifyCheckpoint - torrents which VerifyDtaFiles fully verified, infohash -> fingerprint of their files.
+// Torrent which files changed since (size or mtime) is verified again.
+type verifyCheckpoint struct {
+	path     string
+	verified map[string]string
+}
+
+func loadVerifyCheckpoint(path string) (*verifyCheckpoint, error) {
+	c := &verifyCheckpoint{path: path, verified: map[string]string{}}
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.verified); err != nil {
+		return nil, fmt.Errorf("verify checkpoint %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// filesFingerprint - sizes and modification times of files of torrent
+func filesFingerprint(root string, info *metainfo.Info) (string, error) {
+	var size, mtime int64
+	for _, path := range filesPaths(root, info) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		size += fi.Size()
+		if t := fi.ModTime().UnixNano(); t > mtime {
+			mtime = t
+		}
+	}
+	return fmt.Sprintf("%d-%d", size, mtime), nil
+}
+
+func (c *verifyCheckpoint) isVerified(hash metainfo.Hash, fingerprint string) bool {
+	f, ok := c.verified[hash.HexString()]
+	return ok && f == fingerprint
+}
+
+// markVerified - persisted immediately: interrupted verify doesn't lose finished torrents
+func (c *verifyCheckpoint) markVerified(hash metainfo.Hash, fingerprint string) error {
+	c.verified[hash.HexString()] = fingerprint
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.verified)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// remove - all torrents verified, next verify starts from scratch
+func (c *verifyCheckpoint) remove() error {
+	if c.path == "" {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DefaultVerifyCheckpoint - path of checkpoint in snapshots dir
+func DefaultVerifyCheckpoint(snapshotDir string) string {
+	return filepath.Join(snapshotDir, VerifyCheckpointFile)
+}
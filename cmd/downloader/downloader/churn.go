@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// churnSample - data bytes got from each connection of torrent, at moment
+type churnSample struct {
+	at   time.Time
+	read map[*torrent.PeerConn]int64
+}
+
+// readBytes - data got from each of conns since connection was first seen
+func (p *peerTraffic) readBytes(conns []*torrent.PeerConn) map[*torrent.PeerConn]int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	res := make(map[*torrent.PeerConn]int64, len(conns))
+	for _, pc := range conns {
+		b, ok := p.live[pc]
+		if !ok { // never sent data yet
+			b = &peerBytes{lastActive: time.Now()}
+			p.live[pc] = b
+		}
+		res[pc] = b.read
+	}
+	return res
+}
+
+// churnSlowPeers - called by MainLoop every Cfg.PeerChurnInterval: torrent which uses all its connection slots
+// (EstablishedConnsPerTorrent) and downloads slower than Cfg.PeerChurnBelowRate drops one connection, so a new
+// peer can be dialed. Torrent lib can't close given connection: max conns is lowered for a moment and lib drops
+// the one which helped least recently - usually the slowest, which is logged.
+func (cli *Client) churnSlowPeers(samples map[metainfo.Hash]churnSample) {
+	now := time.Now()
+	alive := map[metainfo.Hash]struct{}{}
+	for _, t := range cli.healthyTorrents() {
+		hash := t.InfoHash()
+		alive[hash] = struct{}{}
+		if t.Info() == nil || cli.torrentComplete(t) || cli.isPaused(hash) || cli.isDownloadPaused(hash) {
+			delete(samples, hash)
+			continue
+		}
+		conns := t.PeerConns()
+		cur := churnSample{at: now, read: cli.traffic.readBytes(conns)}
+		prev, ok := samples[hash]
+		samples[hash] = cur
+		if !ok || len(conns) < cli.maxConnsPerTorrent() {
+			continue
+		}
+		elapsed := cur.at.Sub(prev.at).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+		var total, slowest int64 = 0, -1
+		for pc, read := range cur.read {
+			before, seen := prev.read[pc]
+			if !seen {
+				continue // new connection, give it a chance
+			}
+			delta := read - before
+			total += delta
+			if slowest < 0 || delta < slowest {
+				slowest = delta
+			}
+		}
+		rate := float64(total) / elapsed
+		if slowest < 0 || (cli.cfg.PeerChurnBelowRate > 0 && rate >= float64(cli.cfg.PeerChurnBelowRate.Bytes())) {
+			continue
+		}
+		log.Debug("[torrent] Slots full and download is slow, dropping a peer", "torrent", t.Name(),
+			"rate", datasize.ByteSize(rate).HumanReadable()+"/s", "slowest peer", datasize.ByteSize(float64(slowest)/elapsed).HumanReadable()+"/s")
+		t.SetMaxEstablishedConns(t.SetMaxEstablishedConns(len(conns) - 1))
+	}
+	for hash := range samples {
+		if _, ok := alive[hash]; !ok {
+			delete(samples, hash)
+		}
+	}
+}
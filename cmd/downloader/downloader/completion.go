@@ -0,0 +1,139 @@
+package downloader
+
+import (
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// pieceCompletions - opens piece completion store for each data dir, keeps track of them for periodic Flush
+type pieceCompletions struct {
+	buffered bool // false - write-through, every Set goes to disk immediately
+	format   CompletionFormat
+
+	lock   sync.Mutex
+	list   []*bufferedPieceCompletion
+	shared map[string]*sharedPieceCompletion
+}
+
+func (p *pieceCompletions) open(dir string) storage.PieceCompletion {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.shared[dir]; ok {
+		s.refs++
+		return s
+	}
+	pc, err := openPieceCompletion(p.format, dir)
+	if err != nil {
+		log.Warn("[torrent] couldn't open piece completion db, using in-memory", "dir", dir, "err", err)
+		pc = storage.NewMapPieceCompletion()
+	}
+	var buffered *bufferedPieceCompletion
+	if p.buffered {
+		buffered = &bufferedPieceCompletion{inner: pc, pending: map[metainfo.PieceKey]bool{}}
+		p.list = append(p.list, buffered)
+		pc = buffered
+	}
+	if p.shared == nil {
+		p.shared = map[string]*sharedPieceCompletion{}
+	}
+	s := &sharedPieceCompletion{PieceCompletion: pc, buffered: buffered, owner: p, dir: dir, refs: 1}
+	p.shared[dir] = s
+	return s
+}
+
+func openPieceCompletion(format CompletionFormat, dir string) (storage.PieceCompletion, error) {
+	if format == CompletionBitfield {
+		return newBitfieldPieceCompletion(dir)
+	}
+	return storage.NewDefaultPieceCompletionForDir(dir)
+}
+
+// sharedPieceCompletion - completion db of dir can be opened by few storage backends (see Cfg.StagingDir),
+// db file is opened once and closed by last backend
+type sharedPieceCompletion struct {
+	storage.PieceCompletion
+	buffered *bufferedPieceCompletion // nil if write-through
+	owner    *pieceCompletions
+	dir      string
+	refs     int // guarded by owner.lock
+}
+
+func (s *sharedPieceCompletion) Close() error {
+	s.owner.lock.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(s.owner.shared, s.dir)
+		for i, b := range s.owner.list {
+			if b == s.buffered {
+				s.owner.list = append(s.owner.list[:i], s.owner.list[i+1:]...)
+				break
+			}
+		}
+	}
+	s.owner.lock.Unlock()
+	if !last {
+		return nil
+	}
+	return s.PieceCompletion.Close()
+}
+
+// Flush - writes buffered completion state to disk
+func (p *pieceCompletions) Flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, b := range p.list {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferedPieceCompletion - keeps Set's in memory until Flush, trades durability for less IO:
+// on crash progress verified after last Flush is lost and those pieces will be verified/downloaded again
+type bufferedPieceCompletion struct {
+	inner storage.PieceCompletion
+
+	lock    sync.Mutex
+	pending map[metainfo.PieceKey]bool
+}
+
+func (b *bufferedPieceCompletion) Get(pk metainfo.PieceKey) (storage.Completion, error) {
+	b.lock.Lock()
+	complete, ok := b.pending[pk]
+	b.lock.Unlock()
+	if ok {
+		return storage.Completion{Complete: complete, Ok: true}, nil
+	}
+	return b.inner.Get(pk)
+}
+
+func (b *bufferedPieceCompletion) Set(pk metainfo.PieceKey, complete bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[pk] = complete
+	return nil
+}
+
+func (b *bufferedPieceCompletion) Flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for pk, complete := range b.pending {
+		if err := b.inner.Set(pk, complete); err != nil {
+			return err
+		}
+		delete(b.pending, pk)
+	}
+	return nil
+}
+
+func (b *bufferedPieceCompletion) Close() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.inner.Close()
+}
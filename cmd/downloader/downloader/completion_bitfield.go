@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// CompletionFormat - how piece completion store of data dir is persisted, see Cfg.CompletionFormat
+type CompletionFormat string
+
+const (
+	// CompletionDefault - library's db (bolt/sqlite): record per piece
+	CompletionDefault CompletionFormat = "default"
+	// CompletionBitfield - file per torrent with 2 bits per piece: small on disk, loaded by one read.
+	// State of CompletionDefault store is not migrated: pieces are verified again once after switching.
+	CompletionBitfield CompletionFormat = "bitfield"
+)
+
+// ParseCompletionFormat - empty string is CompletionDefault
+func ParseCompletionFormat(s string) (CompletionFormat, error) {
+	switch f := CompletionFormat(s); f {
+	case "", CompletionDefault:
+		return CompletionDefault, nil
+	case CompletionBitfield:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown completion format: %q, expecting default | bitfield", s)
+	}
+}
+
+const bitfieldCompletionDir = ".torrent.bitfield"
+
+// bitfieldPieceCompletion - per piece 2 bits: known, complete. Set writes only the changed byte.
+type bitfieldPieceCompletion struct {
+	dir string
+
+	lock     sync.Mutex
+	torrents map[metainfo.Hash]*bitfieldTorrent
+}
+
+type bitfieldTorrent struct {
+	bits []byte
+	f    *os.File // opened by first Set
+}
+
+func newBitfieldPieceCompletion(dir string) (*bitfieldPieceCompletion, error) {
+	dir = filepath.Join(dir, bitfieldCompletionDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pc := &bitfieldPieceCompletion{dir: dir, torrents: map[metainfo.Hash]*bitfieldTorrent{}}
+	for _, e := range entries {
+		var hash metainfo.Hash
+		if e.IsDir() || hash.FromHexString(e.Name()) != nil {
+			continue
+		}
+		bits, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		pc.torrents[hash] = &bitfieldTorrent{bits: bits}
+	}
+	return pc, nil
+}
+
+func bitfieldPos(piece int) (byteIndex int, shift uint) {
+	return piece / 4, uint(piece%4) * 2
+}
+
+func (pc *bitfieldPieceCompletion) Get(pk metainfo.PieceKey) (storage.Completion, error) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	t, ok := pc.torrents[pk.InfoHash]
+	i, shift := bitfieldPos(pk.Index)
+	if !ok || i >= len(t.bits) {
+		return storage.Completion{}, nil
+	}
+	v := t.bits[i] >> shift
+	return storage.Completion{Ok: v&1 != 0, Complete: v&2 != 0}, nil
+}
+
+func (pc *bitfieldPieceCompletion) Set(pk metainfo.PieceKey, complete bool) error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	t, ok := pc.torrents[pk.InfoHash]
+	if !ok {
+		t = &bitfieldTorrent{}
+		pc.torrents[pk.InfoHash] = t
+	}
+	i, shift := bitfieldPos(pk.Index)
+	if i >= len(t.bits) {
+		t.bits = append(t.bits, make([]byte, i+1-len(t.bits))...)
+	}
+	v := byte(1)
+	if complete {
+		v |= 2
+	}
+	b := t.bits[i]&^(3<<shift) | v<<shift
+	if b == t.bits[i] {
+		return nil
+	}
+	if t.f == nil {
+		f, err := os.OpenFile(filepath.Join(pc.dir, pk.InfoHash.HexString()), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		t.f = f
+	}
+	if _, err := t.f.WriteAt([]byte{b}, int64(i)); err != nil {
+		return err
+	}
+	t.bits[i] = b
+	return nil
+}
+
+func (pc *bitfieldPieceCompletion) Close() error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	var firstErr error
+	for _, t := range pc.torrents {
+		if t.f == nil {
+			continue
+		}
+		if err := t.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		t.f = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func dirSize(tb testing.TB, dir string) (size int64) {
+	tb.Helper()
+	require.NoError(tb, filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return err
+	}))
+	return size
+}
+
+func TestBitfieldCompletionSmaller(t *testing.T) {
+	require := require.New(t)
+	const torrents, pieces = 20, 1000
+	fill := func(pc storage.PieceCompletion) {
+		for h := 0; h < torrents; h++ {
+			for i := 0; i < pieces; i++ {
+				require.NoError(pc.Set(metainfo.PieceKey{InfoHash: metainfo.Hash{byte(h), 1}, Index: i}, i%3 != 0))
+			}
+		}
+		require.NoError(pc.Close())
+	}
+	load := func(format CompletionFormat, dir string) time.Duration {
+		start := time.Now()
+		pc, err := openPieceCompletion(format, dir)
+		require.NoError(err)
+		defer pc.Close()
+		for h := 0; h < torrents; h++ {
+			for i := 0; i < pieces; i++ {
+				c, err := pc.Get(metainfo.PieceKey{InfoHash: metainfo.Hash{byte(h), 1}, Index: i})
+				require.NoError(err)
+				require.True(c.Ok)
+				require.Equal(i%3 != 0, c.Complete)
+			}
+		}
+		return time.Since(start)
+	}
+
+	defaultDir, bitfieldDir := t.TempDir(), t.TempDir()
+	pc, err := openPieceCompletion(CompletionDefault, defaultDir)
+	require.NoError(err)
+	fill(pc)
+	pc, err = openPieceCompletion(CompletionBitfield, bitfieldDir)
+	require.NoError(err)
+	fill(pc)
+
+	defaultSize, bitfieldSize := dirSize(t, defaultDir), dirSize(t, bitfieldDir)
+	defaultLoad, bitfieldLoad := load(CompletionDefault, defaultDir), load(CompletionBitfield, bitfieldDir)
+	t.Logf("default: %d bytes, load %s; bitfield: %d bytes, load %s", defaultSize, defaultLoad, bitfieldSize, bitfieldLoad)
+	require.Equal(int64(torrents*pieces/4), bitfieldSize)
+	require.Less(bitfieldSize*10, defaultSize)
+
+	// unknown pieces and torrents
+	pc, err = openPieceCompletion(CompletionBitfield, bitfieldDir)
+	require.NoError(err)
+	defer pc.Close()
+	c, err := pc.Get(metainfo.PieceKey{InfoHash: metainfo.Hash{byte(0), 1}, Index: pieces})
+	require.NoError(err)
+	require.False(c.Ok)
+	c, err = pc.Get(metainfo.PieceKey{InfoHash: metainfo.Hash{0xff}, Index: 0})
+	require.NoError(err)
+	require.False(c.Ok)
+}
@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+
+	lg "github.com/anacrolix/log"
+	"github.com/anacrolix/torrent"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"golang.org/x/time/rate"
+)
+
+// Config - base settings of downloader by name, see NewFromConfig. Settings beyond it are fields of Cfg:
+// build one by Config.Cfg, set them and call New.
+type Config struct {
+	SnapshotsDir string
+	StagingDir   string // optional, see Cfg.StagingDir
+	// ProxyURL - optional, http(s) proxy of HTTP trackers announces and webseeds requests. Empty - HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	// env variables are honored. Peers connections (TCP/uTP) and UDP trackers can't go through HTTP proxy - they stay direct.
+	ProxyURL   string
+	Seeding    bool
+	Verbosity  lg.Level
+	ListenPort int
+	// ReadOnlyData, CompletionDir - see Cfg.ReadOnlyData
+	ReadOnlyData  bool
+	CompletionDir string
+	// DialSocket - see Cfg.DialSocket
+	DialSocket DialSocket
+
+	DownloadRate, UploadRate datasize.ByteSize
+}
+
+// Validate - checks Config without side effects: done by Cfg and NewFromConfig too
+func (c Config) Validate() error {
+	if c.SnapshotsDir == "" {
+		return errors.New("snapshots dir is required")
+	}
+	if c.StagingDir != "" && filepath.Clean(c.StagingDir) == filepath.Clean(c.SnapshotsDir) {
+		return fmt.Errorf("staging dir must differ from data dir: %s", c.StagingDir)
+	}
+	if err := validatePort(c.ListenPort); err != nil {
+		return fmt.Errorf("listen port: %w", err)
+	}
+	if _, err := parseProxyURL(c.ProxyURL); err != nil {
+		return err
+	}
+	if err := c.DialSocket.Validate(); err != nil {
+		return err
+	}
+	return validateReadOnlyData(&Cfg{ClientConfig: &torrent.ClientConfig{DataDir: c.SnapshotsDir}, StagingDir: c.StagingDir, ReadOnlyData: c.ReadOnlyData, CompletionDir: c.CompletionDir})
+}
+
+func validateReadOnlyData(cfg *Cfg) error {
+	if !cfg.ReadOnlyData {
+		return nil
+	}
+	switch {
+	case cfg.CompletionDir == "":
+		return errors.New("read-only data dir requires writable completion dir")
+	case filepath.Clean(cfg.CompletionDir) == filepath.Clean(cfg.DataDir):
+		return fmt.Errorf("completion dir must differ from read-only data dir: %s", cfg.CompletionDir)
+	case cfg.StagingDir != "":
+		return errors.New("staging dir can't be used with read-only data dir")
+	case cfg.FileMode != 0 || cfg.FileOwner != nil:
+		return errors.New("file mode and owner can't be set on read-only data dir")
+	case cfg.Storage != "" && cfg.Storage != StorageAuto && cfg.Storage != StorageFile:
+		return fmt.Errorf("storage backend %q can't be used with read-only data dir, only file", cfg.Storage)
+	}
+	return nil
+}
+
+// parseProxyURL - nil for empty url
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	if proxyURL == "" {
+		return nil, nil
+	}
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy url: %w", err)
+	}
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return nil, fmt.Errorf("proxy url must be http or https: %s", proxyURL)
+	}
+	return proxy, nil
+}
+
+// Cfg - validated Config as torrent lib config plus defaults of other settings
+func (c Config) Cfg() (*Cfg, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	torrentConfig := DefaultTorrentConfig()
+	torrentConfig.HTTPProxy = http.ProxyFromEnvironment
+	if proxy, _ := parseProxyURL(c.ProxyURL); proxy != nil {
+		torrentConfig.HTTPProxy = http.ProxyURL(proxy)
+	}
+	torrentConfig.ListenPort = c.ListenPort
+	torrentConfig.Seed = c.Seeding
+	torrentConfig.DataDir = c.SnapshotsDir
+	torrentConfig.UpnpID = torrentConfig.UpnpID + "leecher"
+
+	torrentConfig.UploadRateLimiter = rate.NewLimiter(rateLimit(c.UploadRate), 2*DefaultPieceSize)     // default: unlimited
+	torrentConfig.DownloadRateLimiter = rate.NewLimiter(rateLimit(c.DownloadRate), 2*DefaultPieceSize) // default: unlimited
+
+	// debug
+	if lg.Debug == c.Verbosity {
+		torrentConfig.Debug = true
+	}
+	torrentConfig.Logger = NewAdapterLogger().FilterLevel(c.Verbosity)
+
+	// DefaultStorage is created by New - after all Cfg fields are known
+	return &Cfg{ClientConfig: torrentConfig, StagingDir: c.StagingDir, ReadOnlyData: c.ReadOnlyData, CompletionDir: c.CompletionDir, DialSocket: c.DialSocket}, nil
+}
+
+// NewFromConfig - New with Cfg of Config
+func NewFromConfig(c Config, downloaderDB kv.RwDB) (*Client, error) {
+	cfg, err := c.Cfg()
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg, downloaderDB)
+}
@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// MigrateDataDir - moves data dir (snapshots, .torrent files, piece completion db) to newDir without restart:
+// all torrents are dropped, data moved (renamed, or copied if newDir is on other filesystem), storage re-targeted
+// to newDir, torrents re-added and re-verified. Interrupted move (ctx cancel, IO error) keeps original dir
+// and torrents are re-added there. newDir must not exist.
+// Data of torrents placed elsewhere by Cfg.DirSelector is gathered to newDir too, DirSelector is not used after:
+// it must be removed from config before next start. Refuses to move open db (Cfg.DBPath inside data dir).
+// Heavy: no download/upload until done.
+func (cli *Client) MigrateDataDir(ctx context.Context, newDir string) error {
+	routed, ok := cli.cfg.DefaultStorage.(*routedStorage)
+	if !cli.ownStorage || !ok {
+		return errors.New("can't migrate custom storage (Cfg.DefaultStorage)")
+	}
+	oldDir := cli.DataDir()
+	if filepath.Clean(newDir) == filepath.Clean(oldDir) {
+		return nil
+	}
+	if _, err := os.Stat(newDir); !os.IsNotExist(err) {
+		return fmt.Errorf("new data dir must not exist: %s", newDir)
+	}
+	if _, inside := relInside(oldDir, cli.cfg.DBPath); cli.cfg.DBPath != "" && inside {
+		return fmt.Errorf("db %s is inside data dir, open db can't be moved", cli.cfg.DBPath)
+	}
+	cli.restartLock.Lock()
+	defer cli.restartLock.Unlock()
+
+	torrents := cli.torrentsList()
+	cli.closeReaders()
+	for _, t := range cli.TorrentClient().Torrents() {
+		t.Drop()
+	}
+	if err := routed.Close(); err != nil {
+		log.Warn("[torrent] close storage", "err", err)
+	}
+
+	log.Info("[torrent] Moving data dir", "from", oldDir, "to", newDir, "torrents", len(torrents.hashes))
+	moveErr := cli.moveDataDirs(ctx, oldDir, newDir, torrents)
+	if moveErr == nil {
+		cli.dirLock.Lock()
+		cli.cfg.DataDir = newDir
+		cli.cfg.DirSelector = nil
+		cli.dirLock.Unlock()
+		routed.setSnapshotsDir(newDir, nil)
+	} else {
+		log.Error("[torrent] Move data dir failed, staying in original dir", "dir", oldDir, "err", moveErr)
+	}
+	if err := torrents.addTo(cli.TorrentClient(), cli.db, cli.addOptions(), cli.isPaused, cli.isDownloadPaused); err != nil {
+		return err
+	}
+	cli.applyPaused()
+	cli.addStaticPeers()
+	if moveErr != nil {
+		return fmt.Errorf("move data dir: %w", moveErr)
+	}
+	for _, t := range cli.TorrentClient().Torrents() {
+		if _, ok := torrents.known[t.InfoHash()]; ok {
+			go t.VerifyData()
+		}
+	}
+	return nil
+}
+
+// DataDir - current data dir, changed by MigrateDataDir
+func (cli *Client) DataDir() string {
+	cli.dirLock.RLock()
+	defer cli.dirLock.RUnlock()
+	return cli.cfg.DataDir
+}
+
+// torrentDir - root of torrent's files, see Cfg.DirSelector
+func (cli *Client) torrentDir(name string, infoHash metainfo.Hash) string {
+	cli.dirLock.RLock()
+	defer cli.dirLock.RUnlock()
+	return dataDir(cli.cfg.DataDir, cli.cfg.DirSelector, name, infoHash)
+}
+
+// moveDataDirs - moves oldDir to newDir, then files of torrents which DirSelector placed to other dirs. On failure
+// all moved is moved back.
+func (cli *Client) moveDataDirs(ctx context.Context, oldDir, newDir string, torrents torrentsList) error {
+	if err := moveDir(ctx, oldDir, newDir); err != nil {
+		return err
+	}
+	type placed struct {
+		dir  string
+		info *metainfo.Info
+	}
+	var moved []placed
+	var err error
+	for hash, mi := range torrents.known {
+		var info metainfo.Info
+		if info, err = mi.UnmarshalInfo(); err != nil {
+			break
+		}
+		dir := dataDir(oldDir, cli.cfg.DirSelector, info.Name, hash)
+		if filepath.Clean(dir) == filepath.Clean(oldDir) {
+			continue
+		}
+		if rel, inside := relInside(oldDir, dir); inside { // moved with oldDir
+			dir = filepath.Join(newDir, rel)
+		}
+		if !filesExist(dir, &info) { // not downloaded yet
+			continue
+		}
+		moved = append(moved, placed{dir: dir, info: &info})
+		if err = moveFiles(dir, newDir, &info); err != nil {
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	for _, p := range moved {
+		if err := moveFiles(newDir, p.dir, p.info); err != nil {
+			log.Warn("[torrent] Move files back", "torrent", p.info.Name, "to", p.dir, "err", err)
+		}
+	}
+	if err := moveDir(context.Background(), newDir, oldDir); err != nil {
+		log.Error("[torrent] Move data dir back", "from", newDir, "to", oldDir, "err", err)
+	}
+	return err
+}
+
+// relInside - path relative to dir, if path is inside dir
+func relInside(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// moveDir - rename, or copy+remove if dirs are on different filesystems. src is untouched until copy is complete,
+// on failure partial copy is removed.
+func moveDir(ctx context.Context, src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	var linkErr *os.LinkError
+	if err == nil || !errors.As(err, &linkErr) || !errors.Is(linkErr.Err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyDir(ctx, src, dst); err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyDir(ctx context.Context, src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm())
+		}
+		return copyFile(path, target)
+	})
+}
@@ -0,0 +1,254 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	common2 "github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// All state of downloader is stored in kv.BittorrentInfo table, keys are prefixed by kind of record
+
+func infoBytesKey(infoHash metainfo.Hash) []byte {
+	return append([]byte("info_"), infoHash[:]...)
+}
+
+// saveInfoBytes - caches torrent's metadata, to not resolve it from network after restart
+func saveInfoBytes(db kv.RwDB, infoHash metainfo.Hash, infoBytes []byte) error {
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		return tx.Put(kv.BittorrentInfo, infoBytesKey(infoHash), infoBytes)
+	})
+}
+
+func readInfoBytes(db kv.RoDB, infoHash metainfo.Hash) (infoBytes []byte, err error) {
+	if err = db.View(context.Background(), func(tx kv.Tx) error {
+		v, err := tx.GetOne(kv.BittorrentInfo, infoBytesKey(infoHash))
+		if err != nil {
+			return fmt.Errorf("get info bytes: %w", err)
+		}
+		infoBytes = common2.Copy(v)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return infoBytes, nil
+}
+
+func deleteInfoBytes(db kv.RwDB, infoHash metainfo.Hash) error {
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		return tx.Delete(kv.BittorrentInfo, infoBytesKey(infoHash), nil)
+	})
+}
+
+const pausedPrefix = "paused_"
+
+func savePaused(db kv.RwDB, infoHash metainfo.Hash, paused bool) error {
+	k := append([]byte(pausedPrefix), infoHash[:]...)
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		if paused {
+			return tx.Put(kv.BittorrentInfo, k, []byte{1})
+		}
+		return tx.Delete(kv.BittorrentInfo, k, nil)
+	})
+}
+
+// savePausedSet - pause and resume torrents in one transaction
+func savePausedSet(db kv.RwDB, pause, resume []metainfo.Hash) error {
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		for _, infoHash := range pause {
+			if err := tx.Put(kv.BittorrentInfo, append([]byte(pausedPrefix), infoHash[:]...), []byte{1}); err != nil {
+				return err
+			}
+		}
+		for _, infoHash := range resume {
+			if err := tx.Delete(kv.BittorrentInfo, append([]byte(pausedPrefix), infoHash[:]...), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readPaused(db kv.RoDB) (map[metainfo.Hash]struct{}, error) {
+	res := map[metainfo.Hash]struct{}{}
+	if err := db.View(context.Background(), func(tx kv.Tx) error {
+		return tx.ForPrefix(kv.BittorrentInfo, []byte(pausedPrefix), func(k, _ []byte) error {
+			var infoHash metainfo.Hash
+			copy(infoHash[:], k[len(pausedPrefix):])
+			res[infoHash] = struct{}{}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// downloadPausedPrefix - not "paused_..." - would match pausedPrefix
+const downloadPausedPrefix = "dlpaused_"
+
+func saveDownloadPaused(db kv.RwDB, infoHash metainfo.Hash, paused bool) error {
+	k := append([]byte(downloadPausedPrefix), infoHash[:]...)
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		if paused {
+			return tx.Put(kv.BittorrentInfo, k, []byte{1})
+		}
+		return tx.Delete(kv.BittorrentInfo, k, nil)
+	})
+}
+
+func readDownloadPaused(db kv.RoDB) (map[metainfo.Hash]struct{}, error) {
+	res := map[metainfo.Hash]struct{}{}
+	if err := db.View(context.Background(), func(tx kv.Tx) error {
+		return tx.ForPrefix(kv.BittorrentInfo, []byte(downloadPausedPrefix), func(k, _ []byte) error {
+			var infoHash metainfo.Hash
+			copy(infoHash[:], k[len(downloadPausedPrefix):])
+			res[infoHash] = struct{}{}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+const quotaPrefix = "quota_"
+
+func saveQuotaUsed(db kv.RwDB, period string, used uint64) error {
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, used)
+		return tx.Put(kv.BittorrentInfo, []byte(quotaPrefix+period), v)
+	})
+}
+
+func readQuotaUsed(db kv.RoDB, period string) (used uint64, err error) {
+	if err = db.View(context.Background(), func(tx kv.Tx) error {
+		v, err := tx.GetOne(kv.BittorrentInfo, []byte(quotaPrefix+period))
+		if err != nil {
+			return err
+		}
+		if len(v) == 8 {
+			used = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// auditPrefix - keys are prefix + big-endian unix nanos + infohash: ordered by time
+const auditPrefix = "audit_"
+
+func auditKey(t time.Time, infoHash metainfo.Hash) []byte {
+	k := make([]byte, len(auditPrefix)+8, len(auditPrefix)+8+len(infoHash))
+	copy(k, auditPrefix)
+	var ts uint64
+	if t.After(time.Unix(0, 0)) {
+		ts = uint64(t.UnixNano())
+	}
+	binary.BigEndian.PutUint64(k[len(auditPrefix):], ts)
+	return append(k, infoHash[:]...)
+}
+
+func saveAuditEvent(db kv.RwDB, ev AuditEvent) error {
+	v, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		return tx.Put(kv.BittorrentInfo, auditKey(ev.Time, ev.InfoHash), v)
+	})
+}
+
+func readAuditEvents(db kv.RoDB, since time.Time) (res []AuditEvent, err error) {
+	if err = db.View(context.Background(), func(tx kv.Tx) error {
+		from := auditKey(since, metainfo.Hash{})
+		return tx.ForPrefix(kv.BittorrentInfo, []byte(auditPrefix), func(k, v []byte) error {
+			if bytes.Compare(k, from) < 0 {
+				return nil
+			}
+			var ev AuditEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return fmt.Errorf("audit event %x: %w", k, err)
+			}
+			res = append(res, ev)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// verifiedAtPrefix - time when torrent's completion was recorded: downloaded or re-hashed, see StartupVerifyPolicy
+const verifiedAtPrefix = "verified_"
+
+func saveVerifiedAt(db kv.RwDB, infoHash metainfo.Hash, t time.Time) error {
+	k := append([]byte(verifiedAtPrefix), infoHash[:]...)
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(t.Unix()))
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		return tx.Put(kv.BittorrentInfo, k, v)
+	})
+}
+
+// readVerifiedAt - zero time if never recorded
+func readVerifiedAt(db kv.RoDB, infoHash metainfo.Hash) (t time.Time, err error) {
+	k := append([]byte(verifiedAtPrefix), infoHash[:]...)
+	if err = db.View(context.Background(), func(tx kv.Tx) error {
+		v, err := tx.GetOne(kv.BittorrentInfo, k)
+		if err != nil {
+			return err
+		}
+		if len(v) == 8 {
+			t = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		}
+		return nil
+	}); err != nil {
+		return time.Time{}, err
+	}
+	return t, nil
+}
+
+// completedAtPrefix - wall-clock time when torrent first reached Complete
+const completedAtPrefix = "completed_"
+
+// saveCompletedAt - keeps first time, doesn't overwrite
+func saveCompletedAt(db kv.RwDB, infoHash metainfo.Hash, t time.Time) error {
+	k := append([]byte(completedAtPrefix), infoHash[:]...)
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		v, err := tx.GetOne(kv.BittorrentInfo, k)
+		if err != nil || len(v) > 0 {
+			return err
+		}
+		v = make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(t.Unix()))
+		return tx.Put(kv.BittorrentInfo, k, v)
+	})
+}
+
+func readCompletedAt(db kv.RoDB) (map[metainfo.Hash]time.Time, error) {
+	res := map[metainfo.Hash]time.Time{}
+	if err := db.View(context.Background(), func(tx kv.Tx) error {
+		return tx.ForPrefix(kv.BittorrentInfo, []byte(completedAtPrefix), func(k, v []byte) error {
+			if len(v) != 8 {
+				return nil
+			}
+			var infoHash metainfo.Hash
+			copy(infoHash[:], k[len(completedAtPrefix):])
+			res[infoHash] = time.Unix(int64(binary.BigEndian.Uint64(v)), 0).UTC()
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
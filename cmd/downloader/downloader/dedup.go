@@ -0,0 +1,246 @@
+package downloader
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const dedupStoreDir = ".dedup"
+
+// dedupStorage - mmap storage which keeps content-addressed store of complete files (hardlinks in dir/.dedup):
+// when torrent is opened, its absent file which content is already in store is hardlinked instead of downloaded.
+// File's address is hash of its length and piece hashes from metainfo - finding duplicates costs nothing, but
+// linked file is unknown to piece completion db: torrent lib re-hashes it (CPU and disk read of whole file)
+// before it's considered complete.
+// Only piece-aligned files can be deduplicated: Erigon's single-file torrents always are.
+// Linked files share data: before write to linked file (repair of bad piece) it's replaced by own copy (unshare).
+// Data is accessed by file backend, not mmap: mapping of replaced file would keep writing to shared inode.
+// Blobs which no file links to anymore (torrent removed, file replaced) are removed on start - linux only,
+// link count is needed.
+type dedupStorage struct {
+	dir   string
+	inner storage.ClientImplCloser
+}
+
+func newDedupStorage(dir string, completion storage.PieceCompletion) *dedupStorage {
+	gcDedupStore(filepath.Join(dir, dedupStoreDir))
+	return &dedupStorage{dir: dir, inner: storage.NewFileOpts(storage.NewFileClientOpts{ClientBaseDir: dir, PieceCompletion: completion})}
+}
+
+// gcDedupStore - removes blobs which are linked only by store
+func gcDedupStore(storeDir string) {
+	entries, err := os.ReadDir(storeDir)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		links, ok := linkCount(fi)
+		if !ok {
+			return
+		}
+		if links > 1 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(storeDir, e.Name())); err != nil {
+			log.Warn("[torrent] Dedup: remove unused", "file", e.Name(), "err", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Info("[torrent] Dedup: removed unused files from store", "files", removed)
+	}
+}
+
+// dedupFile - file of torrent which can be shared with other torrents
+type dedupFile struct {
+	path, blob  string
+	first, last int  // pieces
+	remaining   int  // not complete pieces
+	shared      bool // file is hardlink of blob
+}
+
+type dedupTorrent struct {
+	lock  sync.Mutex
+	files []*dedupFile
+}
+
+// dedupFiles - piece-aligned files of torrent and their addresses in store
+func (s *dedupStorage) dedupFiles(info *metainfo.Info) (res []*dedupFile) {
+	paths := filesPaths(s.dir, info)
+	var offset int64
+	for i, f := range info.UpvertedFiles() {
+		start, end := offset, offset+f.Length
+		offset = end
+		if f.Length == 0 || start%info.PieceLength != 0 || (end%info.PieceLength != 0 && end != info.TotalLength()) {
+			continue
+		}
+		first, last := int(start/info.PieceLength), int((end-1)/info.PieceLength)
+		key := sha1.New()
+		_ = binary.Write(key, binary.BigEndian, f.Length)
+		key.Write(info.Pieces[first*sha1.Size : (last+1)*sha1.Size])
+		res = append(res, &dedupFile{
+			path:  paths[i],
+			blob:  filepath.Join(s.dir, dedupStoreDir, hex.EncodeToString(key.Sum(nil))),
+			first: first,
+			last:  last,
+		})
+	}
+	return res
+}
+
+func (s *dedupStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	files := s.dedupFiles(info)
+	for _, f := range files {
+		if _, err := os.Stat(f.path); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(f.blob); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return storage.TorrentImpl{}, err
+		}
+		if err := os.Link(f.blob, f.path); err != nil {
+			log.Warn("[torrent] Dedup: link", "file", f.path, "err", err)
+			continue
+		}
+		f.shared = true
+		log.Info("[torrent] Dedup: file linked, will be verified", "file", f.path)
+	}
+	for _, f := range files {
+		if f.shared {
+			continue
+		}
+		st, err := os.Stat(f.path)
+		if err != nil {
+			continue
+		}
+		if blob, err := os.Stat(f.blob); err == nil && os.SameFile(st, blob) {
+			f.shared = true
+		}
+	}
+	ti, err := s.inner.OpenTorrent(info, infoHash)
+	if err != nil {
+		return ti, err
+	}
+	t := &dedupTorrent{files: files}
+	for _, f := range files {
+		for i := f.first; i <= f.last; i++ {
+			if !ti.Piece(info.Piece(i)).Completion().Complete {
+				f.remaining++
+			}
+		}
+		if f.remaining == 0 {
+			s.store(f)
+		}
+	}
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return dedupPiece{PieceImpl: ti.Piece(p), s: s, t: t, index: p.Index()}
+		},
+		Close:    ti.Close,
+		Capacity: ti.Capacity,
+	}, nil
+}
+
+// store - adds complete file to store, if store doesn't have its content yet
+// f must be locked by dedupTorrent.lock, or not shared yet
+func (s *dedupStorage) store(f *dedupFile) {
+	if _, err := os.Stat(f.blob); err == nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(f.blob), 0755); err != nil {
+		log.Warn("[torrent] Dedup: store", "file", f.path, "err", err)
+		return
+	}
+	if err := os.Link(f.path, f.blob); err != nil {
+		if !os.IsExist(err) {
+			log.Warn("[torrent] Dedup: store", "file", f.path, "err", err)
+		}
+		return
+	}
+	f.shared = true
+}
+
+// unshare - shared files of piece are replaced by own copies, called before write
+func (t *dedupTorrent) unshare(piece int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, f := range t.files {
+		if !f.shared || piece < f.first || piece > f.last {
+			continue
+		}
+		if err := copyFile(f.path, f.path); err != nil {
+			return fmt.Errorf("dedup: unshare %s: %w", f.path, err)
+		}
+		f.shared = false
+		log.Info("[torrent] Dedup: file is written, replaced link by own copy", "file", f.path)
+	}
+	return nil
+}
+
+func (s *dedupStorage) Close() error {
+	return s.inner.Close()
+}
+
+type dedupPiece struct {
+	storage.PieceImpl
+	s     *dedupStorage
+	t     *dedupTorrent
+	index int
+}
+
+func (p dedupPiece) WriteAt(b []byte, off int64) (int, error) {
+	if err := p.t.unshare(p.index); err != nil {
+		return 0, err
+	}
+	return p.PieceImpl.WriteAt(b, off)
+}
+
+func (p dedupPiece) MarkComplete() error {
+	wasComplete := p.PieceImpl.Completion().Complete
+	if err := p.PieceImpl.MarkComplete(); err != nil || wasComplete {
+		return err
+	}
+	p.t.lock.Lock()
+	defer p.t.lock.Unlock()
+	for _, f := range p.t.files {
+		if p.index < f.first || p.index > f.last {
+			continue
+		}
+		if f.remaining--; f.remaining == 0 {
+			p.s.store(f)
+		}
+	}
+	return nil
+}
+
+func (p dedupPiece) MarkNotComplete() error {
+	wasComplete := p.PieceImpl.Completion().Complete
+	if err := p.PieceImpl.MarkNotComplete(); err != nil || !wasComplete {
+		return err
+	}
+	p.t.lock.Lock()
+	defer p.t.lock.Unlock()
+	for _, f := range p.t.files {
+		if p.index >= f.first && p.index <= f.last {
+			f.remaining++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package downloader
+
+import (
+	"os"
+	"syscall"
+)
+
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
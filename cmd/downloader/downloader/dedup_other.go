@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package downloader
+
+import "os"
+
+// linkCount - implemented only for linux, store of dedupStorage is not garbage-collected on other platforms
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
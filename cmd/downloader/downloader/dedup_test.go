@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupStorageSavesSpace(t *testing.T) {
+	require := require.New(t)
+	src, dir := t.TempDir(), t.TempDir()
+	const size = 4*DefaultPieceSize + 123
+	createTestSegment(t, src, "v1-000000-000500-bodies.seg", size)
+	data, err := os.ReadFile(filepath.Join(src, "v1-000000-000500-bodies.seg"))
+	require.NoError(err)
+	require.NoError(os.WriteFile(filepath.Join(src, "v2-000000-000500-bodies.seg"), data, 0644))
+	infoA, err := BuildInfoBytesForFile(src, "v1-000000-000500-bodies.seg")
+	require.NoError(err)
+	infoB, err := BuildInfoBytesForFile(src, "v2-000000-000500-bodies.seg")
+	require.NoError(err)
+
+	s := newDedupStorage(dir, storage.NewMapPieceCompletion())
+	defer s.Close()
+	// download A
+	ta, err := s.OpenTorrent(infoA, metainfo.Hash{1})
+	require.NoError(err)
+	for i := 0; i < infoA.NumPieces(); i++ {
+		p := infoA.Piece(i)
+		pi := ta.Piece(p)
+		_, err = pi.WriteAt(data[p.Offset():p.Offset()+p.Length()], 0)
+		require.NoError(err)
+		require.NoError(pi.MarkComplete())
+	}
+	require.NoError(ta.Close())
+	// B has same content: linked, not downloaded
+	tb, err := s.OpenTorrent(infoB, metainfo.Hash{2})
+	require.NoError(err)
+	defer tb.Close()
+
+	a, b := filepath.Join(dir, infoA.Name), filepath.Join(dir, infoB.Name)
+	stA, err := os.Stat(a)
+	require.NoError(err)
+	stB, err := os.Stat(b)
+	require.NoError(err)
+	require.True(os.SameFile(stA, stB))
+	logical, physical := stA.Size()+stB.Size(), stA.Size()
+	t.Logf("logical %d bytes, on disk %d bytes, saved %.0f%%", logical, physical, 100*float64(logical-physical)/float64(logical))
+	require.Equal(int64(size), logical-physical)
+
+	got, err := os.ReadFile(b)
+	require.NoError(err)
+	require.Equal(data, got)
+}
+
+func TestDedupWriteUnshares(t *testing.T) {
+	require := require.New(t)
+	src, dir := t.TempDir(), t.TempDir()
+	const size = 2 * DefaultPieceSize
+	createTestSegment(t, src, "v1-000000-000500-bodies.seg", size)
+	data, err := os.ReadFile(filepath.Join(src, "v1-000000-000500-bodies.seg"))
+	require.NoError(err)
+	require.NoError(os.WriteFile(filepath.Join(src, "v2-000000-000500-bodies.seg"), data, 0644))
+	infoA, err := BuildInfoBytesForFile(src, "v1-000000-000500-bodies.seg")
+	require.NoError(err)
+	infoB, err := BuildInfoBytesForFile(src, "v2-000000-000500-bodies.seg")
+	require.NoError(err)
+
+	s := newDedupStorage(dir, storage.NewMapPieceCompletion())
+	defer s.Close()
+	ta, err := s.OpenTorrent(infoA, metainfo.Hash{1})
+	require.NoError(err)
+	for i := 0; i < infoA.NumPieces(); i++ {
+		p := infoA.Piece(i)
+		pi := ta.Piece(p)
+		_, err = pi.WriteAt(data[p.Offset():p.Offset()+p.Length()], 0)
+		require.NoError(err)
+		require.NoError(pi.MarkComplete())
+	}
+	require.NoError(ta.Close())
+	tb, err := s.OpenTorrent(infoB, metainfo.Hash{2})
+	require.NoError(err)
+	defer tb.Close()
+
+	// repair of B's piece must not touch A
+	pb := tb.Piece(infoB.Piece(0))
+	require.NoError(pb.MarkNotComplete())
+	garbage := bytes.Repeat([]byte{1}, int(infoB.Piece(0).Length()))
+	_, err = pb.WriteAt(garbage, 0)
+	require.NoError(err)
+	a, b := filepath.Join(dir, infoA.Name), filepath.Join(dir, infoB.Name)
+	gotA, err := os.ReadFile(a)
+	require.NoError(err)
+	require.Equal(data, gotA)
+	gotB, err := os.ReadFile(b)
+	require.NoError(err)
+	require.Equal(garbage, gotB[:len(garbage)])
+	stA, err := os.Stat(a)
+	require.NoError(err)
+	stB, err := os.Stat(b)
+	require.NoError(err)
+	require.False(os.SameFile(stA, stB))
+}
+
+func TestDedupStoreGC(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("store is garbage-collected only on linux")
+	}
+	require := require.New(t)
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, dedupStoreDir)
+	require.NoError(os.MkdirAll(storeDir, 0755))
+	require.NoError(os.WriteFile(filepath.Join(storeDir, "unused"), []byte{1}, 0644))
+	require.NoError(os.WriteFile(filepath.Join(storeDir, "used"), []byte{2}, 0644))
+	require.NoError(os.Link(filepath.Join(storeDir, "used"), filepath.Join(dir, "v1-000000-000500-bodies.seg")))
+
+	s := newDedupStorage(dir, storage.NewMapPieceCompletion())
+	defer s.Close()
+	require.NoFileExists(filepath.Join(storeDir, "unused"))
+	require.FileExists(filepath.Join(storeDir, "used"))
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// dhtNodePrefix - key is prefix + binary krpc.NodeInfo, value is empty
+const dhtNodePrefix = "dht_node_"
+
+// bootstrapNodes - DHT starting nodes getter for private DHT networks
+func bootstrapNodes(network string, nodes []string) dht.StartingNodesGetter {
+	return func() (addrs []dht.Addr, err error) {
+		for _, n := range nodes {
+			addr, err := net.ResolveUDPAddr(network, n)
+			if err != nil {
+				return nil, fmt.Errorf("dht bootstrap node %q: %w", n, err)
+			}
+			addrs = append(addrs, dht.NewAddr(addr))
+		}
+		return addrs, nil
+	}
+}
+
+func saveDhtNodes(db kv.RwDB, nodes []krpc.NodeInfo) error {
+	return db.Update(context.Background(), func(tx kv.RwTx) error {
+		var old [][]byte
+		if err := tx.ForPrefix(kv.BittorrentInfo, []byte(dhtNodePrefix), func(k, _ []byte) error {
+			old = append(old, append([]byte{}, k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := tx.Delete(kv.BittorrentInfo, k, nil); err != nil {
+				return err
+			}
+		}
+		for _, ni := range nodes {
+			v, err := ni.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(kv.BittorrentInfo, append([]byte(dhtNodePrefix), v...), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readDhtNodes(db kv.RoDB) (nodes []krpc.NodeInfo, err error) {
+	if err = db.View(context.Background(), func(tx kv.Tx) error {
+		return tx.ForPrefix(kv.BittorrentInfo, []byte(dhtNodePrefix), func(k, _ []byte) error {
+			var ni krpc.NodeInfo
+			if err := ni.UnmarshalBinary(k[len(dhtNodePrefix):]); err != nil {
+				return fmt.Errorf("dht node %x: %w", k, err)
+			}
+			nodes = append(nodes, ni)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func dhtServers(torrentClient *torrent.Client) (res []*dht.Server) {
+	for _, s := range torrentClient.DhtServers() {
+		if w, ok := s.(torrent.AnacrolixDhtServerWrapper); ok {
+			res = append(res, w.Server)
+		}
+	}
+	return res
+}
+
+// loadDhtRoutingTable - warm start of DHT: routing table of previous run, instead of rebuilding it from bootstrap nodes
+func loadDhtRoutingTable(torrentClient *torrent.Client, db kv.RoDB) error {
+	nodes, err := readDhtNodes(db)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, s := range dhtServers(torrentClient) {
+		for _, ni := range nodes {
+			if s.AddNode(ni) == nil { // ipv4 nodes don't fit ipv6 server and vice versa
+				added++
+			}
+		}
+	}
+	log.Debug("[torrent] Loaded DHT routing table", "nodes", added)
+	return nil
+}
+
+func saveDhtRoutingTable(torrentClient *torrent.Client, db kv.RwDB) error {
+	var nodes []krpc.NodeInfo
+	for _, s := range dhtServers(torrentClient) {
+		nodes = append(nodes, s.Nodes()...)
+	}
+	if len(nodes) == 0 { // keep routing table of previous run
+		return nil
+	}
+	return saveDhtNodes(db, nodes)
+}
@@ -0,0 +1,67 @@
+package downloader
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+)
+
+// DialSocket - socket options of outbound TCP peer connections. Zero value - torrent lib's defaults: no reuse
+// options, source port is chosen by OS from its ephemeral range. Supported only on linux (Validate fails
+// elsewhere). uTP dials go through listen socket of torrent lib and are not affected.
+type DialSocket struct {
+	// ReuseAddr - SO_REUSEADDR: source port can be bound again while previous connection from it is in TIME_WAIT,
+	// matters with narrow PortMin-PortMax range
+	ReuseAddr bool
+	// ReusePort - SO_REUSEPORT: source port can be shared with other sockets which set it too (linux >= 3.9)
+	ReusePort bool
+	// PortMin, PortMax - optional, source ports of outbound connections are taken from this range instead of OS
+	// ephemeral range (net.ipv4.ip_local_port_range), e.g. to match egress firewall rules. Both set or none.
+	PortMin, PortMax int
+}
+
+func (s DialSocket) isZero() bool { return s == DialSocket{} }
+
+// Validate - range and platform support
+func (s DialSocket) Validate() error {
+	if s.isZero() {
+		return nil
+	}
+	if s.PortMin != 0 || s.PortMax != 0 {
+		if err := validatePort(s.PortMin); err != nil {
+			return fmt.Errorf("dial port min: %w", err)
+		}
+		if err := validatePort(s.PortMax); err != nil {
+			return fmt.Errorf("dial port max: %w", err)
+		}
+		if s.PortMin == 0 || s.PortMax == 0 || s.PortMin > s.PortMax {
+			return fmt.Errorf("dial port range must be 1 <= min <= max: [%d, %d]", s.PortMin, s.PortMax)
+		}
+	}
+	return dialSocketSupported()
+}
+
+var (
+	dialSocketLock      sync.Mutex
+	dialSocketInstalled *DialSocket
+)
+
+// installDialSocket - torrent lib dials TCP by process-wide torrent.DefaultNetDialer: options are installed
+// once, before first client with them is created. Clients of same process can't use different options.
+func installDialSocket(s DialSocket) error {
+	if s.isZero() {
+		return nil
+	}
+	dialSocketLock.Lock()
+	defer dialSocketLock.Unlock()
+	if dialSocketInstalled != nil {
+		if *dialSocketInstalled != s {
+			return fmt.Errorf("dial socket options already installed in this process: %+v", *dialSocketInstalled)
+		}
+		return nil
+	}
+	torrent.DefaultNetDialer.Control = s.control
+	dialSocketInstalled = &s
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func dialSocketSupported() error {
+	return nil
+}
+
+// control - net.Dialer.Control: runs after socket is created and before it connects
+func (s DialSocket) control(network, address string, c syscall.RawConn) error {
+	var optErr error
+	if err := c.Control(func(fd uintptr) {
+		optErr = s.setOptions(int(fd), strings.HasSuffix(network, "6"))
+	}); err != nil {
+		return err
+	}
+	return optErr
+}
+
+func (s DialSocket) setOptions(fd int, ipv6 bool) error {
+	if s.ReuseAddr {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return fmt.Errorf("SO_REUSEADDR: %w", err)
+		}
+	}
+	if s.ReusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("SO_REUSEPORT: %w", err)
+		}
+	}
+	if s.PortMin == 0 {
+		return nil
+	}
+	// start from random port of range - to not collide on first ports with parallel dials
+	n := s.PortMax - s.PortMin + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := s.PortMin + (start+i)%n
+		var sa unix.Sockaddr = &unix.SockaddrInet4{Port: port}
+		if ipv6 {
+			sa = &unix.SockaddrInet6{Port: port}
+		}
+		err := unix.Bind(fd, sa)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.EADDRINUSE) {
+			return fmt.Errorf("bind source port %d: %w", port, err)
+		}
+	}
+	return fmt.Errorf("no free source port in [%d, %d]", s.PortMin, s.PortMax)
+}
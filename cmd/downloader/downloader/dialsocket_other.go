@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package downloader
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// dialSocketSupported - socket options are implemented only for linux
+func dialSocketSupported() error {
+	return fmt.Errorf("dial socket options are not supported on %s", runtime.GOOS)
+}
+
+func (s DialSocket) control(network, address string, c syscall.RawConn) error {
+	return dialSocketSupported()
+}
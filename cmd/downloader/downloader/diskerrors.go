@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// watchStorageErrors - called by MainLoop every tick: replaces library's default chunk write error handler
+// (which only logs), torrents added since last tick get it too. Cheap - just sets handler.
+func (cli *Client) watchStorageErrors(t *torrent.Torrent) {
+	hash := t.InfoHash()
+	t.SetOnWriteChunkError(func(err error) { cli.onStorageError(t, hash, err) })
+}
+
+// onStorageError - like library's default: download of torrent is disabled, retrying writes to failed disk
+// only wastes bandwidth. Error is kept until ResumeDownload, see StorageErrors.
+func (cli *Client) onStorageError(t *torrent.Torrent, hash metainfo.Hash, err error) {
+	t.DisallowDataDownload()
+	cli.lock.Lock()
+	_, seen := cli.storageErrors[hash]
+	cli.storageErrors[hash] = err
+	cli.lock.Unlock()
+	if !seen {
+		log.Error("[torrent] Storage write failed, download disabled", "torrent", t.Name(), "err", err)
+	}
+	if cli.cfg.OnStorageError != nil {
+		cli.cfg.OnStorageError(hash, err)
+	}
+	cli.events.queue(hash, StorageError{InfoHash: hash, Err: err})
+}
+
+// StorageErrors - latest write error of torrents which download is disabled because of it.
+// ResumeDownload clears error and enables download again (once disk is fixed).
+func (cli *Client) StorageErrors() map[metainfo.Hash]error {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	res := make(map[metainfo.Hash]error, len(cli.storageErrors))
+	for hash, err := range cli.storageErrors {
+		res[hash] = err
+	}
+	return res
+}
+
+func (cli *Client) hasStorageError(hash metainfo.Hash) bool {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	_, ok := cli.storageErrors[hash]
+	return ok
+}
@@ -2,10 +2,21 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"runtime"
+	dbg "runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/anacrolix/dht/v2"
 	lg "github.com/anacrolix/log"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
@@ -17,12 +28,258 @@ import (
 	"golang.org/x/time/rate"
 )
 
-const ASSERT = false
+var (
+	ErrTorrentNotFound = errors.New("torrent not found")
+	ErrNoMetadata      = errors.New("torrent metadata not resolved yet")
+	ErrTooManyTorrents = errors.New("too many torrents")
+	// ErrNoPreverified - snapshots download was requested with empty preverified list, see AddOptions.RequirePreverified
+	ErrNoPreverified = errors.New("preverified snapshots list is empty")
+	// ErrPortInUse - ListenPort is taken by other process (maybe another downloader), see Cfg.AnyPortIfBusy
+	ErrPortInUse = errors.New("listen port is already in use")
+)
 
 type Client struct {
-	Client *torrent.Client
+	torrentClient atomic.Value // *torrent.Client, replaced by watchdog's restart - see TorrentClient
+	cfg           *Cfg
+	db            kv.RwDB
+
+	completions *pieceCompletions
+	traffic     *peerTraffic
+	quota       downloadQuota                  // used only by MainLoop, except downloadQuota.carry
+	failover    map[metainfo.Hash]*trackerTier // used only by MainLoop
+
+	started       time.Time
+	completed     chan struct{}
+	completedOnce sync.Once
+	// completedTorrents - torrents seen complete by MainLoop, or completed before start (persisted completion
+	// times): webhooks and audit events are not repeated on restart. completedSinceStart - amount of others.
+	completedTorrents   map[metainfo.Hash]struct{}
+	completedSinceStart int
+	// verifiedTorrents - torrents which initial verification seen done by MainLoop
+	verifiedTorrents map[metainfo.Hash]struct{}
+
+	statsLock sync.RWMutex
+	stats     AggStats // latest, calculated by MainLoop
+	rates     torrentRates
+	session   sessionTraffic // see SessionRatio
+
+	lock      sync.RWMutex
+	unhealthy map[metainfo.Hash]error // torrents which caused panic inside torrent library
+	paused    map[metainfo.Hash]struct{}
+	// downloadPaused - see PauseDownload
+	downloadPaused map[metainfo.Hash]struct{}
+	readers        map[metainfo.Hash]torrent.Reader // see SetReadahead
+	excluded       map[metainfo.Hash][]string       // see ExcludeFiles
+	// storageErrors - torrents which download is disabled because chunk write failed, see StorageErrors
+	storageErrors map[metainfo.Hash]error
+	// reverifyQueue - see RequestReverify, reverifying - being re-verified
+	reverifyQueue, reverifying map[metainfo.Hash]struct{}
+	names                      map[metainfo.Hash]string // see Cfg.ExpectedNames, immutable
+
+	staticPeers []torrent.PeerInfo
+	lan         *lanPeers // nil if not Cfg.PreferLANPeers
+
+	trackerErrors   map[TrackerErrorClass]int
+	clockSkewChecks int
+	trackerProbes   map[string]time.Duration
+
+	uploadLimit rate.Limit // configured upload limit, applied when not throttled
+	// trackers - package's Trackers, or ones of Reconfigure. connsPerTorrent - set by Reconfigure, 0 - not set:
+	// ClientConfig is shared with torrent lib and is not changed after New
+	trackers        [][]string
+	connsPerTorrent int
+	uploadThrottled bool
+	bandwidth       *bandwidthShares
+	writes          *storageWrites
+	announcer       *externalAnnouncer // nil if Cfg.ExternalPort is not used
+	pieceEvents     *pieceEvents
+	events          *eventStream // see Events
+
+	closing     chan struct{}
+	closeOnce   sync.Once
+	restartLock sync.Mutex        // Close and watchdog's restart don't overlap
+	dirLock     sync.RWMutex      // cfg.DataDir and cfg.DirSelector, changed by MigrateDataDir
+	ownStorage  bool              // cfg.DefaultStorage created by New
+	callbacks   torrent.Callbacks // cfg.Callbacks before New installed own ones
+}
+
+// Cfg - torrent.ClientConfig plus settings of Erigon's downloader
+type Cfg struct {
+	*torrent.ClientConfig
+
+	// GeoResolver - optional, maps peer's IP to country or ASN label, see AggStats.PeersByGeo
+	GeoResolver GeoResolver
+
+	// DirSelector - optional, places torrents data to different directories (disks)
+	DirSelector DirSelector
+	// DBPath - optional, path of downloader db if it's inside DataDir: MigrateDataDir can't move open db
+	DBPath string
+
+	// CompletionFlushInterval - how often pieces completion state is written to disk.
+	// 0 (default) - write-through: every verified piece is persisted immediately, no progress lost on crash.
+	// >0 - less IO, but on crash progress verified in last interval is lost and will be verified again.
+	CompletionFlushInterval time.Duration
+
+	// Manifest - optional, file name -> hex sha256. Checked once all torrents complete, see VerifyAgainstManifest
+	Manifest map[string]string
+
+	// WebhookURL - optional, JSON WebhookPayload is POSTed there once all torrents complete
+	WebhookURL string
+	// WebhookPerTorrent - also POST when each torrent completes
+	WebhookPerTorrent bool
+
+	// DownloadQuota - max bytes to download per calendar month (UTC), persisted across restarts.
+	// Once exceeded - downloads paused until next month. 0 - unlimited.
+	DownloadQuota datasize.ByteSize
+
+	// DownloadOnly - once all torrents complete MainLoop drops them: no seeding, no announces.
+	// Unlike StopSeeding it's for all torrents.
+	DownloadOnly bool
+
+	// TrackerFailover - BEP 12 tiering: torrents announce to first tier of Trackers only, next tier is added
+	// when torrent has no active peers during this time. 0 (default) - announce to all tiers at once.
+	TrackerFailover time.Duration
+	// Passkey - optional, private trackers auth, see AddOptions.Passkey
+	Passkey string
+	// MaxTorrents - see AddOptions.MaxTorrents. 0 - DefaultMaxTorrents, negative - unlimited.
+	MaxTorrents int
+	// Magnets - optional, candidate magnet links of infohashes, see AddOptions.Magnets
+	Magnets map[metainfo.Hash][]string
+
+	// OnInitialVerifyComplete - optional, called by MainLoop once per torrent when hashing of its existing data
+	// is done and network download begins. Must not block.
+	OnInitialVerifyComplete func(infoHash metainfo.Hash)
+
+	// OnPieceComplete - optional, called for each piece verified and stored (also existing data verified on start),
+	// for incremental processing of downloaded data. Called from own goroutine in order of completion; while
+	// consumer is behind by more than 1024 pieces - events are dropped (logged). Also with custom
+	// ClientConfig.DefaultStorage: its pieces are wrapped.
+	OnPieceComplete func(infoHash metainfo.Hash, pieceIndex int)
+
+	// OnStorageError - optional, called when chunk of torrent couldn't be written to storage (disk full, IO error),
+	// on every failed write. Download of that torrent is disabled until ResumeDownload: embedder may pause other
+	// downloads, alert or move data to another disk. Called by torrent library's goroutine.
+	OnStorageError func(infoHash metainfo.Hash, err error)
+
+	// Private - closed distribution network: torrents created by downloader are private (BEP 27),
+	// DHT, PEX and trackers are disabled, peers are only StaticPeers
+	Private bool
+	// StaticPeers - optional, "host:port" of peers added to every torrent
+	StaticPeers []string
+
+	// DhtBootstrapNodes - optional, "host:port" of DHT starting nodes (private DHT networks). nil - public ones.
+	// Routing table is persisted in db anyway - restart doesn't need bootstrap.
+	DhtBootstrapNodes []string
+
+	// StartupVerify - whether to trust piece completion store on startup, see StartupVerifyPolicy
+	StartupVerify StartupVerifyPolicy
+
+	// LocalServiceDiscovery - find peers of same LAN by multicast announces (BEP 14), see runLSD.
+	// Ignored if Private: LSD announces infohashes to everyone in LAN.
+	LocalServiceDiscovery bool
+	// PreferLANPeers - peers with private addresses (RFC 1918, RFC 4193) are dialed before internet peers:
+	// found by LSD and ones torrent was connected to, see preferLANPeers
+	PreferLANPeers bool
+
+	// FileMode - optional, applied to data files of torrent once it's complete. 0 - keep as created (umask).
+	FileMode os.FileMode
+	// FileOwner - optional, applied to data files of torrent once it's complete. nil - keep.
+	FileOwner *FileOwner
+
+	// UploadFractionWhileDownloading - (0, 1): while any torrent is still downloading upload rate limit is
+	// reduced to this fraction, to leave uplink for download's ACKs. Restored once all complete.
+	// 0 - disabled. Has no effect if upload rate is unlimited.
+	UploadFractionWhileDownloading float64
+
+	// StagingDir - optional, torrents are downloaded there and moved to data dir only once complete and verified:
+	// Erigon never sees half-written files. Must differ from data dir.
+	StagingDir string
+
+	// ReadOnlyData - data dir is read-only (shared immutable volume of seed-only replicas): nothing is written
+	// there - no .torrent files, no data (download is disallowed), piece completion store is in CompletionDir.
+	// Data is read by StorageFile backend: mmap needs writable files.
+	ReadOnlyData bool
+	// CompletionDir - writable dir of piece completion store, required by ReadOnlyData
+	CompletionDir string
+
+	// HashOracleURL - optional, infohashes requested to download must be in authoritative list served there,
+	// see VerifyHashesAgainstOracle
+	HashOracleURL string
+
+	// PeerIdleTimeout - optional, connections which don't exchange data that long are closed (by MainLoop,
+	// once a minute) - freeing slots for useful peers. 0 - keep them (default).
+	PeerIdleTimeout time.Duration
+	// PeerChurnInterval - optional, how often torrent which connection slots are full drops a peer to make room for
+	// new ones (see churnSlowPeers): with low EstablishedConnsPerTorrent slots may be full of slow peers.
+	// 0 - disabled (default).
+	PeerChurnInterval time.Duration
+	// PeerChurnBelowRate - churn only torrents which download slower than this. 0 - regardless of rate.
+	PeerChurnBelowRate datasize.ByteSize
+	// MaxRequestsPerPeer - optional, max outstanding piece requests to one peer. More requests in flight fill
+	// links with high bandwidth-delay product (100 Mbit/s * 200ms RTT needs ~150 requests of 16KiB chunks), fewer
+	// save memory: each request is a chunk buffered on receive, and torrent lib caps in-flight requests by its
+	// write buffer (~960) anyway. Peer's own limit (usually 250 or less) is never exceeded.
+	// 0 - torrent lib's default (250 until peer tells own limit).
+	MaxRequestsPerPeer int
+	// KeepAliveInterval - optional, how long connection may be silent before keep-alive is sent. 0 - library's default (1 min).
+	KeepAliveInterval time.Duration
+
+	// Storage - backend of data files, used if DefaultStorage is not set. Empty - StorageAuto.
+	Storage StorageBackend
+	// BackendSelector - optional, backend per torrent (Storage for torrents it returns empty for).
+	// Used if DefaultStorage is not set.
+	BackendSelector BackendSelector
+
+	// Durability - fsync of verified pieces before they are marked complete, see DurabilityMode.
+	// Used if DefaultStorage is not set. Empty - DurabilityNone.
+	Durability DurabilityMode
+	// Scheduling - how download bandwidth is split between torrents in progress, see SchedulingPolicy.
+	// Empty - SchedulingFair.
+	Scheduling SchedulingPolicy
+	// FinishLineThreshold - completed fraction of torrent from which SchedulingFinishLine boosts it. 0 - 0.9
+	FinishLineThreshold float64
+
+	// CompletionFormat - persistence of piece completion store, see CompletionFormat. Used if DefaultStorage
+	// is not set. Empty - CompletionDefault.
+	CompletionFormat CompletionFormat
+
+	// ExpectedNames - optional, file name -> hex infohash (erigon-snapshots format, like snapshothashes.Mainnet):
+	// torrent which name differs from expected name of its infohash is not added, see NameForHash
+	ExpectedNames map[string]string
+
+	// RequirePreverified - download requests with empty list of snapshots fail, see AddOptions.RequirePreverified
+	RequirePreverified bool
+
+	// MaxVerifyingTorrents - how many torrents verify existing data at once on startup, see AddOptions.MaxVerifying.
+	// 0 - all at once.
+	MaxVerifyingTorrents int
+	// MaxResolvingTorrents - how many magnets resolve metadata at once, see AddOptions.MaxResolving. 0 - all at once.
+	MaxResolvingTorrents int
+
+	// ExternalPort - optional, port announced to trackers instead of ListenPort: behind NAT with static port forward
+	// peers must connect to external one. Torrent lib's tracker announces are disabled then, MainLoop announces
+	// itself (see externalAnnouncer). DHT and PEX still advertise ListenPort. 0 - announce ListenPort.
+	ExternalPort int
+	// AnyPortIfBusy - if ListenPort is in use: listen on free port chosen by OS (logged) instead of ErrPortInUse.
+	// Peers learn it from announces and DHT, but port forwarding of ListenPort (if any) doesn't work.
+	AnyPortIfBusy bool
+	// DialSocket - optional, socket options and source ports range of outbound TCP peer connections. Process-wide:
+	// installed into torrent.DefaultNetDialer by New.
+	DialSocket DialSocket
+
+	// NoProgressDeadline - optional, MainLoop returns NoProgressError (ErrNoProgress) if downloaded bytes don't grow
+	// that long, despite retries and re-announces - for unattended jobs which must terminate. 0 - wait forever.
+	NoProgressDeadline time.Duration
 }
 
+// FileOwner - uid/gid for os.Chown, -1 means "don't change"
+type FileOwner struct {
+	UID, GID int
+}
+
+// GeoResolver - embedder-provided IP-to-location function. Empty label means "unknown".
+type GeoResolver func(ip net.IP) string
+
 func DefaultTorrentConfig() *torrent.ClientConfig {
 	torrentConfig := torrent.NewDefaultClientConfig()
 
@@ -46,46 +303,232 @@ func DefaultTorrentConfig() *torrent.ClientConfig {
 	return torrentConfig
 }
 
-func TorrentConfig(snapshotsDir string, seeding bool, verbosity lg.Level, downloadRate, uploadRate datasize.ByteSize, torrentPort int) (*torrent.ClientConfig, error) {
-	torrentConfig := DefaultTorrentConfig()
-	torrentConfig.ListenPort = torrentPort
-	torrentConfig.Seed = seeding
-	torrentConfig.DataDir = snapshotsDir
-	torrentConfig.UpnpID = torrentConfig.UpnpID + "leecher"
-
-	// rates are divided by 2 - I don't know why it works, maybe bug inside torrent lib accounting
-	torrentConfig.UploadRateLimiter = rate.NewLimiter(rate.Limit(uploadRate.Bytes()/2), 2*DefaultPieceSize)     // default: unlimited
-	torrentConfig.DownloadRateLimiter = rate.NewLimiter(rate.Limit(downloadRate.Bytes()/2), 2*DefaultPieceSize) // default: unlimited
-
-	// debug
-	if lg.Debug == verbosity {
-		torrentConfig.Debug = true
-	}
-	torrentConfig.Logger = NewAdapterLogger().FilterLevel(verbosity)
+// TorrentConfig - positional form of Config.Cfg
+func TorrentConfig(snapshotsDir, stagingDir, proxyURL string, seeding bool, verbosity lg.Level, downloadRate, uploadRate datasize.ByteSize, torrentPort int) (*Cfg, error) {
+	return Config{
+		SnapshotsDir: snapshotsDir,
+		StagingDir:   stagingDir,
+		ProxyURL:     proxyURL,
+		Seeding:      seeding,
+		Verbosity:    verbosity,
+		ListenPort:   torrentPort,
+		DownloadRate: downloadRate,
+		UploadRate:   uploadRate,
+	}.Cfg()
+}
 
-	torrentConfig.DefaultStorage = storage.NewMMap(snapshotsDir)
-	return torrentConfig, nil
+func New(cfg *Cfg, downloaderDB kv.RwDB) (*Client, error) {
+	return newClient(cfg, downloaderDB, newEventStream(eventsBuffer))
 }
 
-func New(cfg *torrent.ClientConfig, downloaderDB kv.RwDB) (*Client, error) {
+// newClient - events stream is kept by watchdog's restart
+func newClient(cfg *Cfg, downloaderDB kv.RwDB, events *eventStream) (*Client, error) {
 	peerID, err := readPeerID(downloaderDB)
 	if err != nil {
 		return nil, fmt.Errorf("get peer id: %w", err)
 	}
 	cfg.PeerID = string(peerID)
-	torrentClient, err := torrent.NewClient(cfg)
+	if cfg.DownloadOnly {
+		cfg.Seed = false
+	}
+	if cfg.UploadFractionWhileDownloading < 0 || cfg.UploadFractionWhileDownloading >= 1 {
+		return nil, fmt.Errorf("UploadFractionWhileDownloading must be in [0, 1): %f", cfg.UploadFractionWhileDownloading)
+	}
+	if cfg.StagingDir != "" && filepath.Clean(cfg.StagingDir) == filepath.Clean(cfg.DataDir) {
+		return nil, fmt.Errorf("staging dir must differ from data dir: %s", cfg.StagingDir)
+	}
+	if _, err := ParseDurabilityMode(string(cfg.Durability)); err != nil {
+		return nil, err
+	}
+	if _, err := ParseSchedulingPolicy(string(cfg.Scheduling)); err != nil {
+		return nil, err
+	}
+	if err := validateFinishLineThreshold(cfg.FinishLineThreshold); err != nil {
+		return nil, err
+	}
+	completionFormat, err := ParseCompletionFormat(string(cfg.CompletionFormat))
+	if err != nil {
+		return nil, err
+	}
+	names, err := namesByHash(cfg.ExpectedNames)
 	if err != nil {
+		return nil, fmt.Errorf("expected names: %w", err)
+	}
+	if !validBackend(cfg.Storage) {
+		return nil, fmt.Errorf("unknown storage backend: %q", cfg.Storage)
+	}
+	if err := validateReadOnlyData(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.MaxRequestsPerPeer < 0 {
+		return nil, fmt.Errorf("MaxRequestsPerPeer must not be negative: %d", cfg.MaxRequestsPerPeer)
+	}
+	if err := validatePort(cfg.ExternalPort); err != nil {
+		return nil, fmt.Errorf("external port: %w", err)
+	}
+	if err := cfg.DialSocket.Validate(); err != nil {
+		return nil, err
+	}
+	if err := installDialSocket(cfg.DialSocket); err != nil {
+		return nil, err
+	}
+	var announcer *externalAnnouncer
+	if cfg.ExternalPort != 0 && cfg.ExternalPort != cfg.ListenPort && !cfg.DisableTrackers {
+		cfg.DisableTrackers = true
+		announcer = newExternalAnnouncer(cfg.ExternalPort)
+	}
+	if cfg.KeepAliveInterval > 0 {
+		cfg.KeepAliveTimeout = cfg.KeepAliveInterval
+	}
+	if cfg.Private {
+		cfg.NoDHT = true
+		cfg.DisablePEX = true
+		cfg.DisableTrackers = true
+	}
+	staticPeers, err := resolvePeers(cfg.StaticPeers)
+	if err != nil {
+		return nil, err
+	}
+	var lan *lanPeers
+	if cfg.PreferLANPeers {
+		lan = newLanPeers()
+	}
+	if len(cfg.DhtBootstrapNodes) > 0 {
+		cfg.DhtStartingNodes = func(network string) dht.StartingNodesGetter {
+			return bootstrapNodes(network, cfg.DhtBootstrapNodes)
+		}
+	}
+	paused, err := readPaused(downloaderDB)
+	if err != nil {
+		return nil, fmt.Errorf("read paused torrents: %w", err)
+	}
+	downloadPaused, err := readDownloadPaused(downloaderDB)
+	if err != nil {
+		return nil, fmt.Errorf("read download-paused torrents: %w", err)
+	}
+	completedAt, err := readCompletedAt(downloaderDB)
+	if err != nil {
+		return nil, fmt.Errorf("read completion times: %w", err)
+	}
+	completedTorrents := make(map[metainfo.Hash]struct{}, len(completedAt))
+	for hash := range completedAt {
+		completedTorrents[hash] = struct{}{}
+	}
+	callbacks := cfg.Callbacks
+	traffic := newPeerTraffic()
+	traffic.install(cfg.ClientConfig)
+	installMaxRequests(cfg.ClientConfig, cfg.MaxRequestsPerPeer)
+	completions := &pieceCompletions{buffered: cfg.CompletionFlushInterval > 0, format: completionFormat}
+	bandwidth := newBandwidthShares()
+	writes := &storageWrites{}
+	ownStorage := cfg.DefaultStorage == nil
+	pieceEvents := newPieceEvents(events, cfg.OnPieceComplete)
+	if !ownStorage {
+		cfg.DefaultStorage = notifyingStorage{ClientImpl: cfg.DefaultStorage, events: pieceEvents}
+	} else {
+		routed := newRoutedStorage(cfg.DataDir, cfg.DirSelector, cfg.BackendSelector, cfg.StagingDir, bandwidth, writes, cfg.Durability, func(dir, completionDir string, backend StorageBackend) storage.ClientImplCloser {
+			if backend == "" {
+				backend = cfg.Storage
+			}
+			if cfg.ReadOnlyData {
+				backend, completionDir = StorageFile, cfg.CompletionDir
+			}
+			return newStorageBackend(backend, dir, completions.open(completionDir))
+		})
+		routed.events = pieceEvents
+		cfg.DefaultStorage = routed
+	}
+	// closeStorage - on errors: own storage holds open files and mmaps
+	closeStorage := func() {
+		if closer, ok := cfg.DefaultStorage.(storage.ClientImplCloser); ok && ownStorage {
+			if err := closer.Close(); err != nil {
+				log.Warn("[torrent] close storage", "err", err)
+			}
+		}
+		pieceEvents.close()
+	}
+	torrentClient, err := torrent.NewClient(cfg.ClientConfig)
+	if err != nil && cfg.ListenPort != 0 && isAddrInUse(err) {
+		busy := cfg.ListenPort
+		if cfg.AnyPortIfBusy {
+			cfg.ListenPort = 0
+			if torrentClient, err = torrent.NewClient(cfg.ClientConfig); err == nil {
+				log.Warn("[torrent] Listen port is in use, listening on free port", "busy", busy, "port", torrentClient.LocalPort())
+			}
+		} else {
+			err = fmt.Errorf("%w: %d", ErrPortInUse, busy)
+		}
+	}
+	if err != nil {
+		closeStorage()
 		return nil, fmt.Errorf("fail to start torrent client: %w", err)
 	}
 	if len(peerID) == 0 {
 		if err = savePeerID(downloaderDB, torrentClient.PeerID()); err != nil {
+			torrentClient.Close()
+			closeStorage()
 			return nil, fmt.Errorf("save peer id: %w", err)
 		}
 	}
+	if !cfg.NoDHT {
+		if err = loadDhtRoutingTable(torrentClient, downloaderDB); err != nil {
+			log.Warn("[torrent] Load DHT routing table", "err", err)
+		}
+	}
+	uploadLimit := rate.Inf
+	if cfg.UploadRateLimiter != nil {
+		uploadLimit = cfg.UploadRateLimiter.Limit()
+	}
 
-	return &Client{
-		Client: torrentClient,
-	}, nil
+	cli := &Client{
+		cfg:               cfg,
+		db:                downloaderDB,
+		completions:       completions,
+		traffic:           traffic,
+		started:           time.Now(),
+		completed:         make(chan struct{}),
+		completedTorrents: completedTorrents,
+		verifiedTorrents:  map[metainfo.Hash]struct{}{},
+		failover:          map[metainfo.Hash]*trackerTier{},
+		unhealthy:         map[metainfo.Hash]error{},
+		paused:            paused,
+		downloadPaused:    downloadPaused,
+		storageErrors:     map[metainfo.Hash]error{},
+		reverifyQueue:     map[metainfo.Hash]struct{}{},
+		reverifying:       map[metainfo.Hash]struct{}{},
+		announcer:         announcer,
+		readers:           map[metainfo.Hash]torrent.Reader{},
+		excluded:          map[metainfo.Hash][]string{},
+		names:             names,
+		staticPeers:       staticPeers,
+		lan:               lan,
+		uploadLimit:       uploadLimit,
+		trackers:          Trackers,
+		bandwidth:         bandwidth,
+		writes:            writes,
+		pieceEvents:       pieceEvents,
+		events:            events,
+		closing:           make(chan struct{}),
+		ownStorage:        ownStorage,
+		callbacks:         callbacks,
+	}
+	cli.setTorrentClient(torrentClient)
+	return cli, nil
+}
+
+// TorrentClient - current torrent client. Don't keep it: watchdog (EnableAutoRestart) replaces dead one.
+func (cli *Client) TorrentClient() *torrent.Client {
+	torrentClient, _ := cli.torrentClient.Load().(*torrent.Client)
+	return torrentClient
+}
+
+func (cli *Client) setTorrentClient(torrentClient *torrent.Client) {
+	cli.torrentClient.Store(torrentClient)
+}
+
+// isAddrInUse - not all listeners of torrent lib (utp) wrap syscall error
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), "address already in use")
 }
 
 func savePeerID(db kv.RwDB, peerID torrent.PeerID) error {
@@ -108,103 +551,857 @@ func readPeerID(db kv.RoDB) (peerID []byte, err error) {
 	return peerID, nil
 }
 
+// SetPeerID - seeds peer ID which New() will use, allows to keep node's swarm identity when moving to new storage
+func SetPeerID(db kv.RwDB, id []byte) error {
+	var peerID torrent.PeerID
+	if len(id) != len(peerID) {
+		return fmt.Errorf("peer id must be %d bytes, got %d", len(peerID), len(id))
+	}
+	copy(peerID[:], id)
+	return savePeerID(db, peerID)
+}
+
 func (cli *Client) Close() {
-	for _, tr := range cli.Client.Torrents() {
+	cli.closeOnce.Do(func() { close(cli.closing) })
+	cli.restartLock.Lock()
+	defer cli.restartLock.Unlock()
+	cli.closeTorrentClient()
+	cli.events.close()
+}
+
+func (cli *Client) closeTorrentClient() {
+	cli.closeReaders()
+	if !cli.cfg.NoDHT {
+		if err := saveDhtRoutingTable(cli.TorrentClient(), cli.db); err != nil {
+			log.Warn("[torrent] Save DHT routing table", "err", err)
+		}
+	}
+	for _, tr := range cli.TorrentClient().Torrents() {
 		tr.Drop()
 	}
-	cli.Client.Close()
+	cli.TorrentClient().Close()
+	if closer, ok := cli.cfg.DefaultStorage.(storage.ClientImplCloser); ok {
+		if err := closer.Close(); err != nil {
+			log.Warn("[torrent] close storage", "err", err)
+		}
+	}
+	cli.pieceEvents.close()
+}
+
+// Completed - closed when all torrents are downloaded first time
+func (cli *Client) Completed() <-chan struct{} {
+	return cli.completed
+}
+
+// markTorrentCompleted - called by MainLoop for every complete torrent
+func (cli *Client) markTorrentCompleted(t *torrent.Torrent) {
+	if _, ok := cli.completedTorrents[t.InfoHash()]; ok {
+		return
+	}
+	assert(t.Info() != nil, "torrent completed without metadata", "hash", t.InfoHash())
+	cli.completedTorrents[t.InfoHash()] = struct{}{}
+	cli.completedSinceStart++
+	t, err := cli.promoteStaged(t)
+	if err != nil {
+		log.Error("[torrent] Move from staging dir", "torrent", t.Name(), "err", err)
+	}
+	audit(cli.db, AuditCompleted, t.InfoHash(), "", nil)
+	cli.events.publish(TorrentCompleted{InfoHash: t.InfoHash()})
+	if err := saveCompletedAt(cli.db, t.InfoHash(), time.Now()); err != nil {
+		log.Warn("[torrent] Save completion time", "torrent", t.Name(), "err", err)
+	}
+	if verifiedAt, err := readVerifiedAt(cli.db, t.InfoHash()); err == nil && verifiedAt.IsZero() {
+		if err := saveVerifiedAt(cli.db, t.InfoHash(), time.Now()); err != nil {
+			log.Warn("[torrent] Save verification time", "torrent", t.Name(), "err", err)
+		}
+	}
+	if cli.cfg.FileMode != 0 || cli.cfg.FileOwner != nil {
+		root := cli.torrentDir(t.Name(), t.InfoHash())
+		if err := setFilesPermissions(root, t, cli.cfg.FileMode, cli.cfg.FileOwner); err != nil {
+			log.Warn("[torrent] Set files permissions", "torrent", t.Name(), "err", err)
+		}
+	}
+	if cli.cfg.WebhookURL != "" && cli.cfg.WebhookPerTorrent {
+		sendWebhook(cli.cfg.WebhookURL, WebhookPayload{
+			Event:       WebhookTorrentCompleted,
+			InfoHashes:  []string{t.InfoHash().HexString()},
+			TotalBytes:  t.Length(),
+			DurationSec: time.Since(cli.started).Seconds(),
+		})
+	}
+}
+
+// markInitialVerifyComplete - called by MainLoop for every torrent with metadata
+func (cli *Client) markInitialVerifyComplete(t *torrent.Torrent) {
+	if _, ok := cli.verifiedTorrents[t.InfoHash()]; ok {
+		return
+	}
+	if checkingPieces(t) > 0 {
+		return
+	}
+	cli.verifiedTorrents[t.InfoHash()] = struct{}{}
+	log.Debug("[torrent] Initial verification done", "torrent", t.Name())
+	if cli.cfg.OnInitialVerifyComplete != nil {
+		cli.cfg.OnInitialVerifyComplete(t.InfoHash())
+	}
+}
+
+// CompletionTimes - when each torrent first reached Complete (UTC), persisted across restarts.
+// Torrents downloaded before this tracking existed get time of first start with it.
+func (cli *Client) CompletionTimes() map[metainfo.Hash]time.Time {
+	res, err := readCompletedAt(cli.db)
+	if err != nil {
+		log.Warn("[torrent] Read completion times", "err", err)
+		return map[metainfo.Hash]time.Time{}
+	}
+	return res
+}
+
+func (cli *Client) markCompleted(torrents []*torrent.Torrent) {
+	assert(len(torrents) > 0, "all completed without torrents")
+	cli.completedOnce.Do(func() {
+		close(cli.completed)
+		if cli.cfg.WebhookURL != "" && cli.completedSinceStart > 0 {
+			payload := WebhookPayload{Event: WebhookAllCompleted, DurationSec: time.Since(cli.started).Seconds()}
+			for _, t := range torrents {
+				payload.InfoHashes = append(payload.InfoHashes, t.InfoHash().HexString())
+				payload.TotalBytes += t.Length()
+			}
+			sendWebhook(cli.cfg.WebhookURL, payload)
+		}
+		if len(cli.cfg.Manifest) > 0 {
+			go func() {
+				err := VerifyAgainstManifest(cli.DataDir(), cli.cfg.Manifest)
+				if err != nil {
+					audit(cli.db, AuditVerifyFailed, metainfo.Hash{}, "manifest", err)
+					cli.events.queue(metainfo.Hash{}, VerifyFailed{Err: err})
+					log.Error("[torrent] Verify against manifest", "err", err)
+					return
+				}
+				audit(cli.db, AuditVerifyPassed, metainfo.Hash{}, "manifest", nil)
+				log.Info("[torrent] Verify against manifest succeed", "files", len(cli.cfg.Manifest))
+			}()
+		}
+	})
+}
+
+// stopAll - DownloadOnly mode: drop all torrents to stop any BitTorrent activity
+func (cli *Client) stopAll() {
+	for _, t := range cli.TorrentClient().Torrents() {
+		ch := t.Closed()
+		t.Drop()
+		<-ch
+	}
 }
 
 func (cli *Client) PeerID() []byte {
-	peerID := cli.Client.PeerID()
+	peerID := cli.TorrentClient().PeerID()
 	return peerID[:]
 }
 
-func MainLoop(ctx context.Context, torrentClient *torrent.Client) {
-	interval := time.Second * 5
-	logEvery := time.NewTicker(interval)
+// ExportPeerID - copy of peer ID, can be passed to SetPeerID of another node's db
+func (cli *Client) ExportPeerID() []byte {
+	return common2.Copy(cli.PeerID())
+}
+
+// Unhealthy - torrents which caused panic inside torrent library, MainLoop doesn't touch them
+func (cli *Client) Unhealthy() map[metainfo.Hash]error {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	res := make(map[metainfo.Hash]error, len(cli.unhealthy))
+	for h, err := range cli.unhealthy {
+		res[h] = err
+	}
+	return res
+}
+
+func (cli *Client) healthyTorrents() []*torrent.Torrent {
+	all := cli.TorrentClient().Torrents()
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	res := all[:0]
+	for _, t := range all {
+		if _, ok := cli.unhealthy[t.InfoHash()]; ok {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// safeTorrent - runs f, if torrent library panics - marks torrent unhealthy instead of crashing the node
+func (cli *Client) safeTorrent(t *torrent.Torrent, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("panic: %v", r)
+			log.Error("[torrent] Recovered, torrent marked unhealthy", "hash", t.InfoHash(), "err", err, "stack", dbg.Stack())
+			cli.lock.Lock()
+			cli.unhealthy[t.InfoHash()] = err
+			cli.lock.Unlock()
+		}
+	}()
+	f()
+}
+
+// allowedTorrents - torrents already allowed to download/upload while waiting for metadata,
+// MainLoop doesn't repeat it every tick
+type allowedTorrents map[metainfo.Hash]struct{}
+
+// allow - calls f once per torrent until forget called
+func (a allowedTorrents) allow(hash metainfo.Hash, f func()) {
+	if _, ok := a[hash]; ok {
+		return
+	}
+	a[hash] = struct{}{}
+	f()
+}
+
+// forget - when metadata resolved
+func (a allowedTorrents) forget(hash metainfo.Hash) { delete(a, hash) }
+
+// MainLoop - manages torrents and logs progress. Panics of torrent library don't crash the node:
+// MainLoop recovers and starts over.
+// exitOnComplete - return nil once all torrents are complete (one-shot download jobs), otherwise keep seeding
+// until ctx done.
+// Returns NoProgressError if download is stuck, see Cfg.NoProgressDeadline.
+func MainLoop(ctx context.Context, cli *Client, exitOnComplete bool) error {
+	if cli.cfg.LocalServiceDiscovery && !cli.cfg.Private {
+		go func() {
+			if err := cli.runLSD(ctx); err != nil {
+				log.Warn("[torrent] Local service discovery stopped", "err", err)
+			}
+		}()
+	}
+	go cli.probeTrackers(ctx) // then every 30 minutes by mainLoop
+	var progress progressWatch
+	for {
+		if stopped, err := mainLoop(ctx, cli, exitOnComplete, &progress); stopped {
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// statsInterval - how often MainLoop checks torrents and updates Stats
+var statsInterval = 5 * time.Second
+
+// mainLoop - returns false if recovered from panic
+func mainLoop(ctx context.Context, cli *Client, exitOnComplete bool, progress *progressWatch) (stopped bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("[torrent] MainLoop recovered from panic", "err", r, "stack", dbg.Stack())
+			stopped = ctx.Err() != nil
+		}
+	}()
+	logEvery := time.NewTicker(statsInterval)
 	defer logEvery.Stop()
+	var flushEvery <-chan time.Time
+	if cli.cfg.CompletionFlushInterval > 0 {
+		flushTicker := time.NewTicker(cli.cfg.CompletionFlushInterval)
+		defer flushTicker.Stop()
+		flushEvery = flushTicker.C
+	}
+	checkTrackersEvery := time.NewTicker(time.Minute)
+	defer checkTrackersEvery.Stop()
+	probeTrackersEvery := time.NewTicker(30 * time.Minute)
+	defer probeTrackersEvery.Stop()
+	swarmHealthEvery := time.NewTicker(time.Minute)
+	defer swarmHealthEvery.Stop()
+	var churnEvery <-chan time.Time
+	churnSamples := map[metainfo.Hash]churnSample{}
+	if cli.cfg.PeerChurnInterval > 0 {
+		churnTicker := time.NewTicker(cli.cfg.PeerChurnInterval)
+		defer churnTicker.Stop()
+		churnEvery = churnTicker.C
+	}
 	var m runtime.MemStats
 	var stats AggStats
+	statsAt := time.Now()
+	allowed := allowedTorrents{}
+	tracked := newEventsTracker()
+	throttle := newLogThrottle(logThrottleInterval)
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return true, nil
+		case <-probeTrackersEvery.C:
+			go cli.probeTrackers(ctx)
+		case <-swarmHealthEvery.C:
+			cli.logSwarmHealth()
+		case <-churnEvery:
+			cli.churnSlowPeers(churnSamples)
+		case <-checkTrackersEvery.C:
+			cli.checkTrackers()
+			cli.addStaticPeers()
+			if cli.lan != nil {
+				cli.preferLANPeers(cli.healthyTorrents())
+			}
+			if cli.cfg.PeerIdleTimeout > 0 {
+				cli.dropIdlePeers()
+			}
+		case <-flushEvery:
+			if err := cli.completions.Flush(); err != nil {
+				log.Warn("[torrent] Flush pieces completion", "err", err)
+			}
 		case <-logEvery.C:
-			torrents := torrentClient.Torrents()
+			torrents := cli.healthyTorrents()
 			allComplete := true
 			gotInfo := 0
+			var downloading []*torrent.Torrent
 			for _, t := range torrents {
-				select {
-				case <-t.GotInfo(): // all good
-					gotInfo++
-				default:
-					t.AllowDataUpload()
-					t.AllowDataDownload()
+				t := t
+				cli.safeTorrent(t, func() {
+					tracked.torrent(cli.events, t)
+					paused := cli.isPaused(t.InfoHash())
+					if paused {
+						t.DisallowDataDownload()
+						t.DisallowDataUpload()
+					}
+					cli.watchStorageErrors(t)
+					if conns := cli.reconfiguredConns(); conns > 0 { // torrents added after Reconfigure
+						t.SetMaxEstablishedConns(conns)
+					}
+					downloadPaused := cli.isDownloadPaused(t.InfoHash())
+					if downloadPaused {
+						t.DisallowDataDownload()
+					}
+					select {
+					case <-t.GotInfo(): // all good
+						gotInfo++
+						allowed.forget(t.InfoHash())
+						cli.markInitialVerifyComplete(t)
+						cli.applyExcluded(t)
+					default:
+						if !paused {
+							allowed.allow(t.InfoHash(), func() {
+								t.AllowDataUpload()
+								if !downloadPaused {
+									t.AllowDataDownload()
+								}
+							})
+						}
+					}
+					if !paused {
+						cli.checkTrackerFailover(t)
+						if cli.announcer != nil {
+							cli.announcer.maybeAnnounce(ctx, cli, t)
+						}
+					}
+					cli.events.flush(t.InfoHash())
+					complete := cli.torrentComplete(t)
+					if complete {
+						cli.markTorrentCompleted(t)
+					}
+					allComplete = allComplete && complete
+					if !complete && !paused && !downloadPaused && !cli.hasStorageError(t.InfoHash()) {
+						downloading = append(downloading, t)
+					}
+				})
+			}
+			if cli.announcer != nil {
+				cli.announcer.prune(torrents)
+			}
+			tracked.prune(cli.events, torrents, cli.TorrentClient().BadPeerIPs())
+			cli.pruneTrackerFailover(cli.TorrentClient().Torrents())
+			cli.events.flushAll()
+			cli.processReverify(ctx)
+			cli.throttleUpload(!allComplete)
+			cli.rebalanceBandwidth()
+			if err := cli.checkQuota(torrents); err != nil {
+				if ok, repeats, unchanged := throttle.check("quota", err.Error(), time.Now()); ok {
+					log.Warn("[torrent] Download quota", "err", err, "repeats", repeats, "unchanged", unchanged.Round(time.Second))
+				}
+			}
+			if cli.cfg.NoProgressDeadline > 0 {
+				if cli.quota.exceeded {
+					downloading = nil
+				}
+				if err := progress.check(cli.cfg.NoProgressDeadline, downloading, time.Now()); err != nil {
+					log.Error("[torrent] Giving up", "err", err)
+					return true, err
 				}
-				allComplete = allComplete && t.Complete.Bool()
 			}
 			if gotInfo < len(torrents) {
-				log.Info(fmt.Sprintf("[torrent] Waiting for torrents metadata: %d/%d", gotInfo, len(torrents)))
+				if ok, repeats, unchanged := throttle.check("metadata", fmt.Sprintf("%d/%d", gotInfo, len(torrents)), time.Now()); ok {
+					if repeats == 0 {
+						log.Info(fmt.Sprintf("[torrent] Waiting for torrents metadata: %d/%d", gotInfo, len(torrents)))
+					} else {
+						log.Info(fmt.Sprintf("[torrent] Still waiting for torrents metadata: %d/%d, last change %s ago", gotInfo, len(torrents), unchanged.Round(time.Second)))
+					}
+				}
 				continue
 			}
 
+			if allComplete && len(torrents) > 0 {
+				cli.markCompleted(torrents)
+				if cli.cfg.DownloadOnly {
+					cli.stopAll()
+					log.Info("[torrent] Download complete, stopped all torrents (download-only mode)")
+					return true, nil
+				}
+				if exitOnComplete {
+					log.Info("[torrent] Download complete")
+					return true, nil
+				}
+			}
+
 			runtime.ReadMemStats(&m)
-			stats = CalcStats(stats, interval, torrentClient)
+			// ticks are late or bunched under load: rates are of real time since previous sample
+			elapsed := time.Since(statsAt)
+			statsAt = time.Now()
+			stats = CalcStats(stats, elapsed, cli.TorrentClient(), cli.cfg.GeoResolver)
+			stats.PendingWrites, stats.WriteLoad = cli.writes.sample(elapsed)
+			stats.Bottleneck = bottleneck(stats.readBytesPerSec, stats.WriteLoad)
+			stats.FreeloaderRequestedBytes, stats.ReciprocalRequestedBytes = cli.traffic.split()
+			stats.Paused, stats.DownloadPaused = cli.pausedCounts()
+			stats.StorageErrors = len(cli.StorageErrors())
+			cli.rates.sample(torrents, time.Now())
+			cli.setStats(stats)
+			if len(stats.PeersByGeo) > 0 {
+				log.Info("[torrent] Peers", "by geo", stats.PeersByGeo)
+			}
 			if allComplete {
 				log.Info("[torrent] Seeding",
 					"download", common2.ByteCount(uint64(stats.readBytesPerSec))+"/s",
 					"upload", common2.ByteCount(uint64(stats.writeBytesPerSec))+"/s",
 					"peers", stats.peersCount,
 					"torrents", stats.torrentsCount,
+					"requested by freeloaders", common2.ByteCount(uint64(stats.FreeloaderRequestedBytes)),
+					"session ratio", fmt.Sprintf("%.2f", cli.SessionRatio()),
 					"alloc", common2.ByteCount(m.Alloc), "sys", common2.ByteCount(m.Sys))
 				continue
 			}
 
-			log.Info("[torrent] Downloading",
-				"Progress", fmt.Sprintf("%.2f%%", stats.Progress),
-				"download", common2.ByteCount(uint64(stats.readBytesPerSec))+"/s",
-				"upload", common2.ByteCount(uint64(stats.writeBytesPerSec))+"/s",
-				"peers", stats.peersCount,
-				"torrents", stats.torrentsCount,
-				"alloc", common2.ByteCount(m.Alloc), "sys", common2.ByteCount(m.Sys))
-			if stats.peersCount == 0 {
-				ips := torrentClient.BadPeerIPs()
-				if len(ips) > 0 {
-					log.Info("[torrent] Stats", "banned", ips)
-				}
+			if stats.Phase == PhaseVerifying {
+				log.Info("[torrent] Verifying",
+					"Progress", fmt.Sprintf("%.2f%%", stats.Progress),
+					"torrents", stats.torrentsCount,
+					"alloc", common2.ByteCount(m.Alloc), "sys", common2.ByteCount(m.Sys))
+				continue
+			}
+			log.Info("[torrent] Downloading",
+				"Progress", fmt.Sprintf("%.2f%%", stats.Progress),
+				"paused", stats.Paused, "download paused", stats.DownloadPaused,
+				"storage errors", stats.StorageErrors,
+				"download", common2.ByteCount(uint64(stats.readBytesPerSec))+"/s",
+				"upload", common2.ByteCount(uint64(stats.writeBytesPerSec))+"/s",
+				"peers", stats.peersCount,
+				"torrents", stats.torrentsCount,
+				"alloc", common2.ByteCount(m.Alloc), "sys", common2.ByteCount(m.Sys))
+			if stats.peersCount == 0 {
+				// peers count flapping around zero must not repeat same list every tick
+				ips := cli.TorrentClient().BadPeerIPs()
+				if ok, repeats, unchanged := throttle.check("banned", fmt.Sprint(ips), time.Now()); ok && len(ips) > 0 {
+					if repeats == 0 {
+						log.Info("[torrent] Stats", "banned", ips)
+					} else {
+						log.Info(fmt.Sprintf("[torrent] Still %d peers, banned list last change %s ago", stats.peersCount, unchanged.Round(time.Second)), "banned", len(ips))
+					}
+				}
+			}
+		}
+	}
+}
+
+// torrentWithInfo - returns torrent which metadata is already known
+func (cli *Client) torrentWithInfo(hash metainfo.Hash) (*torrent.Torrent, error) {
+	t, ok := cli.TorrentClient().Torrent(hash)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTorrentNotFound, hash)
+	}
+	select {
+	case <-t.GotInfo():
+		return t, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNoMetadata, hash)
+	}
+}
+
+// Remaining - how much data and pieces torrent still needs
+func (cli *Client) Remaining(hash metainfo.Hash) (bytes int64, pieces int, err error) {
+	t, err := cli.torrentWithInfo(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	completedPieces := 0
+	for _, r := range t.PieceStateRuns() {
+		if r.Complete {
+			completedPieces += r.Length
+		}
+	}
+	return t.Length() - t.BytesCompleted(), t.NumPieces() - completedPieces, nil
+}
+
+// PieceAvailability - how many connected peers have each piece of torrent (by their claims).
+// Zeros on incomplete pieces mean the swarm can't finish the torrent now - webseeds are the only source.
+func (cli *Client) PieceAvailability(hash metainfo.Hash) ([]int, error) {
+	t, err := cli.torrentWithInfo(hash)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, t.NumPieces())
+	for _, pc := range t.PeerConns() {
+		pc.PeerPieces().Iterate(func(i uint32) bool {
+			if int(i) >= len(res) {
+				return false
+			}
+			res[i]++
+			return true
+		})
+	}
+	return res, nil
+}
+
+// FileProgress - download state of one file of torrent
+type FileProgress struct {
+	Path           string // relative to data dir, slash-separated
+	Length         int64
+	BytesCompleted int64 // in verified pieces
+	Complete       bool  // all pieces which file spans are verified - file can be used
+}
+
+// FileProgress - per-file completion of multi-file torrent, derived from verified pieces which file spans:
+// complete file of not complete torrent can already be used
+func (cli *Client) FileProgress(hash metainfo.Hash) ([]FileProgress, error) {
+	t, err := cli.torrentWithInfo(hash)
+	if err != nil {
+		return nil, err
+	}
+	files := t.Files()
+	res := make([]FileProgress, 0, len(files))
+	for _, f := range files {
+		completed := f.BytesCompleted()
+		res = append(res, FileProgress{
+			Path:           f.Path(),
+			Length:         f.Length(),
+			BytesCompleted: completed,
+			Complete:       completed == f.Length(),
+		})
+	}
+	return res, nil
+}
+
+// Pause - stops download and upload of torrent. Paused state is persisted and survives restart.
+func (cli *Client) Pause(hash metainfo.Hash) error {
+	if err := savePaused(cli.db, hash, true); err != nil {
+		return err
+	}
+	cli.lock.Lock()
+	cli.paused[hash] = struct{}{}
+	cli.lock.Unlock()
+	cli.pauseTorrent(hash)
+	return nil
+}
+
+func (cli *Client) pauseTorrent(hash metainfo.Hash) {
+	if t, ok := cli.TorrentClient().Torrent(hash); ok {
+		t.DisallowDataDownload()
+		t.DisallowDataUpload()
+	}
+}
+
+// Resume - opposite of Pause
+func (cli *Client) Resume(hash metainfo.Hash) error {
+	if err := savePaused(cli.db, hash, false); err != nil {
+		return err
+	}
+	cli.lock.Lock()
+	delete(cli.paused, hash)
+	cli.lock.Unlock()
+	cli.resumeTorrent(hash)
+	return nil
+}
+
+func (cli *Client) resumeTorrent(hash metainfo.Hash) {
+	if t, ok := cli.TorrentClient().Torrent(hash); ok {
+		if !cli.isDownloadPaused(hash) {
+			t.AllowDataDownload()
+		}
+		t.AllowDataUpload()
+	}
+}
+
+// PauseDownload - stops download of torrent, but keeps uploading pieces it has (seed-through-pause).
+// Independent of Pause, persisted and survives restart.
+func (cli *Client) PauseDownload(hash metainfo.Hash) error {
+	if err := saveDownloadPaused(cli.db, hash, true); err != nil {
+		return err
+	}
+	cli.lock.Lock()
+	cli.downloadPaused[hash] = struct{}{}
+	cli.lock.Unlock()
+	if t, ok := cli.TorrentClient().Torrent(hash); ok {
+		t.DisallowDataDownload()
+	}
+	return nil
+}
+
+// ResumeDownload - opposite of PauseDownload. Torrent stays stopped if it's paused by Pause. Also clears storage error of torrent, see StorageErrors
+func (cli *Client) ResumeDownload(hash metainfo.Hash) error {
+	if err := saveDownloadPaused(cli.db, hash, false); err != nil {
+		return err
+	}
+	cli.lock.Lock()
+	delete(cli.downloadPaused, hash)
+	delete(cli.storageErrors, hash)
+	cli.lock.Unlock()
+	if t, ok := cli.TorrentClient().Torrent(hash); ok && !cli.isPaused(hash) {
+		t.AllowDataDownload()
+	}
+	return nil
+}
+
+func (cli *Client) PauseAll() error {
+	for _, t := range cli.TorrentClient().Torrents() {
+		if err := cli.Pause(t.InfoHash()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cli *Client) ResumeAll() error {
+	for _, t := range cli.TorrentClient().Torrents() {
+		if err := cli.Resume(t.InfoHash()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cli *Client) isPaused(hash metainfo.Hash) bool {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	_, ok := cli.paused[hash]
+	return ok
+}
 
-			}
+func (cli *Client) isDownloadPaused(hash metainfo.Hash) bool {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	_, ok := cli.downloadPaused[hash]
+	return ok
+}
+
+// pausedCounts - for status output
+func (cli *Client) pausedCounts() (paused, downloadPaused int) {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	return len(cli.paused), len(cli.downloadPaused)
+}
+
+// applyPaused - paused state of torrents survives restart: must be re-applied after torrents added
+func (cli *Client) applyPaused() {
+	for _, t := range cli.TorrentClient().Torrents() {
+		if cli.isPaused(t.InfoHash()) {
+			t.DisallowDataDownload()
+			t.DisallowDataUpload()
 		}
+		if cli.isDownloadPaused(t.InfoHash()) {
+			t.DisallowDataDownload()
+		}
+	}
+}
+
+// FetchMetainfo - resolves magnet link to metainfo without downloading any data
+// torrent is dropped right after - unless it was already added to client before
+func (cli *Client) FetchMetainfo(ctx context.Context, uri string) (*metainfo.MetaInfo, error) {
+	m, err := metainfo.ParseMagnetUri(uri)
+	if err != nil {
+		return nil, err
+	}
+	_, existed := cli.TorrentClient().Torrent(m.InfoHash)
+	t, err := cli.TorrentClient().AddMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		t.DisallowDataDownload()
+		defer t.Drop()
 	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.GotInfo():
+	}
+	mi := t.Metainfo()
+	return &mi, nil
 }
 
 func (cli *Client) StopSeeding(hash metainfo.Hash) error {
-	t, ok := cli.Client.Torrent(hash)
+	t, ok := cli.TorrentClient().Torrent(hash)
 	if !ok {
 		return nil
 	}
+	cli.closeReader(hash)
 	ch := t.Closed()
 	t.Drop()
 	<-ch
 	return nil
 }
 
+// Remove - drops torrent and forgets its cached metadata and paused state. Data files are not deleted.
+func (cli *Client) Remove(hash metainfo.Hash) error {
+	if err := cli.StopSeeding(hash); err != nil {
+		return err
+	}
+	if err := cli.Resume(hash); err != nil {
+		return err
+	}
+	if err := cli.ResumeDownload(hash); err != nil {
+		return err
+	}
+	if err := deleteInfoBytes(cli.db, hash); err != nil {
+		return err
+	}
+	audit(cli.db, AuditRemoved, hash, "", nil)
+	return nil
+}
+
+// Phase - what downloader is busy with: on start it re-hashes pre-existing files, and BytesCompleted grows
+// because of verification, not download
+type Phase string
+
+const (
+	PhaseVerifying   Phase = "verifying"
+	PhaseDownloading Phase = "downloading"
+)
+
+// verifyingMinCheckingPieces - downloaded pieces are hashed one by one, initial verification queues all pieces
+// of existing files at once. More pieces than this waiting for hash - means verification phase.
+const verifyingMinCheckingPieces = 16
+
+// checkingPieces - pieces being hashed or queued for hash
+func checkingPieces(t *torrent.Torrent) (n int) {
+	for _, r := range t.PieceStateRuns() {
+		if r.Checking {
+			n += r.Length
+		}
+	}
+	return n
+}
+
+// ConnStats - torrent library's own counters over all connections, past and present, of all torrents.
+// Unlike Stats (curated and averaged by MainLoop) - raw, as library reports them, always up to date.
+func (cli *Client) ConnStats() torrent.ConnStats {
+	return cli.TorrentClient().ConnStats()
+}
+
+// TorrentStats - torrent library's own stats of one torrent: its ConnStats and peers counts, see ConnStats
+func (cli *Client) TorrentStats(hash metainfo.Hash) (torrent.TorrentStats, error) {
+	t, ok := cli.TorrentClient().Torrent(hash)
+	if !ok {
+		return torrent.TorrentStats{}, fmt.Errorf("%w: %s", ErrTorrentNotFound, hash)
+	}
+	return t.Stats(), nil
+}
+
+// AllTorrentStats - TorrentStats of all torrents
+func (cli *Client) AllTorrentStats() map[metainfo.Hash]torrent.TorrentStats {
+	torrents := cli.TorrentClient().Torrents()
+	res := make(map[metainfo.Hash]torrent.TorrentStats, len(torrents))
+	for _, t := range torrents {
+		res[t.InfoHash()] = t.Stats()
+	}
+	return res
+}
+
+// Stats - latest stats calculated by MainLoop, safe for concurrent use. Raw library counters: ConnStats
+func (cli *Client) Stats() AggStats {
+	cli.statsLock.RLock()
+	defer cli.statsLock.RUnlock()
+	return cli.stats
+}
+
+// setStats - stats must not be mutated after this call: readers share its maps
+func (cli *Client) setStats(stats AggStats) {
+	cli.statsLock.Lock()
+	defer cli.statsLock.Unlock()
+	cli.stats = stats
+}
+
 type AggStats struct {
 	readBytesPerSec  int64
 	writeBytesPerSec int64
 	peersCount       int64
 
+	Phase Phase
+	// Progress - of download, or of verification during PhaseVerifying
 	Progress      float32
 	torrentsCount int
 
 	bytesRead    int64
 	bytesWritten int64
+	bytesLeft    int64
+
+	// Paused - torrents stopped by Pause, DownloadPaused - by PauseDownload (still seeding)
+	Paused, DownloadPaused int
+	// StorageErrors - torrents which download is disabled because storage write failed, see Client.StorageErrors
+	StorageErrors int
+
+	// PeersByGeo - amount of connected peers by label of GeoResolver, nil if no resolver
+	PeersByGeo map[string]int
+
+	// FreeloaderRequestedBytes - requested (minus cancelled) by peers which never sent us any data,
+	// ReciprocalRequestedBytes - by others. Since start. Not uploaded bytes: torrent lib doesn't report data
+	// sent per peer, and rejected or rate limited requests are counted too. High FreeloaderRequestedBytes share -
+	// consider upload rate limit.
+	FreeloaderRequestedBytes int64
+	ReciprocalRequestedBytes int64
+
+	// PendingWrites - chunk writes to storage in progress now, WriteLoad - average of it since previous Stats.
+	// Only storage created by New is measured.
+	PendingWrites int64
+	WriteLoad     float64
+	// Bottleneck - disk if received chunks wait for storage (WriteLoad high), network if downloading otherwise
+	Bottleneck Bottleneck
 }
 
-func CalcStats(prevStats AggStats, interval time.Duration, client *torrent.Client) (result AggStats) {
+// ETA - of download at current rate, 0 if nothing left or rate unknown (also during PhaseVerifying)
+func (s AggStats) ETA() time.Duration {
+	if s.Phase != PhaseDownloading || s.bytesLeft <= 0 || s.readBytesPerSec <= 0 {
+		return 0
+	}
+	return time.Duration(s.bytesLeft/s.readBytesPerSec) * time.Second
+}
+
+// StatusLine - compact one-line progress for terminal UIs, like:
+// "snapshots: 62.3% | 45.0 MiB/s↓ 3.0 MiB/s↑ | 12 peers | ETA 18m0s". Formats latest Stats - cheap, doesn't block on torrent lib.
+func (cli *Client) StatusLine() string {
+	return cli.Stats().statusLine()
+}
+
+func (s AggStats) statusLine() string {
+	var progress string
+	switch {
+	case s.torrentsCount == 0:
+		progress = "no torrents"
+	case s.Phase == PhaseVerifying:
+		progress = fmt.Sprintf("verifying %.1f%%", s.Progress)
+	case s.bytesLeft <= 0:
+		progress = "seeding"
+	default:
+		progress = fmt.Sprintf("%.1f%%", s.Progress)
+	}
+	line := fmt.Sprintf("snapshots: %s | %s/s↓ %s/s↑ | %d peers", progress,
+		common2.ByteCount(uint64(s.readBytesPerSec)), common2.ByteCount(uint64(s.writeBytesPerSec)), s.peersCount)
+	if s.Paused > 0 || s.DownloadPaused > 0 {
+		line += fmt.Sprintf(" | paused %d, download paused %d", s.Paused, s.DownloadPaused)
+	}
+	if eta := s.ETA(); eta > 0 {
+		line += " | ETA " + eta.Round(time.Minute).String()
+	}
+	return line
+}
+
+// CalcStats - elapsed is real time since prevStats was calculated, not nominal tick interval: rates stay right
+// when ticks are delayed
+func CalcStats(prevStats AggStats, elapsed time.Duration, client *torrent.Client, geo GeoResolver) (result AggStats) {
 	var aggBytesCompleted, aggLen int64
+	var aggNumPieces, aggCheckingPieces int
 	//var aggCompletedPieces, aggNumPieces, aggPartialPieces int
 	peers := map[torrent.PeerID]*torrent.PeerConn{}
 	torrents := client.Torrents()
@@ -229,74 +1426,466 @@ func CalcStats(prevStats AggStats, interval time.Duration, client *torrent.Clien
 		result.bytesWritten += stats.BytesWritten.Int64() + stats.BytesWrittenData.Int64()
 		aggBytesCompleted += t.BytesCompleted()
 		aggLen += t.Length()
+		aggNumPieces += t.NumPieces()
+		aggCheckingPieces += checkingPieces(t)
 		for _, peer := range t.PeerConns() {
 			peers[peer.PeerID] = peer
 		}
 	}
 
-	result.readBytesPerSec += (result.bytesRead - prevStats.bytesRead) / int64(interval.Seconds())
-	result.writeBytesPerSec += (result.bytesWritten - prevStats.bytesWritten) / int64(interval.Seconds())
+	assert(elapsed > 0, "stats elapsed time is not positive", "elapsed", elapsed)
+	if elapsed > 0 {
+		result.readBytesPerSec += int64(float64(result.bytesRead-prevStats.bytesRead) / elapsed.Seconds())
+		result.writeBytesPerSec += int64(float64(result.bytesWritten-prevStats.bytesWritten) / elapsed.Seconds())
+	}
 
-	result.Progress = float32(float64(100) * (float64(aggBytesCompleted) / float64(aggLen)))
+	if aggCheckingPieces > verifyingMinCheckingPieces {
+		result.Phase = PhaseVerifying
+		result.Progress = float32(float64(100) * (float64(aggNumPieces-aggCheckingPieces) / float64(aggNumPieces)))
+	} else {
+		result.Phase = PhaseDownloading
+		result.Progress = float32(float64(100) * (float64(aggBytesCompleted) / float64(aggLen)))
+	}
+	assert(aggLen == 0 || (result.Progress >= 0 && result.Progress <= 100), "progress out of range",
+		"progress", result.Progress, "completed", aggBytesCompleted, "len", aggLen, "checking", aggCheckingPieces, "pieces", aggNumPieces)
 
+	result.bytesLeft = aggLen - aggBytesCompleted
 	result.peersCount = int64(len(peers))
 	result.torrentsCount = len(torrents)
+	if geo != nil {
+		result.PeersByGeo = peersByGeo(peers, geo)
+	}
 	return result
 }
 
+func peersByGeo(peers map[torrent.PeerID]*torrent.PeerConn, geo GeoResolver) map[string]int {
+	res := map[string]int{}
+	for _, peer := range peers {
+		label := ""
+		if ip := peerIP(peer.RemoteAddr); ip != nil {
+			label = geo(ip)
+		}
+		if label == "" {
+			label = "unknown"
+		}
+		res[label]++
+	}
+	return res
+}
+
+func peerIP(addr torrent.PeerRemoteAddr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// TrackersMode - how Trackers are applied to announce list of added torrent
+type TrackersMode int
+
+const (
+	TrackersReplace TrackersMode = iota // announce list of .torrent file replaced by Trackers
+	TrackersMerge                       // Trackers appended to announce list of .torrent file
+	TrackersKeep                        // announce list of .torrent file used as-is, Trackers ignored
+)
+
+// AddOptions - controls AddTorrentFiles and ResolveAbsentTorrents the same way
+type AddOptions struct {
+	// GotInfoTimeout - how long to wait for torrent metadata. 0 - wait until ctx done.
+	// .torrent files already have metadata - no wait happens for them.
+	GotInfoTimeout time.Duration
+	// WriteTorrentFiles - create .torrent file (if it doesn't exist) once metadata is known
+	WriteTorrentFiles bool
+	Trackers          TrackersMode
+	// AnnounceList - trackers of TrackersReplace and TrackersMerge, nil - package's Trackers
+	AnnounceList [][]string
+	// Passkey - substituted to PasskeyPlaceholder of Trackers urls (private trackers auth)
+	Passkey       string
+	AllowDownload bool
+	AllowUpload   bool
+	// MaxTorrents - guard rail against misconfigured dir with thousands of stray .torrent files:
+	// adding stops with ErrTooManyTorrents. 0 - unlimited.
+	MaxTorrents int
+	// FirstTierOnly - announce list is cut to first tier, other tiers are added by MainLoop on failure.
+	// see Cfg.TrackerFailover
+	FirstTierOnly bool
+	// Magnets - optional, candidate magnet links of infohash (different tracker/peer hints) which
+	// ResolveAbsentTorrents tries in turn - before magnet built from Trackers - until metadata is resolved.
+	Magnets map[metainfo.Hash][]string
+	// MagnetSourceTimeout - how long to wait for metadata from one of Magnets. 0 - DefaultMagnetSourceTimeout
+	MagnetSourceTimeout time.Duration
+	// MaxVerifying - >0: AddTorrentFiles adds new torrents in batches of this size, next batch is added once initial
+	// verification (hashing of existing data) of previous one is done - no disk IO storm on startup. 0 - all at once.
+	MaxVerifying int
+	// MaxResolving - >0: ResolveAbsentTorrents adds next magnet once less than this many added magnets are resolving
+	// metadata - on weak connection few resolve faster than all at once (each wait is bounded by GotInfoTimeout).
+	// 0 - all at once.
+	MaxResolving int
+	// ExpectedNames - optional, infohash -> name: torrent with other name is rejected with ErrNameMismatch
+	// (magnet - dropped once metadata resolved)
+	ExpectedNames map[metainfo.Hash]string
+	// RequirePreverified - safe mode: ResolveAbsentTorrents fails with ErrNoPreverified on empty list of hashes
+	// (usually config loading bug) instead of downloading nothing. Off - empty list means "no snapshots".
+	RequirePreverified bool
+}
+
+func DefaultAddOptions() AddOptions {
+	return AddOptions{
+		WriteTorrentFiles: true,
+		Trackers:          TrackersReplace,
+		MaxTorrents:       DefaultMaxTorrents,
+		AllowDownload:     true,
+		AllowUpload:       true,
+	}
+}
+
+// DefaultMaxTorrents - Erigon has hundreds of snapshots
+const DefaultMaxTorrents = 10_000
+
+// waitInitialVerify - until all pieces of torrents which are queued for hashing on add are hashed
+func waitInitialVerify(ctx context.Context, torrents []*torrent.Torrent) error {
+	check := time.NewTicker(100 * time.Millisecond)
+	defer check.Stop()
+	for _, t := range torrents {
+	wait:
+		for checkingPieces(t) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.Closed():
+				break wait
+			case <-check.C:
+			}
+		}
+	}
+	return nil
+}
+
+// waitResolveSlot - returns once less than max of torrents are resolving metadata, with those which still are
+func waitResolveSlot(ctx context.Context, resolving []*torrent.Torrent, max int, timeout time.Duration) ([]*torrent.Torrent, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	check := time.NewTicker(100 * time.Millisecond)
+	defer check.Stop()
+	for {
+		still := resolving[:0]
+		for _, t := range resolving {
+			select {
+			case <-t.GotInfo():
+			case <-t.Closed():
+			default:
+				still = append(still, t)
+			}
+		}
+		resolving = still
+		if len(resolving) < max {
+			return resolving, nil
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("metadata of %d torrents not resolved in %s: %w", len(resolving), timeout, ctx.Err())
+			}
+			return nil, ctx.Err()
+		case <-check.C:
+		}
+	}
+}
+
+// checkMaxTorrents - adding amount of torrents to client must not exceed opts.MaxTorrents
+func checkMaxTorrents(torrentClient *torrent.Client, adding int, opts AddOptions) error {
+	if opts.MaxTorrents <= 0 {
+		return nil
+	}
+	if total := len(torrentClient.Torrents()) + adding; total > opts.MaxTorrents {
+		return fmt.Errorf("%w: %d, limit is %d", ErrTooManyTorrents, total, opts.MaxTorrents)
+	}
+	return nil
+}
+
+func applyTrackers(mi *metainfo.MetaInfo, opts AddOptions) {
+	trackers := opts.AnnounceList
+	if trackers == nil {
+		trackers = Trackers
+	}
+	switch opts.Trackers {
+	case TrackersReplace:
+		mi.AnnounceList = WithPasskey(trackers, opts.Passkey)
+	case TrackersMerge:
+		mi.AnnounceList = append(mi.AnnounceList, WithPasskey(trackers, opts.Passkey)...)
+	case TrackersKeep:
+	}
+	if opts.FirstTierOnly && len(mi.AnnounceList) > 1 {
+		mi.AnnounceList = mi.AnnounceList[:1]
+	}
+}
+
+func applyAllow(t *torrent.Torrent, opts AddOptions) {
+	if opts.AllowDownload {
+		t.AllowDataDownload()
+	} else {
+		t.DisallowDataDownload()
+	}
+	if opts.AllowUpload {
+		t.AllowDataUpload()
+	} else {
+		t.DisallowDataUpload()
+	}
+}
+
+// waitGotInfo - waits for metadata of given torrents and creates .torrent files if opts.WriteTorrentFiles
+// if db != nil - metadata cached there as soon as it resolved. Torrents with name other than opts.ExpectedNames
+// are dropped, others are processed anyway: rejected ones are returned together as AddErrors
+func waitGotInfo(ctx context.Context, torrents []*torrent.Torrent, db kv.RwDB, snapshotsDir string, opts AddOptions) error {
+	if opts.GotInfoTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.GotInfoTimeout)
+		defer cancel()
+	}
+	var rejected AddErrors
+	for _, t := range torrents {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("metadata of %s not resolved in %s: %w", t.InfoHash(), opts.GotInfoTimeout, ctx.Err())
+			}
+			return ctx.Err()
+		case <-t.GotInfo():
+			if err := checkName(opts.ExpectedNames, t.InfoHash(), t.Name()); err != nil {
+				// wrong torrent of one hash doesn't stop others
+				t.Drop()
+				audit(db, AuditRemoved, t.InfoHash(), "", err)
+				log.Warn("[torrent] Dropped torrent", "err", err)
+				rejected = append(rejected, err)
+				continue
+			}
+			mi := t.Metainfo()
+			if db != nil {
+				cached, err := readInfoBytes(db, t.InfoHash())
+				if err != nil {
+					return err
+				}
+				if len(cached) == 0 {
+					if err := saveInfoBytes(db, t.InfoHash(), mi.InfoBytes); err != nil {
+						return err
+					}
+					audit(db, AuditMetadataResolved, t.InfoHash(), "", nil)
+				}
+			}
+			if !opts.WriteTorrentFiles {
+				continue
+			}
+			if err := CreateTorrentFileIfNotExists(snapshotsDir, t.Info(), &mi); err != nil {
+				return err
+			}
+		}
+	}
+	if len(rejected) > 0 {
+		return rejected
+	}
+	return nil
+}
+
 // AddTorrentFiles - adding .torrent files to torrentClient (and checking their hashes), if .torrent file
 // added first time - pieces verification process will start (disk IO heavy) - Progress
 // kept in `piece completion storage` (surviving reboot). Once it done - no disk IO needed again.
 // Don't need call torrent.VerifyData manually
-func AddTorrentFiles(snapshotsDir string, torrentClient *torrent.Client) error {
+// One broken .torrent file doesn't prevent adding others: failures are returned together as AddErrors
+// Torrents with overlapping file paths fail it with ErrOverlappingPaths, before any download starts
+func AddTorrentFiles(ctx context.Context, snapshotsDir string, torrentClient *torrent.Client, opts AddOptions) error {
 	files, err := AllTorrentPaths(snapshotsDir)
 	if err != nil {
 		return err
 	}
+	if opts.MaxTorrents > 0 && len(files) > opts.MaxTorrents {
+		return fmt.Errorf("%w: %d .torrent files in %s, limit is %d", ErrTooManyTorrents, len(files), snapshotsDir, opts.MaxTorrents)
+	}
+	var failed AddErrors
+	type loaded struct {
+		path string
+		mi   *metainfo.MetaInfo
+	}
+	toAdd := make([]loaded, 0, len(files))
+	infos := torrentInfos(torrentClient.Torrents())
 	for _, torrentFilePath := range files {
 		mi, err := metainfo.LoadFromFile(torrentFilePath)
 		if err != nil {
-			return err
+			failed = append(failed, fmt.Errorf("load %s: %w", torrentFilePath, err))
+			continue
+		}
+		info, err := mi.UnmarshalInfo()
+		if err == nil && len(opts.ExpectedNames) > 0 {
+			err = checkName(opts.ExpectedNames, mi.HashInfoBytes(), info.Name)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", torrentFilePath, err))
+			continue
+		}
+		toAdd = append(toAdd, loaded{path: torrentFilePath, mi: mi})
+		infos = append(infos, torrentInfo{hash: mi.HashInfoBytes(), info: &info})
+	}
+	// before AddTorrent: storage of added torrent would write into files of other
+	if err := checkOverlappingPaths(infos); err != nil {
+		return err
+	}
+
+	added := make([]*torrent.Torrent, 0, len(toAdd))
+	var verifying []*torrent.Torrent // see AddOptions.MaxVerifying
+	for _, l := range toAdd {
+		torrentFilePath, mi := l.path, l.mi
+		applyTrackers(mi, opts)
+		if _, ok := torrentClient.Torrent(mi.HashInfoBytes()); !ok {
+			if err := checkMaxTorrents(torrentClient, 1, opts); err != nil {
+				return err
+			}
 		}
-		mi.AnnounceList = Trackers
 
-		if _, err = torrentClient.AddTorrent(mi); err != nil {
+		_, existed := torrentClient.Torrent(mi.HashInfoBytes())
+		t, err := torrentClient.AddTorrent(mi)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("add %s: %w", torrentFilePath, err))
+			continue
+		}
+		applyAllow(t, opts)
+		added = append(added, t)
+		if opts.MaxVerifying > 0 && !existed {
+			if verifying = append(verifying, t); len(verifying) == opts.MaxVerifying {
+				if err := waitInitialVerify(ctx, verifying); err != nil {
+					return err
+				}
+				verifying = verifying[:0]
+			}
+		}
+	}
+	if err := waitGotInfo(ctx, added, nil, snapshotsDir, opts); err != nil {
+		var rejected AddErrors
+		if !errors.As(err, &rejected) {
 			return err
 		}
+		failed = append(failed, rejected...)
+	}
+	if len(failed) > 0 {
+		return failed
 	}
-
 	return nil
 }
 
+// AddErrors - .torrent files which AddTorrentFiles failed to add, all others are added anyway
+type AddErrors []error
+
+func (e AddErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d torrents failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e AddErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // ResolveAbsentTorrents - add hard-coded hashes (if client doesn't have) as magnet links and download everything
-func ResolveAbsentTorrents(ctx context.Context, torrentClient *torrent.Client, preverifiedHashes []metainfo.Hash, snapshotDir string) error {
-	mi := &metainfo.MetaInfo{AnnounceList: Trackers}
+// if metadata is known locally - no network resolution needed. It's taken from: .torrent file in snapshotDir,
+// or db (resolved by previous runs). Torrent with unexpected name (see AddOptions.ExpectedNames) is dropped,
+// it doesn't stop others: such torrents are returned together as AddErrors
+func ResolveAbsentTorrents(ctx context.Context, torrentClient *torrent.Client, db kv.RwDB, preverifiedHashes []metainfo.Hash, snapshotDir string, opts AddOptions) error {
+	if len(preverifiedHashes) == 0 && opts.RequirePreverified {
+		return ErrNoPreverified
+	}
+	mi := &metainfo.MetaInfo{}
+	applyTrackers(mi, opts)
+	localFiles, err := torrentFilesByHash(snapshotDir)
+	if err != nil {
+		return err
+	}
+	var resolving []*torrent.Torrent // magnets, see AddOptions.MaxResolving
 	for _, infoHash := range preverifiedHashes {
 		if _, ok := torrentClient.Torrent(infoHash); ok {
 			continue
 		}
-		magnet := mi.Magnet(&infoHash, nil)
-		t, err := torrentClient.AddMagnet(magnet.String())
+		if err := checkMaxTorrents(torrentClient, 1, opts); err != nil {
+			return err
+		}
+		var t *torrent.Torrent
+		if localMi, ok := localFiles[infoHash]; ok {
+			// metadata already known - never block on GotInfo, webseeds of .torrent file work even if swarm is dead
+			applyTrackers(localMi, opts)
+			if t, err = torrentClient.AddTorrent(localMi); err != nil {
+				return err
+			}
+			applyAllow(t, opts)
+			audit(db, AuditAdded, infoHash, SourceTorrentFile, nil)
+			continue
+		}
+		t, err = addCachedInfo(torrentClient, db, infoHash, opts)
 		if err != nil {
 			return err
 		}
-		t.AllowDataDownload()
-		t.AllowDataUpload()
-	}
-
-	for _, t := range torrentClient.Torrents() {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-t.GotInfo():
-			mi := t.Metainfo()
-			if err := CreateTorrentFileIfNotExists(snapshotDir, t.Info(), &mi); err != nil {
+		if t == nil && opts.MaxResolving > 0 {
+			if resolving, err = waitResolveSlot(ctx, resolving, opts.MaxResolving, opts.GotInfoTimeout); err != nil {
+				return err
+			}
+		}
+		source := SourceCachedInfo
+		if t == nil && len(opts.Magnets[infoHash]) > 0 {
+			sources, err := parseMagnets(infoHash, opts.Magnets[infoHash])
+			if err != nil {
+				return err
+			}
+			sources = append(sources, mi.Magnet(&infoHash, nil))
+			t, _ = torrentClient.AddTorrentInfoHash(infoHash)
+			go rotateMagnetSources(ctx, t, sources, opts.MagnetSourceTimeout)
+			source = SourceMagnet
+		} else if t == nil {
+			magnet := mi.Magnet(&infoHash, nil)
+			t, err = torrentClient.AddMagnet(magnet.String())
+			if err != nil {
 				return err
 			}
+			source = SourceMagnet
+		}
+		applyAllow(t, opts)
+		audit(db, AuditAdded, infoHash, source, nil)
+		if source == SourceMagnet {
+			resolving = append(resolving, t)
 		}
 	}
 
-	return nil
+	return waitGotInfo(ctx, torrentClient.Torrents(), db, snapshotDir, opts)
+}
+
+// addCachedInfo - adds torrent with metadata cached in db, returns nil if nothing cached
+func addCachedInfo(torrentClient *torrent.Client, db kv.RwDB, infoHash metainfo.Hash, opts AddOptions) (*torrent.Torrent, error) {
+	infoBytes, err := readInfoBytes(db, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(infoBytes) == 0 {
+		return nil, nil
+	}
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+	if mi.HashInfoBytes() != infoHash {
+		log.Warn("[torrent] Ignoring cached metadata with wrong hash", "hash", infoHash)
+		return nil, nil
+	}
+	applyTrackers(mi, opts)
+	return torrentClient.AddTorrent(mi)
 }
 
 //nolint
@@ -332,14 +1921,31 @@ func waitForChecksumVerify(ctx context.Context, torrentClient *torrent.Client) {
 	torrentClient.WaitAll() // wait for checksum verify
 }
 
-func VerifyDtaFiles(ctx context.Context, snapshotDir string) error {
+// VerifyDtaFiles - check data files against piece hashes of .torrent files
+// dirs - where data files are, nil if all in snapshotDir
+// With opts.Checkpoint interrupted (or failed) verify resumes at torrent boundary: fully verified torrents
+// which files didn't change since are skipped. Checkpoint is removed once all torrents are verified.
+// With opts.MaxDuration verify stops once budget is spent and returns *VerifyIncompleteError.
+func VerifyDtaFiles(ctx context.Context, snapshotDir string, dirs DirSelector, opts VerifyOptions) error {
 	logEvery := time.NewTicker(5 * time.Second)
 	defer logEvery.Stop()
 	files, err := AllTorrentPaths(snapshotDir)
 	if err != nil {
 		return err
 	}
-	totalPieces := 0
+	checkpoint, err := loadVerifyCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		path        string
+		hash        metainfo.Hash
+		info        *metainfo.Info
+		root        string
+		fingerprint string
+	}
+	var todo []pending
+	totalPieces, skipped := 0, 0
 	for _, f := range files {
 		metaInfo, err := metainfo.LoadFromFile(f)
 		if err != nil {
@@ -349,37 +1955,80 @@ func VerifyDtaFiles(ctx context.Context, snapshotDir string) error {
 		if err != nil {
 			return err
 		}
-		totalPieces += info.NumPieces()
-	}
-
-	j := 0
-	for _, f := range files {
-		metaInfo, err := metainfo.LoadFromFile(f)
-		if err != nil {
+		hash := metaInfo.HashInfoBytes()
+		root := dataDir(snapshotDir, dirs, info.Name, hash)
+		if err := checkFileSizes(&info, root); err != nil {
 			return err
 		}
-		info, err := metaInfo.UnmarshalInfo()
+		fingerprint, err := filesFingerprint(root, &info)
 		if err != nil {
 			return err
 		}
-		err = verifyTorrent(&info, snapshotDir, func(i int, good bool) error {
+		if checkpoint.isVerified(hash, fingerprint) {
+			skipped++
+			continue
+		}
+		todo = append(todo, pending{path: f, hash: hash, info: &info, root: root, fingerprint: fingerprint})
+		totalPieces += info.NumPieces()
+	}
+	if skipped > 0 {
+		log.Info("[torrent] Verify resumed from checkpoint", "skipped torrents", skipped, "left", len(todo))
+	}
+	if opts.DB != nil { // within budget - what's not verified longest, never verified first
+		verifiedAt := make(map[metainfo.Hash]time.Time, len(todo))
+		for _, p := range todo {
+			if verifiedAt[p.hash], err = readVerifiedAt(opts.DB, p.hash); err != nil {
+				return err
+			}
+		}
+		sort.SliceStable(todo, func(i, j int) bool { return verifiedAt[todo[i].hash].Before(verifiedAt[todo[j].hash]) })
+	}
+
+	verifyCtx := ctx
+	if opts.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		verifyCtx, cancel = context.WithTimeout(ctx, opts.MaxDuration)
+		defer cancel()
+	}
+	j, verified := 0, 0
+	for _, p := range todo {
+		torrentOpts := opts
+		torrentOpts.Storage = torrentBackend(opts.Storage, opts.Backends, p.info.Name, p.hash)
+		err = verifyTorrent(verifyCtx, p.info, p.root, torrentOpts, func(i int, good bool) error {
 			j++
-			if !good {
-				log.Error("[torrent] Verify hash mismatch", "at piece", i, "file", f)
-				return fmt.Errorf("invalid file")
+			if !good { // details are logged by verifyTorrent
+				return fmt.Errorf("invalid file: %s, piece %d", p.path, i)
 			}
 			select {
 			case <-logEvery.C:
 				log.Info("[torrent] Verify", "Progress", fmt.Sprintf("%.2f%%", 100*float64(j)/float64(totalPieces)))
-			case <-ctx.Done():
-				return ctx.Err()
+			case <-verifyCtx.Done():
+				return verifyCtx.Err()
 			default:
 			}
 			return nil
 		})
 		if err != nil {
+			if ctx.Err() == nil && errors.Is(verifyCtx.Err(), context.DeadlineExceeded) {
+				incomplete := &VerifyIncompleteError{Budget: opts.MaxDuration, Verified: verified, Skipped: skipped, Left: len(todo) - verified}
+				log.Warn("[torrent] Verification incomplete within budget", "budget", opts.MaxDuration,
+					"verified torrents", incomplete.Verified, "skipped (checkpoint)", incomplete.Skipped, "left", incomplete.Left)
+				return incomplete
+			}
 			return err
 		}
+		verified++
+		if err := checkpoint.markVerified(p.hash, p.fingerprint); err != nil {
+			return fmt.Errorf("save verify checkpoint: %w", err)
+		}
+		if opts.DB != nil {
+			if err := saveVerifiedAt(opts.DB, p.hash, time.Now()); err != nil {
+				return fmt.Errorf("save verification time: %w", err)
+			}
+		}
+	}
+	if err := checkpoint.remove(); err != nil {
+		return err
 	}
 	log.Info("[torrent] Verify succeed")
 	return nil
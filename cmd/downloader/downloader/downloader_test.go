@@ -0,0 +1,1485 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dht/v2/krpc"
+	lg "github.com/anacrolix/log"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces"
+	proto_downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	proto_control "github.com/ledgerwatch/erigon/cmd/downloader/downloadercontrol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestAllowedTorrents(t *testing.T) {
+	require := require.New(t)
+	h1, h2 := metainfo.Hash{1}, metainfo.Hash{2}
+	calls := map[metainfo.Hash]int{}
+	allowed := allowedTorrents{}
+	for tick := 0; tick < 10; tick++ {
+		for _, h := range []metainfo.Hash{h1, h2} {
+			h := h
+			allowed.allow(h, func() { calls[h]++ })
+		}
+	}
+	require.Equal(1, calls[h1])
+	require.Equal(1, calls[h2])
+
+	// metadata resolved, then torrent re-added
+	allowed.forget(h1)
+	allowed.allow(h1, func() { calls[h1]++ })
+	require.Equal(2, calls[h1])
+	require.Equal(1, calls[h2])
+}
+
+func TestSetPeerID(t *testing.T) {
+	require := require.New(t)
+	db := memdb.NewTestDB(t)
+	require.Error(SetPeerID(db, []byte{1, 2, 3}))
+	id := []byte("-GT0002-0123456789ab")
+	require.NoError(SetPeerID(db, id))
+	got, err := readPeerID(db)
+	require.NoError(err)
+	require.Equal(id, got)
+}
+
+func TestClassifyTrackerError(t *testing.T) {
+	require := require.New(t)
+	require.Equal(TrackerErrClock, classifyTrackerError("announcing: x509: certificate has expired or is not yet valid"))
+	require.Equal(TrackerErrAuth, classifyTrackerError("announcing: tracker gave failure reason: \"Unregistered torrent\""))
+	require.Equal(TrackerErrRateLimited, classifyTrackerError("announcing: response from tracker: 429 Too Many Requests"))
+	require.Equal(TrackerErrNetwork, classifyTrackerError("announcing: dial udp: lookup tracker.example.com: no such host"))
+	require.Equal(TrackerErrOther, classifyTrackerError("announcing: unexpected EOF"))
+}
+
+// TestAnnounceResults - pins format of torrent lib's status dump which announceResults parses
+func TestAnnounceResults(t *testing.T) {
+	require := require.New(t)
+	tracker := func(resp map[string]interface{}) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := bencode.Marshal(resp)
+			_, _ = w.Write(b)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL + "/announce"
+	}
+	good := tracker(map[string]interface{}{"interval": 1800, "peers": ""})
+	bad := tracker(map[string]interface{}{"failure reason": "Unregistered torrent"})
+
+	cfg := torrent.TestingConfig(t)
+	cfg.DisableTrackers = false
+	cl, err := torrent.NewClient(cfg)
+	require.NoError(err)
+	defer cl.Close()
+	_, _, err = cl.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: metainfo.Hash{1}, Trackers: [][]string{{good}, {bad}}})
+	require.NoError(err)
+
+	var ok int
+	var errs []string
+	require.Eventually(func() bool {
+		ok, errs = announceResults(cl)
+		return ok+len(errs) == 2
+	}, 10*time.Second, 50*time.Millisecond)
+	require.Equal(1, ok)
+	require.Len(errs, 1)
+	require.Equal(TrackerErrAuth, classifyTrackerError(errs[0]), errs[0])
+}
+
+func TestAuditEvents(t *testing.T) {
+	require := require.New(t)
+	db := memdb.NewTestDB(t)
+	h := metainfo.Hash{1}
+	audit(db, AuditAdded, h, SourceMagnet, nil)
+	since := time.Now()
+	audit(db, AuditCompleted, h, "", nil)
+	audit(db, AuditVerifyFailed, metainfo.Hash{}, "manifest", errors.New("size mismatch"))
+
+	events, err := readAuditEvents(db, time.Time{})
+	require.NoError(err)
+	require.Len(events, 3)
+	require.Equal(AuditAdded, events[0].Kind)
+	require.Equal(SourceMagnet, events[0].Source)
+
+	events, err = readAuditEvents(db, since)
+	require.NoError(err)
+	require.Len(events, 2)
+	require.Equal(AuditCompleted, events[0].Kind)
+	require.Equal(h, events[0].InfoHash)
+	require.Equal("size mismatch", events[1].Err)
+}
+
+// run with -race
+func TestStatsConcurrentAccess(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(dir, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+	cfg, err := TorrentConfig(dir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+	tr, err := cli.TorrentClient().AddTorrent(mi)
+	require.NoError(err)
+	tr.VerifyData()
+
+	defer func(interval time.Duration) { statsInterval = interval }(statsInterval)
+	statsInterval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = MainLoop(ctx, cli, false)
+	}()
+	// readers can't fail test from own goroutines: failures are reported after Wait
+	var failuresLock sync.Mutex
+	var failures []string
+	updates := make([]int, 4)
+	for r := range updates {
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var prev AggStats
+			for ctx.Err() == nil {
+				stats := cli.Stats()
+				peers := 0
+				for _, n := range stats.PeersByGeo {
+					peers += n
+				}
+				var failure string
+				switch {
+				case stats.Progress < 0 || stats.Progress > 100:
+					failure = fmt.Sprintf("progress %f", stats.Progress)
+				case stats.torrentsCount != 0 && stats.torrentsCount != 1:
+					failure = fmt.Sprintf("torrents %d", stats.torrentsCount)
+				}
+				if failure != "" {
+					failuresLock.Lock()
+					failures = append(failures, failure)
+					failuresLock.Unlock()
+				}
+				if stats.torrentsCount != prev.torrentsCount || stats.Progress != prev.Progress {
+					updates[r]++
+				}
+				prev = stats
+			}
+		}()
+	}
+	wg.Wait()
+	require.Empty(failures)
+	for _, n := range updates {
+		require.Positive(n, "stats were never updated by MainLoop")
+	}
+	require.Equal(float32(100), cli.Stats().Progress)
+	require.Equal(1, cli.Stats().torrentsCount)
+}
+
+func TestDhtNodesRoundTrip(t *testing.T) {
+	require := require.New(t)
+	db := memdb.NewTestDB(t)
+	nodes := []krpc.NodeInfo{
+		{ID: krpc.ID{1}, Addr: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881}},
+		{ID: krpc.ID{2}, Addr: krpc.NodeAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+	}
+	require.NoError(saveDhtNodes(db, nodes))
+	require.NoError(saveDhtNodes(db, nodes[:1])) // replaces previous table
+	got, err := readDhtNodes(db)
+	require.NoError(err)
+	require.Len(got, 1)
+	require.Equal(nodes[0].ID, got[0].ID)
+	require.Equal(6881, got[0].Addr.Port)
+}
+
+func TestLsdMessage(t *testing.T) {
+	require := require.New(t)
+	m := lsdMessage{port: 42069, infoHashes: []metainfo.Hash{{1}, {2}}, cookie: "abc"}
+	got, err := parseLsdMessage(m.encode())
+	require.NoError(err)
+	require.Equal(m, got)
+
+	_, err = parseLsdMessage([]byte("BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n"))
+	require.Error(err)
+	_, err = parseLsdMessage([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.Error(err)
+}
+
+func TestLanPeers(t *testing.T) {
+	require := require.New(t)
+	require.True(isLANIP(net.ParseIP("10.1.2.3")))
+	require.True(isLANIP(net.ParseIP("172.31.0.1")))
+	require.True(isLANIP(net.ParseIP("192.168.1.1")))
+	require.True(isLANIP(net.ParseIP("fd00::1")))
+	require.False(isLANIP(net.ParseIP("172.32.0.1")))
+	require.False(isLANIP(net.ParseIP("8.8.8.8")))
+	require.False(isLANIP(net.ParseIP("127.0.0.1")))
+
+	h := metainfo.Hash{1}
+	lan := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 42069}
+	conns := []*torrent.PeerConn{
+		{Peer: torrent.Peer{RemoteAddr: lan, Discovery: torrent.PeerSourceTracker}},
+		{Peer: torrent.Peer{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 50000}, Discovery: torrent.PeerSourceIncoming}},
+		{Peer: torrent.Peer{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 42069}, Discovery: torrent.PeerSourceDhtGetPeers}},
+	}
+	peers := newLanPeers()
+	peers.remember(h, conns)
+	require.Equal([]torrent.PeerInfo{{Addr: lan, Source: torrent.PeerSourceTracker, Trusted: true}}, peers.of(h))
+	require.Empty(peers.of(metainfo.Hash{2}))
+	peers.prune(nil)
+	require.Empty(peers.of(h))
+}
+
+func TestCompletedAt(t *testing.T) {
+	require := require.New(t)
+	db := memdb.NewTestDB(t)
+	h := metainfo.Hash{1}
+	first := time.Unix(1_600_000_000, 0)
+	require.NoError(saveCompletedAt(db, h, first))
+	require.NoError(saveCompletedAt(db, h, first.Add(time.Hour))) // first time is kept
+	times, err := readCompletedAt(db)
+	require.NoError(err)
+	require.Len(times, 1)
+	require.True(first.Equal(times[h]))
+}
+
+func TestPausedRoundTrip(t *testing.T) {
+	require := require.New(t)
+	db := memdb.NewTestDB(t)
+	h := metainfo.Hash{1, 2, 3}
+	require.NoError(savePaused(db, h, true))
+	paused, err := readPaused(db)
+	require.NoError(err)
+	require.Contains(paused, h)
+	require.NoError(savePaused(db, h, false))
+	paused, err = readPaused(db)
+	require.NoError(err)
+	require.Empty(paused)
+
+	// independent of full pause
+	require.NoError(saveDownloadPaused(db, h, true))
+	paused, err = readPaused(db)
+	require.NoError(err)
+	require.Empty(paused)
+	downloadPaused, err := readDownloadPaused(db)
+	require.NoError(err)
+	require.Contains(downloadPaused, h)
+}
+
+func TestAddTorrentFilesSkipsBroken(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	require.NoError(os.WriteFile(filepath.Join(dir, "v1-000500-001000-bodies.seg.torrent"), []byte("garbage"), 0644))
+
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	err = AddTorrentFiles(context.Background(), dir, cl, DefaultAddOptions())
+	var failed AddErrors
+	require.True(errors.As(err, &failed), err)
+	require.Len(failed, 1)
+	require.Len(cl.Torrents(), 1)
+}
+
+func TestAddTorrentFilesOverlapping(t *testing.T) {
+	require := require.New(t)
+	dir, other := t.TempDir(), t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	createTestSegment(t, other, "v1-000000-000500-bodies.seg", DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), other, false))
+	b, err := os.ReadFile(filepath.Join(other, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+	require.NoError(os.WriteFile(filepath.Join(dir, "v1-000500-001000-bodies.seg.torrent"), b, 0644))
+
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	err = AddTorrentFiles(context.Background(), dir, cl, DefaultAddOptions())
+	require.ErrorIs(err, ErrOverlappingPaths)
+	require.Empty(cl.Torrents())
+}
+
+func TestParseMagnets(t *testing.T) {
+	require := require.New(t)
+	h := metainfo.Hash{1}
+	uri := (&metainfo.MetaInfo{AnnounceList: [][]string{{"udp://a:1"}}}).Magnet(&h, nil).String()
+	ms, err := parseMagnets(h, []string{uri})
+	require.NoError(err)
+	require.Equal([]string{"udp://a:1"}, ms[0].Trackers)
+
+	_, err = parseMagnets(metainfo.Hash{2}, []string{uri})
+	require.Error(err)
+	_, err = parseMagnets(h, []string{"not-a-magnet"})
+	require.Error(err)
+}
+
+func TestStatusLine(t *testing.T) {
+	require := require.New(t)
+	require.Equal("snapshots: no torrents | 0 B/s↓ 0 B/s↑ | 0 peers", AggStats{}.statusLine())
+	s := AggStats{Phase: PhaseDownloading, Progress: 62.34, torrentsCount: 3, peersCount: 12,
+		readBytesPerSec: 1024 * 1024, writeBytesPerSec: 2048, bytesLeft: 18 * 60 * 1024 * 1024}
+	require.Equal("snapshots: 62.3% | 1.0 MiB/s↓ 2.0 KiB/s↑ | 12 peers | ETA 18m0s", s.statusLine())
+	s.bytesLeft = 0
+	require.Equal("snapshots: seeding | 1.0 MiB/s↓ 2.0 KiB/s↑ | 12 peers", s.statusLine())
+	s.DownloadPaused = 1
+	require.Equal("snapshots: seeding | 1.0 MiB/s↓ 2.0 KiB/s↑ | 12 peers | paused 0, download paused 1", s.statusLine())
+}
+
+func TestVerifyHashesAgainstOracle(t *testing.T) {
+	require := require.New(t)
+	known := metainfo.Hash{1}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`'v1-000000-000500-bodies.seg' = '` + known.HexString() + `'`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	require.NoError(VerifyHashesAgainstOracle(ctx, []metainfo.Hash{known}, srv.URL))
+	err := VerifyHashesAgainstOracle(ctx, []metainfo.Hash{known, {2}}, srv.URL)
+	require.ErrorIs(err, ErrHashesNotInOracle)
+	require.Contains(err.Error(), metainfo.Hash{2}.HexString())
+}
+
+func TestBandwidthShares(t *testing.T) {
+	require := require.New(t)
+	h1, h2, h3 := metainfo.Hash{1}, metainfo.Hash{2}, metainfo.Hash{3}
+	b := newBandwidthShares()
+	l1, l2, l3 := b.limiter(h1), b.limiter(h2), b.limiter(h3)
+
+	// no weights - library's fairness
+	b.rebalance(400, []metainfo.Hash{h1, h2})
+	require.Equal(rate.Inf, l1.Limit())
+
+	b.weights[h1] = 3
+	b.rebalance(400, []metainfo.Hash{h1, h2})
+	require.Equal(rate.Limit(300), l1.Limit())
+	require.Equal(rate.Limit(100), l2.Limit())
+	require.Equal(rate.Inf, l3.Limit()) // complete
+
+	// h1 complete - h2 gets all
+	b.rebalance(400, []metainfo.Hash{h2})
+	require.Equal(rate.Inf, l1.Limit())
+	require.Equal(rate.Limit(400), l2.Limit())
+
+	b.rebalance(rate.Inf, []metainfo.Hash{h1, h2})
+	require.Equal(rate.Inf, l2.Limit())
+}
+
+func TestSchedulingFinishLine(t *testing.T) {
+	require := require.New(t)
+	_, err := ParseSchedulingPolicy("fastest")
+	require.Error(err)
+	require.Error(validateFinishLineThreshold(1))
+
+	h1, h2 := metainfo.Hash{1}, metainfo.Hash{2}
+	b := newBandwidthShares()
+	l1, l2 := b.limiter(h1), b.limiter(h2)
+	b.boost([]metainfo.Hash{h2})
+	b.rebalance(1100, []metainfo.Hash{h1, h2})
+	require.Equal(rate.Limit(100), l1.Limit())
+	require.Equal(rate.Limit(1000), l2.Limit())
+
+	// boosts are replaced, not accumulated
+	b.boost(nil)
+	b.rebalance(1100, []metainfo.Hash{h1, h2})
+	require.Equal(rate.Inf, l1.Limit())
+}
+
+func TestNoProgressDeadline(t *testing.T) {
+	require := require.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	tr, _ := cl.AddTorrentInfoHash(metainfo.Hash{1})
+
+	var w progressWatch
+	now := time.Now()
+	require.NoError(w.check(time.Minute, []*torrent.Torrent{tr}, now))
+	require.NoError(w.check(time.Minute, []*torrent.Torrent{tr}, now.Add(30*time.Second)))
+	// nothing expected to download - doesn't count
+	require.NoError(w.check(time.Minute, nil, now.Add(50*time.Second)))
+	require.NoError(w.check(time.Minute, []*torrent.Torrent{tr}, now.Add(100*time.Second)))
+
+	err = w.check(time.Minute, []*torrent.Torrent{tr}, now.Add(170*time.Second))
+	require.True(errors.Is(err, ErrNoProgress))
+	var noProgress *NoProgressError
+	require.True(errors.As(err, &noProgress))
+	require.Equal([]string{metainfo.Hash{1}.HexString()}, noProgress.Stuck)
+}
+
+func TestExcludedFilesDontBlockCompletion(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	root := filepath.Join(dir, "bundle")
+	require.NoError(os.MkdirAll(root, 0755))
+	require.NoError(os.WriteFile(filepath.Join(root, "a.seg"), make([]byte, 32*1024), 0644))
+	require.NoError(os.WriteFile(filepath.Join(root, "debug.dump"), []byte("dump, not downloaded"), 0644))
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	require.NoError(info.BuildFromFilePath(root))
+	require.NoError(os.Remove(filepath.Join(root, "debug.dump")))
+	mi := &metainfo.MetaInfo{}
+	mi.InfoBytes, _ = bencode.Marshal(info)
+
+	cfg := torrent.TestingConfig(t)
+	cfg.DataDir = dir
+	cl, err := torrent.NewClient(cfg)
+	require.NoError(err)
+	defer cl.Close()
+	tr, err := cl.AddTorrent(mi)
+	require.NoError(err)
+	tr.VerifyData()
+
+	cli := &Client{excluded: map[metainfo.Hash][]string{}}
+	cli.setTorrentClient(cl)
+	require.False(cli.torrentComplete(tr))
+	require.Error(cli.ExcludeFiles(tr.InfoHash(), []string{"["}))
+	require.NoError(cli.ExcludeFiles(tr.InfoHash(), []string{"*.dump"}))
+	require.True(cli.torrentComplete(tr))
+	require.Equal(torrent.PiecePriorityNone, tr.PieceState(2).Priority)
+}
+
+type fakePiece struct {
+	storage.PieceImpl
+	complete bool
+}
+
+func (p *fakePiece) MarkComplete() error    { p.complete = true; return nil }
+func (p *fakePiece) MarkNotComplete() error { p.complete = false; return nil }
+func (p *fakePiece) WriteAt(b []byte, _ int64) (int, error) {
+	time.Sleep(time.Millisecond)
+	return len(b), nil
+}
+func (p *fakePiece) Completion() storage.Completion {
+	return storage.Completion{Complete: p.complete, Ok: true}
+}
+
+func TestDurabilityFile(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	info := &metainfo.Info{Name: "bundle", PieceLength: 10, Files: []metainfo.FileInfo{
+		{Path: []string{"a"}, Length: 15}, // pieces 0, 1
+		{Path: []string{"b"}, Length: 15}, // pieces 1, 2
+	}}
+	for _, path := range filesPaths(dir, info) {
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(os.WriteFile(path, make([]byte, 15), 0644))
+	}
+	inner := []*fakePiece{{}, {}, {}}
+	durable := newDurableTorrent(DurabilityFile, dir, info)
+	durable.initRemaining(func(i int) storage.PieceImpl { return inner[i] }, len(inner))
+	piece := func(i int) durablePiece { return durablePiece{PieceImpl: inner[i], t: durable, index: i} }
+
+	require.NoError(piece(0).MarkComplete())
+	require.True(piece(0).Completion().Complete)
+	require.False(inner[0].complete) // file "a" not complete yet
+
+	require.NoError(piece(1).MarkComplete())
+	require.True(inner[0].complete)  // "a" complete and synced
+	require.False(inner[1].complete) // spans not complete "b"
+
+	// verification of pending piece failed - it's downloaded again
+	require.NoError(piece(1).MarkNotComplete())
+	require.False(piece(1).Completion().Complete)
+	require.NoError(piece(2).MarkComplete())
+	require.False(inner[2].complete)
+	require.NoError(piece(1).MarkComplete())
+	require.True(inner[1].complete)
+	require.True(inner[2].complete)
+}
+
+func TestFake(t *testing.T) {
+	require := require.New(t)
+	var d Downloader = NewFake()
+	hash := metainfo.Hash{1}
+	for i := 0; i < 2; i++ {
+		added, err := d.AddMagnet(metainfo.Magnet{InfoHash: hash}.String())
+		require.NoError(err)
+		require.Equal(hash, added)
+	}
+	_, err := d.AddMagnet("garbage")
+	require.Error(err)
+	require.Equal([]metainfo.Hash{hash}, d.List())
+
+	d.(*Fake).Complete()
+	<-d.Completed()
+	d.Close()
+	require.True(d.(*Fake).Closed())
+}
+
+func TestExpectedNames(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-headers.seg", DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(dir, "v1-000000-000500-headers.seg.torrent"))
+	require.NoError(err)
+	hash := mi.HashInfoBytes()
+
+	_, err = namesByHash(map[string]string{"a.seg": hash.HexString(), "b.seg": hash.HexString()})
+	require.Error(err)
+	names, err := namesByHash(map[string]string{"v1-000000-000500-bodies.seg": hash.HexString()})
+	require.NoError(err)
+
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	opts := DefaultAddOptions()
+	opts.ExpectedNames = names
+	err = AddTorrentFiles(context.Background(), dir, cl, opts)
+	require.True(errors.Is(err, ErrNameMismatch), err)
+	require.Len(cl.Torrents(), 0)
+
+	opts.ExpectedNames = map[metainfo.Hash]string{hash: "v1-000000-000500-headers.seg"}
+	require.NoError(AddTorrentFiles(context.Background(), dir, cl, opts))
+	require.Len(cl.Torrents(), 1)
+}
+
+func TestAddTorrentFilesMaxVerifying(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	for _, name := range []string{"v1-000000-000500-bodies.seg", "v1-000500-001000-bodies.seg", "v1-001000-001500-bodies.seg"} {
+		createTestSegment(t, dir, name, 2*DefaultPieceSize)
+	}
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+
+	cfg := torrent.TestingConfig(t)
+	cfg.DataDir = dir
+	cl, err := torrent.NewClient(cfg)
+	require.NoError(err)
+	defer cl.Close()
+	opts := DefaultAddOptions()
+	opts.MaxVerifying = 2
+	require.NoError(AddTorrentFiles(context.Background(), dir, cl, opts))
+	require.Len(cl.Torrents(), 3)
+	verified := 0
+	for _, tr := range cl.Torrents() {
+		if tr.Complete.Bool() {
+			verified++
+		}
+	}
+	require.GreaterOrEqual(verified, 2) // first batch verified before last torrent added
+}
+
+func TestQuotaCarry(t *testing.T) {
+	require := require.New(t)
+	old, fresh := &torrent.Client{}, &torrent.Client{}
+	var q downloadQuota
+	require.Equal(int64(100), q.read(old, 100))
+	q.carry(old, 150) // restart: 50 read since last check
+	require.Equal(int64(50+10), q.read(fresh, 10))
+	require.Equal(int64(5), q.read(fresh, 15))
+}
+
+func TestETA(t *testing.T) {
+	require := require.New(t)
+	require.Equal(time.Duration(0), eta(0, 0))
+	require.Equal(ETAUnknown, eta(100, 0))
+	require.Equal(10*time.Second, eta(100, 10))
+	require.Equal(ETAUnknown, eta(20<<30, 2))
+	require.Equal(ETAUnknown, eta(math.MaxInt64, 1))
+}
+
+func TestExternalPortAnnounce(t *testing.T) {
+	require := require.New(t)
+	require.Error(validatePort(65536))
+	require.Error(validatePort(-1))
+
+	ports := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ports <- r.URL.Query().Get("port")
+		_ = bencode.NewEncoder(w).Encode(map[string]interface{}{"interval": 60, "peers": "\x7f\x00\x00\x01\x1a\xe1"})
+	}))
+	defer srv.Close()
+
+	cfg := torrent.TestingConfig(t)
+	cl, err := torrent.NewClient(cfg)
+	require.NoError(err)
+	defer cl.Close()
+	tr, _, err := cl.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: metainfo.Hash{1}, Trackers: [][]string{{srv.URL + "/announce"}}})
+	require.NoError(err)
+
+	cli := &Client{cfg: &Cfg{ClientConfig: cfg}}
+	cli.setTorrentClient(cl)
+	a := newExternalAnnouncer(4444)
+	a.maybeAnnounce(context.Background(), cli, tr)
+	require.Equal("4444", <-ports)
+	require.Eventually(func() bool {
+		ok, errs := a.results()
+		return ok == 1 && len(errs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Contains(a.announceLatencies(), srv.URL+"/announce")
+}
+
+func TestLogThrottle(t *testing.T) {
+	require := require.New(t)
+	lt := newLogThrottle(time.Minute)
+	start := time.Now()
+	ok, _, _ := lt.check("peers", "0", start)
+	require.True(ok)
+	for i := 1; i < 12; i++ { // every 5s, same value
+		ok, _, _ = lt.check("peers", "0", start.Add(time.Duration(i)*5*time.Second))
+		require.False(ok)
+	}
+	ok, repeats, unchanged := lt.check("peers", "0", start.Add(time.Minute))
+	require.True(ok)
+	require.Equal(12, repeats)
+	require.Equal(time.Minute, unchanged)
+
+	ok, repeats, _ = lt.check("peers", "1", start.Add(time.Minute+time.Second))
+	require.True(ok)
+	require.Zero(repeats)
+	ok, _, _ = lt.check("other", "0", start.Add(time.Minute+time.Second))
+	require.True(ok)
+}
+
+func TestRequestReverify(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(dir, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+
+	cfg := torrent.TestingConfig(t)
+	cfg.DataDir = dir
+	cl, err := torrent.NewClient(cfg)
+	require.NoError(err)
+	defer cl.Close()
+	tr, err := cl.AddTorrent(mi)
+	require.NoError(err)
+	tr.VerifyData()
+	require.True(tr.Complete.Bool())
+
+	cli := &Client{reverifyQueue: map[metainfo.Hash]struct{}{}, reverifying: map[metainfo.Hash]struct{}{}}
+	cli.setTorrentClient(cl)
+	require.ErrorIs(cli.RequestReverify(metainfo.Hash{1}), ErrTorrentNotFound)
+	f, err := os.OpenFile(filepath.Join(dir, "v1-000000-000500-bodies.seg"), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte{0, 1, 2}, DefaultPieceSize+1)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	require.NoError(cli.RequestReverify(tr.InfoHash()))
+	cli.processReverify(context.Background())
+	require.Eventually(func() bool { return !tr.PieceState(1).Complete }, 5*time.Second, 10*time.Millisecond)
+	require.True(tr.PieceState(0).Complete)
+}
+
+func TestMaxRequestsPerPeer(t *testing.T) {
+	require := require.New(t)
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cfg.MaxRequestsPerPeer = 500
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+
+	// torrent client got config with callbacks
+	callbacks := cli.cfg.ClientConfig.Callbacks
+	p := &torrent.Peer{PeerMaxRequests: 250}
+	for _, f := range callbacks.NewPeer {
+		f(p)
+	}
+	require.Equal(500, p.PeerMaxRequests)
+	for peerLimit, expect := range map[int]int{0: 500, 250: 250, 1000: 500} {
+		msg := &pp.ExtendedHandshakeMessage{Reqq: peerLimit}
+		callbacks.ReadExtendedHandshake(nil, msg)
+		require.Equal(expect, msg.Reqq, peerLimit)
+	}
+
+	cfg, err = TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cfg.MaxRequestsPerPeer = -1
+	_, err = New(cfg, memdb.NewTestDB(t))
+	require.Error(err)
+}
+
+func TestRequirePreverified(t *testing.T) {
+	require := require.New(t)
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	db := memdb.NewTestDB(t)
+	cli, err := New(cfg, db)
+	require.NoError(err)
+	defer cli.Close()
+
+	// empty list means "no snapshots" by default
+	require.NoError(ResolveAbsentTorrents(context.Background(), cli.TorrentClient(), db, nil, cfg.DataDir, cli.addOptions()))
+
+	cli.cfg.RequirePreverified = true
+	err = ResolveAbsentTorrents(context.Background(), cli.TorrentClient(), db, nil, cfg.DataDir, cli.addOptions())
+	require.ErrorIs(err, ErrNoPreverified)
+}
+
+func TestAddOptionsOfCfg(t *testing.T) {
+	require := require.New(t)
+	cli := &Client{cfg: &Cfg{ClientConfig: torrent.NewDefaultClientConfig()}}
+	require.Equal(DefaultMaxTorrents, cli.addOptions().MaxTorrents)
+	require.Empty(cli.addOptions().Passkey)
+
+	magnets := map[metainfo.Hash][]string{{1}: {"magnet:?xt=urn:btih:0100000000000000000000000000000000000000"}}
+	cli.cfg.Passkey, cli.cfg.MaxTorrents, cli.cfg.Magnets = "secret", 5, magnets
+	opts := cli.addOptions()
+	require.Equal("secret", opts.Passkey)
+	require.Equal(5, opts.MaxTorrents)
+	require.Equal(magnets, opts.Magnets)
+
+	cli.cfg.MaxTorrents = -1
+	require.Equal(0, cli.addOptions().MaxTorrents) // unlimited
+}
+
+func TestSessionRatio(t *testing.T) {
+	require := require.New(t)
+	require.Equal(0.0, sessionRatio(0, 0))
+	require.True(math.IsInf(sessionRatio(10, 0), 1))
+	require.Equal(0.5, sessionRatio(5, 10))
+
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+	cli.session.uploaded, cli.session.downloaded = 30, 10
+	require.Equal(3.0, cli.SessionRatio())
+	cli.ResetSession()
+	up, down := cli.SessionBytes()
+	require.Zero(up)
+	require.Zero(down)
+}
+
+func TestPieceEvents(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	got := make(chan int, 2*pieceEventsBuffer)
+	events := newPieceEvents(nil, func(hash metainfo.Hash, pieceIndex int) {
+		<-release
+		got <- pieceIndex
+	})
+	hash := metainfo.Hash{1}
+	p := notifyingPiece{PieceImpl: &fakePiece{}, events: events, hash: hash, index: 7}
+	require.NoError(p.MarkComplete())
+	require.NoError(p.MarkComplete()) // already complete - no event
+
+	// consumer is blocked: buffer fills, then events are dropped without blocking
+	for i := 0; i < pieceEventsBuffer+10; i++ {
+		events.notify(hash, i)
+	}
+	events.lock.Lock()
+	require.Greater(events.dropped, 0)
+	events.lock.Unlock()
+
+	close(release)
+	events.close()
+	require.Equal(7, <-got)
+	require.Equal(0, <-got)
+}
+
+func TestPortInUse(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(err)
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, port)
+	require.NoError(err)
+	_, err = New(cfg, memdb.NewTestDB(t))
+	require.ErrorIs(err, ErrPortInUse)
+	require.Contains(err.Error(), strconv.Itoa(port))
+
+	cfg, err = TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, port)
+	require.NoError(err)
+	cfg.AnyPortIfBusy = true
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+	require.NotEqual(port, cli.TorrentClient().LocalPort())
+}
+
+func TestConfigValidate(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	require.NoError(Config{SnapshotsDir: dir, ListenPort: 42069}.Validate())
+	require.Error(Config{}.Validate())
+	require.Error(Config{SnapshotsDir: dir, StagingDir: dir + "/"}.Validate())
+	require.Error(Config{SnapshotsDir: dir, ListenPort: 70000}.Validate())
+	require.Error(Config{SnapshotsDir: dir, ProxyURL: "socks5://proxy:1080"}.Validate())
+
+	cli, err := NewFromConfig(Config{SnapshotsDir: dir, Seeding: true, Verbosity: lg.Warning}, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+	require.True(cli.cfg.Seed)
+	require.Equal(dir, cli.cfg.DataDir)
+}
+
+func TestLastActivity(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(dir, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+
+	seederCfg := torrent.TestingConfig(t)
+	seederCfg.DataDir = dir
+	seederCfg.Seed = true
+	seeder, err := torrent.NewClient(seederCfg)
+	require.NoError(err)
+	defer seeder.Close()
+	seeding, err := seeder.AddTorrent(mi)
+	require.NoError(err)
+	seeding.VerifyData()
+
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	tr, err := cl.AddTorrent(mi)
+	require.NoError(err)
+	cli := &Client{}
+	cli.setTorrentClient(cl)
+
+	start := time.Now()
+	cli.rates.sample(cl.Torrents(), start)
+	cli.rates.sample(cl.Torrents(), start.Add(time.Minute))
+	require.Equal(start, cli.LastActivity()[tr.InfoHash()]) // idle
+
+	tr.AddClientPeer(seeder)
+	tr.DownloadAll()
+	require.Eventually(func() bool { return tr.Complete.Bool() }, 10*time.Second, 10*time.Millisecond)
+	cli.rates.sample(cl.Torrents(), start.Add(2*time.Minute))
+	require.Equal(start.Add(2*time.Minute), cli.LastActivity()[tr.InfoHash()])
+}
+
+func TestSaveLoadState(t *testing.T) {
+	require := require.New(t)
+	primaryDir, standbyDir := t.TempDir(), t.TempDir()
+	createTestSegment(t, primaryDir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), primaryDir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(primaryDir, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+	data, err := os.ReadFile(filepath.Join(primaryDir, "v1-000000-000500-bodies.seg"))
+	require.NoError(err)
+
+	cfg, err := TorrentConfig(primaryDir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	primary, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer primary.Close()
+	tr, err := primary.TorrentClient().AddTorrent(mi)
+	require.NoError(err)
+	tr.VerifyData()
+	require.True(tr.Complete.Bool())
+	require.NoError(primary.PauseDownload(tr.InfoHash()))
+	var state bytes.Buffer
+	require.NoError(primary.SaveState(&state))
+
+	// replicated data dir: no completion store, data not verified there
+	data[0]++ // LoadState trusts state, corruption is not noticed
+	require.NoError(os.WriteFile(filepath.Join(standbyDir, "v1-000000-000500-bodies.seg"), data, 0644))
+	cfg, err = TorrentConfig(standbyDir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	standby, err := LoadState(&state, cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer standby.Close()
+	require.Equal(primary.TorrentClient().PeerID(), standby.TorrentClient().PeerID())
+	restored, ok := standby.TorrentClient().Torrent(tr.InfoHash())
+	require.True(ok)
+	require.NotNil(restored.Info())
+	require.True(restored.Complete.Bool())
+	require.True(standby.isDownloadPaused(tr.InfoHash()))
+}
+
+func TestCheckOverlappingPaths(t *testing.T) {
+	require := require.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	add := func(info metainfo.Info) *torrent.Torrent {
+		info.PieceLength = DefaultPieceSize
+		info.Pieces = make([]byte, 20)
+		infoBytes, err := bencode.Marshal(info)
+		require.NoError(err)
+		tr, err := cl.AddTorrent(&metainfo.MetaInfo{InfoBytes: infoBytes})
+		require.NoError(err)
+		return tr
+	}
+	file := add(metainfo.Info{Name: "a.seg", Length: 10})
+	sameFile := add(metainfo.Info{Name: "a.seg", Length: 11})
+	fileAsDir := add(metainfo.Info{Name: "a.seg", Files: []metainfo.FileInfo{{Path: []string{"x"}, Length: 10}}})
+	dir1 := add(metainfo.Info{Name: "d", Files: []metainfo.FileInfo{{Path: []string{"x"}, Length: 10}}})
+	dir2 := add(metainfo.Info{Name: "d", Files: []metainfo.FileInfo{{Path: []string{"y"}, Length: 10}}})
+
+	require.NoError(checkOverlappingPaths(torrentInfos([]*torrent.Torrent{file, dir1, dir2})))
+	err = checkOverlappingPaths(torrentInfos([]*torrent.Torrent{file, sameFile}))
+	require.ErrorIs(err, ErrOverlappingPaths)
+	require.Contains(err.Error(), "a.seg")
+	require.ErrorIs(checkOverlappingPaths(torrentInfos([]*torrent.Torrent{file, fileAsDir})), ErrOverlappingPaths)
+	require.ErrorIs(checkOverlappingPaths(torrentInfos([]*torrent.Torrent{fileAsDir, file})), ErrOverlappingPaths)
+}
+
+func TestResolveAbsentTorrentsMaxResolving(t *testing.T) {
+	require := require.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	opts := DefaultAddOptions()
+	opts.MaxResolving = 2
+	opts.GotInfoTimeout = 300 * time.Millisecond
+
+	// no peers: first wave never resolves, 3rd magnet is not added
+	hashes := []metainfo.Hash{{1}, {2}, {3}}
+	err = ResolveAbsentTorrents(context.Background(), cl, memdb.NewTestDB(t), hashes, t.TempDir(), opts)
+	require.ErrorIs(err, context.DeadlineExceeded)
+	require.Len(cl.Torrents(), 2)
+	_, ok := cl.Torrent(metainfo.Hash{3})
+	require.False(ok)
+}
+
+func TestResolveAbsentTorrentsNameMismatch(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-headers.seg", DefaultPieceSize)
+	createTestSegment(t, dir, "v1-000500-001000-headers.seg", DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	var hashes []metainfo.Hash
+	for _, name := range []string{"v1-000000-000500-headers.seg", "v1-000500-001000-headers.seg"} {
+		mi, err := metainfo.LoadFromFile(filepath.Join(dir, name+".torrent"))
+		require.NoError(err)
+		hashes = append(hashes, mi.HashInfoBytes())
+	}
+
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	db := memdb.NewTestDB(t)
+	opts := DefaultAddOptions()
+	// mismatch of first hash doesn't stop second one
+	opts.ExpectedNames = map[metainfo.Hash]string{hashes[0]: "v1-000000-000500-bodies.seg"}
+	err = ResolveAbsentTorrents(context.Background(), cl, db, hashes, dir, opts)
+	require.ErrorIs(err, ErrNameMismatch)
+	var rejected AddErrors
+	require.True(errors.As(err, &rejected))
+	require.Len(rejected, 1)
+	require.Len(cl.Torrents(), 1)
+	_, ok := cl.Torrent(hashes[1])
+	require.True(ok)
+	cached, err := readInfoBytes(db, hashes[1])
+	require.NoError(err)
+	require.NotEmpty(cached)
+}
+
+func TestReadOnlyData(t *testing.T) {
+	require := require.New(t)
+	dir, completionDir := t.TempDir(), t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	createTestSegment(t, dir, "v1-000500-001000-bodies.seg", DefaultPieceSize) // no .torrent file
+	listDir := func() (names []string) {
+		entries, err := os.ReadDir(dir)
+		require.NoError(err)
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	before := listDir()
+
+	require.Error(Config{SnapshotsDir: dir, ReadOnlyData: true}.Validate())
+	require.Error(Config{SnapshotsDir: dir, ReadOnlyData: true, CompletionDir: dir}.Validate())
+	cli, err := NewFromConfig(Config{SnapshotsDir: dir, ReadOnlyData: true, CompletionDir: completionDir, Seeding: true, Verbosity: lg.Warning}, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+	require.NoError(CreateTorrentFilesAndAdd(context.Background(), dir, cli))
+	require.Len(cli.TorrentClient().Torrents(), 1)
+	tr := cli.TorrentClient().Torrents()[0]
+	require.Eventually(func() bool { return tr.Complete.Bool() }, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(before, listDir())
+	stored, err := os.ReadDir(completionDir)
+	require.NoError(err)
+	require.NotEmpty(stored)
+}
+
+func TestBackpressure(t *testing.T) {
+	require := require.New(t)
+	w := &storageWrites{}
+	p := throttledPiece{PieceImpl: &fakePiece{}, limiter: rate.NewLimiter(rate.Inf, 0), writes: w}
+	_, _ = p.WriteAt([]byte{1}, 0)
+	require.Greater(w.busy, int64(0))
+
+	w.busy, w.inFlight = int64(10*time.Second), 3
+	pending, load := w.sample(5 * time.Second)
+	require.Equal(int64(3), pending)
+	require.Equal(2.0, load)
+	require.Equal(BottleneckDisk, bottleneck(1000, load))
+	_, load = w.sample(5 * time.Second) // nothing written since
+	require.Zero(load)
+	require.Equal(BottleneckNetwork, bottleneck(1000, load))
+	require.Equal(BottleneckNone, bottleneck(0, load))
+}
+
+func TestDialSocket(t *testing.T) {
+	require := require.New(t)
+	require.NoError(DialSocket{}.Validate())
+	require.Error(DialSocket{PortMin: 100}.Validate())
+	require.Error(DialSocket{PortMin: 200, PortMax: 100}.Validate())
+	require.Error(DialSocket{PortMin: 100, PortMax: 70000}.Validate())
+	s := DialSocket{ReuseAddr: true, ReusePort: true, PortMin: 51000, PortMax: 51100}
+	if runtime.GOOS != "linux" {
+		require.Error(s.Validate())
+		return
+	}
+	require.NoError(s.Validate())
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	d := &net.Dialer{Control: s.control}
+	for i := 0; i < 3; i++ {
+		c, err := d.Dial("tcp4", l.Addr().String())
+		require.NoError(err)
+		port := c.LocalAddr().(*net.TCPAddr).Port
+		c.Close()
+		require.True(port >= s.PortMin && port <= s.PortMax, port)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	require := require.New(t)
+	events := newEventStream(2)
+	events.publish(TorrentAdded{InfoHash: metainfo.Hash{1}})
+	events.publish(TorrentAdded{InfoHash: metainfo.Hash{2}})
+	events.publish(TorrentAdded{InfoHash: metainfo.Hash{3}}) // drops oldest
+	require.Equal(TorrentAdded{InfoHash: metainfo.Hash{2}}, <-events.ch)
+	require.Equal(TorrentAdded{InfoHash: metainfo.Hash{3}}, <-events.ch)
+
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	require.NoError(err)
+	defer cl.Close()
+	tr, _ := cl.AddTorrentInfoHash(metainfo.Hash{4})
+	events = newEventStream(eventsBuffer)
+	events.queue(metainfo.Hash{4}, PieceCompleted{InfoHash: metainfo.Hash{4}}) // before MainLoop seen torrent
+	events.queue(metainfo.Hash{}, VerifyFailed{})
+	tracked := newEventsTracker()
+	tracked.torrent(events, tr)
+	events.flush(tr.InfoHash())
+	tracked.torrent(events, tr) // once per torrent
+	tracked.prune(events, []*torrent.Torrent{tr}, []string{"10.0.0.1"})
+	tracked.prune(events, []*torrent.Torrent{tr}, []string{"10.0.0.1"})
+	events.flushAll()
+	events.close()
+
+	var got []Event
+	for ev := range events.ch {
+		got = append(got, ev)
+	}
+	require.Equal([]Event{TorrentAdded{InfoHash: metainfo.Hash{4}}, PieceCompleted{InfoHash: metainfo.Hash{4}},
+		PeerBanned{IP: net.ParseIP("10.0.0.1")}, VerifyFailed{}}, got)
+	events.publish(TorrentCompleted{}) // after close - ignored
+}
+
+func TestEventsOrder(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(dir, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+	cfg, err := TorrentConfig(dir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cfg.DefaultStorage = storage.NewFile(dir) // custom storage: pieces are notified too
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	tr, err := cli.TorrentClient().AddTorrent(mi)
+	require.NoError(err)
+	tr.VerifyData() // pieces complete before MainLoop seen torrent
+
+	defer func(interval time.Duration) { statsInterval = interval }(statsInterval)
+	statsInterval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_ = MainLoop(ctx, cli, false)
+	cli.Close()
+
+	var kinds []string
+	for ev := range cli.Events() {
+		switch ev := ev.(type) {
+		case TorrentAdded:
+			kinds = append(kinds, "added")
+		case PieceCompleted:
+			require.Equal(tr.InfoHash(), ev.InfoHash)
+			kinds = append(kinds, "piece")
+		case TorrentCompleted:
+			kinds = append(kinds, "completed")
+		}
+	}
+	require.Equal([]string{"added", "piece", "piece", "completed"}, kinds)
+}
+
+func TestCompletedBeforeRestart(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", DefaultPieceSize)
+	db := memdb.NewTestDB(t)
+	start := func() *Client {
+		cfg, err := TorrentConfig(dir, "", "", true, lg.Warning, 0, 0, 0)
+		require.NoError(err)
+		cli, err := New(cfg, db)
+		require.NoError(err)
+		require.NoError(CreateTorrentFilesAndAdd(context.Background(), dir, cli))
+		tr := cli.TorrentClient().Torrents()[0]
+		require.Eventually(func() bool { return tr.Complete.Bool() }, 5*time.Second, 10*time.Millisecond)
+		cli.markTorrentCompleted(tr)
+		return cli
+	}
+	countCompleted := func() (n int) {
+		events, err := readAuditEvents(db, time.Time{})
+		require.NoError(err)
+		for _, ev := range events {
+			if ev.Kind == AuditCompleted {
+				n++
+			}
+		}
+		return n
+	}
+
+	cli := start()
+	require.Equal(1, cli.completedSinceStart)
+	cli.Close()
+	require.Equal(1, countCompleted())
+
+	// restart: completion is known from db - not repeated
+	cli = start()
+	defer cli.Close()
+	require.Equal(0, cli.completedSinceStart)
+	require.Equal(1, countCompleted())
+}
+
+func TestReconfigure(t *testing.T) {
+	require := require.New(t)
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	db := memdb.NewTestDB(t)
+	cli, err := New(cfg, db)
+	require.NoError(err)
+	defer cli.Close()
+	h1, h2 := metainfo.Hash{1}, metainfo.Hash{2}
+	require.NoError(cli.Pause(h1))
+	trackers := [][]string{{"udp://tracker.example.com:1337/announce"}}
+	packageTrackers := Trackers
+
+	// invalid input - nothing applied
+	err = cli.Reconfigure(RuntimeConfig{ConnsPerTorrent: 7, Paused: []metainfo.Hash{h2}, Trackers: [][]string{{"ftp://x"}}})
+	require.Error(err)
+	require.Error(cli.Reconfigure(RuntimeConfig{ConnsPerTorrent: 7, Paused: []metainfo.Hash{{}}}))
+	require.Equal(cfg.EstablishedConnsPerTorrent, cli.maxConnsPerTorrent())
+	require.True(cli.isPaused(h1))
+	require.False(cli.isPaused(h2))
+
+	require.NoError(cli.Reconfigure(RuntimeConfig{ConnsPerTorrent: 7, Paused: []metainfo.Hash{h2}, Trackers: trackers}))
+	require.Equal(7, cli.maxConnsPerTorrent())
+	require.Equal(trackers, cli.addOptions().AnnounceList)
+	require.Equal(packageTrackers, Trackers)
+	require.False(cli.isPaused(h1))
+	require.True(cli.isPaused(h2))
+	paused, err := readPaused(db)
+	require.NoError(err)
+	require.Equal(map[metainfo.Hash]struct{}{h2: {}}, paused)
+}
+
+func TestDownloaderControl(t *testing.T) {
+	require := require.New(t)
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	db := memdb.NewTestDB(t)
+	cli, err := New(cfg, db)
+	require.NoError(err)
+	defer cli.Close()
+	h := metainfo.Hash{1}
+	_, _, err = cli.TorrentClient().AddTorrentSpec(&torrent.TorrentSpec{InfoHash: h})
+	require.NoError(err)
+
+	srv, err := NewGrpcServer(db, cli)
+	require.NoError(err)
+	grpcServer := grpc.NewServer()
+	proto_control.RegisterDownloaderControlServer(grpcServer, srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go func() { _ = grpcServer.Serve(l) }()
+	defer grpcServer.Stop()
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = protoregistry.GlobalFiles.FindDescriptorByName("downloader.DownloaderControl") // for reflection
+	require.NoError(err)
+	control := proto_control.NewDownloaderControlClient(conn)
+	req := &proto_downloader.DownloadRequest{Items: []*proto_downloader.DownloadItem{{TorrentHash: gointerfaces.ConvertAddressToH160(h)}}}
+
+	_, err = control.Pause(ctx, req)
+	require.NoError(err)
+	require.True(cli.isPaused(h))
+	list, err := control.List(ctx, &emptypb.Empty{})
+	require.NoError(err)
+	require.Len(list.Torrents, 1)
+	require.Equal(h, metainfo.Hash(gointerfaces.ConvertH160toAddress(list.Torrents[0].InfoHash)))
+	require.True(list.Torrents[0].Paused)
+	_, err = control.Resume(ctx, req)
+	require.NoError(err)
+	require.False(cli.isPaused(h))
+	_, err = control.Pause(ctx, &proto_downloader.DownloadRequest{Items: []*proto_downloader.DownloadItem{{Path: "x"}}})
+	require.Error(err)
+
+	defer func(interval time.Duration) { statsInterval = interval }(statsInterval)
+	statsInterval = 10 * time.Millisecond
+	stream, err := control.Progress(ctx, &proto_downloader.StatsRequest{})
+	require.NoError(err)
+	for i := 0; i < 2; i++ {
+		reply, err := stream.Recv()
+		require.NoError(err)
+		require.Equal(int32(1), reply.Torrents)
+	}
+
+	_, err = control.Remove(ctx, req)
+	require.NoError(err)
+	_, ok := cli.TorrentClient().Torrent(h)
+	require.False(ok)
+}
+
+func TestTrackerFailoverPasskey(t *testing.T) {
+	require := require.New(t)
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cfg.TrackerFailover = time.Minute
+	cfg.Passkey = "secret"
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+	require.NoError(cli.Reconfigure(RuntimeConfig{Trackers: [][]string{
+		{"http://first.example.com/" + PasskeyPlaceholder + "/announce"},
+		{"http://second.example.com/" + PasskeyPlaceholder + "/announce"},
+	}}))
+	tr, _, err := cli.TorrentClient().AddTorrentSpec(&torrent.TorrentSpec{InfoHash: metainfo.Hash{1}})
+	require.NoError(err)
+
+	cli.checkTrackerFailover(tr)
+	cli.failover[tr.InfoHash()].activeAt = time.Now().Add(-2 * time.Minute)
+	cli.checkTrackerFailover(tr)
+	require.Equal(1, cli.failover[tr.InfoHash()].tier)
+	require.Contains(tr.Metainfo().AnnounceList, []string{"http://second.example.com/secret/announce"})
+
+	cli.pruneTrackerFailover(cli.TorrentClient().Torrents())
+	require.Len(cli.failover, 1)
+	tr.Drop()
+	cli.pruneTrackerFailover(cli.TorrentClient().Torrents())
+	require.Empty(cli.failover)
+}
+
+func TestRemoveClosesReader(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	mi, err := metainfo.LoadFromFile(filepath.Join(dir, "v1-000000-000500-bodies.seg.torrent"))
+	require.NoError(err)
+	cfg, err := TorrentConfig(dir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+
+	for _, drop := range []func(metainfo.Hash) error{cli.StopSeeding, cli.Remove} {
+		tr, err := cli.TorrentClient().AddTorrent(mi)
+		require.NoError(err)
+		require.NoError(cli.SetReadahead(tr.InfoHash(), 0, DefaultPieceSize))
+		require.Len(cli.readers, 1)
+		require.NoError(drop(tr.InfoHash()))
+		require.Empty(cli.readers)
+	}
+}
+
+func TestProbeTrackers(t *testing.T) {
+	require := require.New(t)
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/secret/announce" {
+			atomic.AddInt32(&hits, 1)
+		}
+	}))
+	defer srv.Close()
+	tracker := srv.URL + "/" + PasskeyPlaceholder + "/announce"
+	for _, private := range []bool{true, false} {
+		cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+		require.NoError(err)
+		cfg.Private = private
+		cfg.DisableTrackers = false
+		cfg.Passkey = "secret"
+		cli, err := New(cfg, memdb.NewTestDB(t))
+		require.NoError(err)
+		require.NoError(cli.Reconfigure(RuntimeConfig{Trackers: [][]string{{tracker}}}))
+		cli.probeTrackers(context.Background())
+		if private {
+			require.Zero(atomic.LoadInt32(&hits))
+			require.Empty(cli.TrackerLatencies())
+		} else {
+			require.Equal(int32(1), atomic.LoadInt32(&hits))
+			require.Contains(cli.TrackerLatencies(), tracker)
+		}
+		cli.Close()
+	}
+}
+
+func TestRestart(t *testing.T) {
+	require := require.New(t)
+	seedDir := t.TempDir()
+	var mis []*metainfo.MetaInfo
+	for _, name := range []string{"v1-000000-000500-bodies.seg", "v1-000500-001000-bodies.seg", "v1-001000-001500-bodies.seg"} {
+		createTestSegment(t, seedDir, name, 2*DefaultPieceSize)
+		info, err := BuildInfoBytesForFile(seedDir, name)
+		require.NoError(err)
+		mi := &metainfo.MetaInfo{}
+		mi.InfoBytes, err = bencode.Marshal(info)
+		require.NoError(err)
+		mis = append(mis, mi)
+	}
+	cfg, err := TorrentConfig(t.TempDir(), "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	db := memdb.NewTestDB(t)
+	cli, err := New(cfg, db)
+	require.NoError(err)
+	defer cli.Close()
+	require.NoError(cli.clientAlive())
+	var hashes []metainfo.Hash
+	for _, mi := range mis {
+		tr, err := cli.TorrentClient().AddTorrent(mi)
+		require.NoError(err)
+		hashes = append(hashes, tr.InfoHash())
+	}
+	require.NoError(cli.Pause(hashes[1]))
+	require.NoError(cli.PauseDownload(hashes[2]))
+
+	old := cli.TorrentClient()
+	require.NoError(cli.restart(cfg, db))
+	require.NotSame(old, cli.TorrentClient())
+	select {
+	case <-old.Closed():
+	default:
+		t.Fatal("old torrent client is not closed")
+	}
+	require.NoError(cli.clientAlive())
+	require.Len(cli.TorrentClient().Torrents(), len(hashes))
+	for _, h := range hashes {
+		tr, ok := cli.TorrentClient().Torrent(h)
+		require.True(ok)
+		require.Eventually(func() bool { return tr.PieceState(0).Priority == torrent.PiecePriorityNormal }, 5*time.Second, 10*time.Millisecond, "re-added torrent is not marked for download")
+	}
+	require.True(cli.isPaused(hashes[1]))
+	require.True(cli.isDownloadPaused(hashes[2]))
+}
+
+func TestMigrateDataDir(t *testing.T) {
+	require := require.New(t)
+	oldDir, otherDir, seedDir := t.TempDir(), t.TempDir(), t.TempDir()
+	newDir := filepath.Join(t.TempDir(), "snapshots")
+	torrentOf := func(dir, name string) *metainfo.MetaInfo {
+		createTestSegment(t, dir, name, 2*DefaultPieceSize)
+		info, err := BuildInfoBytesForFile(dir, name)
+		require.NoError(err)
+		mi := &metainfo.MetaInfo{}
+		mi.InfoBytes, err = bencode.Marshal(info)
+		require.NoError(err)
+		return mi
+	}
+	inDataDir := torrentOf(oldDir, "v1-000000-000500-bodies.seg")
+	inOtherDir := torrentOf(otherDir, "v1-000500-001000-bodies.seg")
+	absent := torrentOf(seedDir, "v1-001000-001500-bodies.seg")
+
+	cfg, err := TorrentConfig(oldDir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cfg.DirSelector = func(name string, _ metainfo.Hash) string {
+		if name == "v1-000500-001000-bodies.seg" {
+			return otherDir
+		}
+		return ""
+	}
+	db := memdb.NewTestDB(t)
+	cli, err := New(cfg, db)
+	require.NoError(err)
+	defer cli.Close()
+	var hashes []metainfo.Hash
+	for _, mi := range []*metainfo.MetaInfo{inDataDir, inOtherDir, absent} {
+		tr, err := cli.TorrentClient().AddTorrent(mi)
+		require.NoError(err)
+		tr.DownloadAll()
+		hashes = append(hashes, tr.InfoHash())
+	}
+	require.NoError(cli.PauseDownload(hashes[2]))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = MainLoop(ctx, cli, false) }()
+
+	cfg.DBPath = filepath.Join(oldDir, "db")
+	require.Error(cli.MigrateDataDir(ctx, newDir))
+	require.Equal(oldDir, cli.DataDir())
+	cfg.DBPath = ""
+
+	require.NoError(cli.MigrateDataDir(ctx, newDir))
+	require.Equal(newDir, cli.DataDir())
+	srv, err := NewGrpcServer(db, cli)
+	require.NoError(err)
+	require.Equal(newDir, srv.t.DataDir())
+	require.FileExists(filepath.Join(newDir, "v1-000000-000500-bodies.seg"))
+	require.FileExists(filepath.Join(newDir, "v1-000500-001000-bodies.seg"))
+	require.NoFileExists(filepath.Join(otherDir, "v1-000500-001000-bodies.seg"))
+	require.NoDirExists(oldDir)
+	for i, h := range hashes {
+		tr, ok := cli.TorrentClient().Torrent(h)
+		require.True(ok)
+		if i < 2 {
+			require.Eventually(func() bool { return tr.Complete.Bool() }, 10*time.Second, 10*time.Millisecond, "moved data is verified")
+			continue
+		}
+		require.Eventually(func() bool { return tr.PieceState(0).Priority == torrent.PiecePriorityNormal }, 5*time.Second, 10*time.Millisecond, "re-added torrent is not marked for download")
+	}
+	require.True(cli.isDownloadPaused(hashes[2]))
+}
@@ -0,0 +1,185 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// DurabilityMode - when data of verified pieces is fsynced, relative to marking them complete in piece completion
+// store. Without fsync power loss can leave store claiming pieces which data never hit the disk: such pieces are
+// never re-downloaded (unless StartupVerify re-hashes them), see Cfg.Durability
+type DurabilityMode string
+
+const (
+	// DurabilityNone - OS writes data back when it wants (default, fastest)
+	DurabilityNone DurabilityMode = "none"
+	// DurabilityFile - pieces are marked complete in store once file(s) which they span are complete and fsynced:
+	// one fsync per file, but on crash verified pieces of not complete files are lost and downloaded again
+	DurabilityFile DurabilityMode = "file"
+	// DurabilityPiece - each piece is fsynced before it's marked complete: no verified data lost on crash,
+	// fsync per piece costs write throughput - notable on HDD and network disks
+	DurabilityPiece DurabilityMode = "piece"
+)
+
+// ParseDurabilityMode - empty string is DurabilityNone
+func ParseDurabilityMode(s string) (DurabilityMode, error) {
+	switch m := DurabilityMode(s); m {
+	case "", DurabilityNone:
+		return DurabilityNone, nil
+	case DurabilityFile, DurabilityPiece:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown durability mode: %q, expecting none | file | piece", s)
+	}
+}
+
+// durableTorrent - files of torrent (opened in root) with pieces they span
+type durableTorrent struct {
+	mode  DurabilityMode
+	files []durableFile
+
+	lock    sync.Mutex
+	pending map[int]storage.PieceImpl // DurabilityFile: verified pieces waiting for their files
+}
+
+type durableFile struct {
+	path       string
+	first, end int // pieces
+	remaining  int // not complete pieces, DurabilityFile only
+	synced     bool
+	empty      bool // zero length - spans no pieces
+}
+
+func newDurableTorrent(mode DurabilityMode, root string, info *metainfo.Info) *durableTorrent {
+	t := &durableTorrent{mode: mode, pending: map[int]storage.PieceImpl{}}
+	paths := filesPaths(root, info)
+	var offset int64
+	for i, f := range info.UpvertedFiles() {
+		df := durableFile{path: paths[i], empty: f.Length == 0}
+		if f.Length > 0 {
+			df.first, df.end = int(offset/info.PieceLength), int((offset+f.Length+info.PieceLength-1)/info.PieceLength)
+			df.remaining = df.end - df.first
+		}
+		offset += f.Length
+		t.files = append(t.files, df)
+	}
+	return t
+}
+
+// spans - indexes of files which have data of piece
+func (t *durableTorrent) spans(piece int) (res []int) {
+	for i, f := range t.files {
+		if !f.empty && piece >= f.first && piece < f.end {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// initRemaining - pieces already complete in store (previous runs) are durable
+func (t *durableTorrent) initRemaining(piece func(i int) storage.PieceImpl, numPieces int) {
+	for i := 0; i < numPieces; i++ {
+		if !piece(i).Completion().Complete {
+			continue
+		}
+		for _, j := range t.spans(i) {
+			t.files[j].remaining--
+		}
+	}
+	for j := range t.files {
+		t.files[j].synced = t.files[j].remaining == 0
+	}
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+type durablePiece struct {
+	storage.PieceImpl
+	t     *durableTorrent
+	index int
+}
+
+func (p durablePiece) MarkComplete() error {
+	if p.t.mode == DurabilityPiece {
+		for _, j := range p.t.spans(p.index) {
+			if err := syncFile(p.t.files[j].path); err != nil {
+				return fmt.Errorf("fsync: %w", err)
+			}
+		}
+		return p.PieceImpl.MarkComplete()
+	}
+
+	p.t.lock.Lock()
+	defer p.t.lock.Unlock()
+	if _, ok := p.t.pending[p.index]; ok || p.PieceImpl.Completion().Complete {
+		return nil
+	}
+	p.t.pending[p.index] = p.PieceImpl
+	for _, j := range p.t.spans(p.index) {
+		f := &p.t.files[j]
+		if f.remaining--; f.remaining == 0 && !f.synced {
+			if err := syncFile(f.path); err != nil {
+				return fmt.Errorf("fsync: %w", err)
+			}
+			f.synced = true
+		}
+	}
+	// commit pieces which all files are synced
+	for i, piece := range p.t.pending {
+		durable := true
+		for _, j := range p.t.spans(i) {
+			durable = durable && p.t.files[j].synced
+		}
+		if !durable {
+			continue
+		}
+		if err := piece.MarkComplete(); err != nil {
+			return err
+		}
+		delete(p.t.pending, i)
+	}
+	return nil
+}
+
+func (p durablePiece) MarkNotComplete() error {
+	if p.t.mode == DurabilityFile {
+		p.t.lock.Lock()
+		_, pending := p.t.pending[p.index]
+		wasComplete := pending || p.PieceImpl.Completion().Complete
+		delete(p.t.pending, p.index)
+		if wasComplete {
+			for _, j := range p.t.spans(p.index) {
+				p.t.files[j].remaining++
+				p.t.files[j].synced = false
+			}
+		}
+		p.t.lock.Unlock()
+		if pending {
+			return nil
+		}
+	}
+	return p.PieceImpl.MarkNotComplete()
+}
+
+func (p durablePiece) Completion() storage.Completion {
+	if p.t.mode == DurabilityFile {
+		p.t.lock.Lock()
+		_, pending := p.t.pending[p.index]
+		p.t.lock.Unlock()
+		if pending {
+			return storage.Completion{Complete: true, Ok: true}
+		}
+	}
+	return p.PieceImpl.Completion()
+}
@@ -0,0 +1,113 @@
+package downloader
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// ETAUnknown - ETA of torrent which doesn't download now (no rate yet, no peers, no metadata, paused)
+const ETAUnknown time.Duration = -1
+
+// rateSmoothing - weight of latest sample in exponential moving average of download rate
+const rateSmoothing = 0.3
+
+type torrentRate struct {
+	completed int64
+	at        time.Time
+	rate      float64 // bytes/sec, smoothed
+
+	transferred  int64     // BytesRead + BytesWritten of torrent stats
+	lastActivity time.Time // when transferred grew, see Client.LastActivity
+}
+
+// torrentRates - per-torrent download rates and last activity, sampled by MainLoop every tick
+type torrentRates struct {
+	lock  sync.Mutex
+	rates map[metainfo.Hash]*torrentRate
+}
+
+func (r *torrentRates) sample(torrents []*torrent.Torrent, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	seen := make(map[metainfo.Hash]*torrentRate, len(torrents))
+	for _, t := range torrents {
+		completed := t.BytesCompleted()
+		stats := t.Stats()
+		transferred := stats.BytesRead.Int64() + stats.BytesWritten.Int64()
+		prev, ok := r.rates[t.InfoHash()]
+		if !ok {
+			seen[t.InfoHash()] = &torrentRate{completed: completed, at: now, transferred: transferred, lastActivity: now}
+			continue
+		}
+		if transferred > prev.transferred {
+			prev.lastActivity = now
+		}
+		prev.transferred = transferred
+		if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+			instant := float64(completed-prev.completed) / elapsed
+			if instant < 0 { // failed verification
+				instant = 0
+			}
+			prev.rate = rateSmoothing*instant + (1-rateSmoothing)*prev.rate
+		}
+		prev.completed, prev.at = completed, now
+		seen[t.InfoHash()] = prev
+	}
+	r.rates = seen // forget removed torrents
+}
+
+func (r *torrentRates) rate(hash metainfo.Hash) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if tr, ok := r.rates[hash]; ok {
+		return tr.rate
+	}
+	return 0
+}
+
+func eta(left int64, rate float64) time.Duration {
+	if left <= 0 {
+		return 0
+	}
+	if rate < 1 {
+		return ETAUnknown
+	}
+	secs := float64(left) / rate
+	if secs > float64(math.MaxInt64/int64(time.Second)) { // decayed rate of stalled torrent: overflows time.Duration
+		return ETAUnknown
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// ETAs - overall ETA (of latest Stats) and ETA of each torrent by its own smoothed download rate: one slow torrent
+// dominates overall ETA, while others may be almost done. 0 - complete, ETAUnknown - not downloading now.
+func (cli *Client) ETAs() (overall time.Duration, per map[metainfo.Hash]time.Duration) {
+	stats := cli.Stats()
+	overall = eta(stats.bytesLeft, float64(stats.readBytesPerSec))
+	torrents := cli.TorrentClient().Torrents()
+	per = make(map[metainfo.Hash]time.Duration, len(torrents))
+	for _, t := range torrents {
+		if t.Info() == nil {
+			per[t.InfoHash()] = ETAUnknown
+			continue
+		}
+		per[t.InfoHash()] = eta(t.BytesMissing(), cli.rates.rate(t.InfoHash()))
+	}
+	return overall, per
+}
+
+// LastActivity - when each torrent last downloaded or uploaded any bytes, with MainLoop tick precision.
+// Torrent which didn't transfer anything yet - when MainLoop first saw it (added or downloader started).
+func (cli *Client) LastActivity() map[metainfo.Hash]time.Time {
+	cli.rates.lock.Lock()
+	defer cli.rates.lock.Unlock()
+	res := make(map[metainfo.Hash]time.Time, len(cli.rates.rates))
+	for hash, r := range cli.rates.rates {
+		res[hash] = r.lastActivity
+	}
+	return res
+}
@@ -0,0 +1,238 @@
+package downloader
+
+import (
+	"net"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// eventsBuffer - events queued for consumer of Events, oldest are dropped beyond it
+const eventsBuffer = 1024
+
+// Event - lifecycle event of downloader, see Events. Sealed: variants are TorrentAdded, MetadataResolved,
+// PieceCompleted, TorrentCompleted, VerifyFailed, StorageError and PeerBanned - consumers type-switch on them.
+type Event interface {
+	event()
+}
+
+// TorrentAdded - torrent seen by MainLoop first time: added by any of Add* methods or present on start
+type TorrentAdded struct{ InfoHash metainfo.Hash }
+
+// MetadataResolved - MainLoop seen torrent's metadata first time (got from peers or known when added)
+type MetadataResolved struct {
+	InfoHash metainfo.Hash
+	Name     string
+}
+
+// PieceCompleted - like Cfg.OnPieceComplete
+type PieceCompleted struct {
+	InfoHash metainfo.Hash
+	Index    int
+}
+
+// TorrentCompleted - all files which are not excluded are downloaded, once per torrent
+type TorrentCompleted struct{ InfoHash metainfo.Hash }
+
+// VerifyFailed - RequestReverify found Pieces bad pieces (they are downloaded again), or verification against
+// Cfg.Manifest failed (zero InfoHash, Err is set)
+type VerifyFailed struct {
+	InfoHash metainfo.Hash
+	Pieces   int
+	Err      error
+}
+
+// StorageError - like Cfg.OnStorageError
+type StorageError struct {
+	InfoHash metainfo.Hash
+	Err      error
+}
+
+// PeerBanned - torrent lib banned peer's IP (sent bad data)
+type PeerBanned struct{ IP net.IP }
+
+func (TorrentAdded) event()     {}
+func (MetadataResolved) event() {}
+func (PieceCompleted) event()   {}
+func (TorrentCompleted) event() {}
+func (VerifyFailed) event()     {}
+func (StorageError) event()     {}
+func (PeerBanned) event()       {}
+
+// eventStream - never blocks publisher: if consumer is behind by eventsBuffer events, oldest event is dropped
+// (amount is logged). Survives watchdog's restart of torrent client, closed by Client.Close.
+type eventStream struct {
+	ch chan Event
+
+	lock    sync.Mutex
+	closed  bool
+	dropped int
+	queued  map[metainfo.Hash][]Event // see queue
+	nQueued int
+}
+
+func newEventStream(size int) *eventStream {
+	return &eventStream{ch: make(chan Event, size), queued: map[metainfo.Hash][]Event{}}
+}
+
+// publish - nil-safe, like all methods
+func (s *eventStream) publish(ev Event) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.publishLocked(ev)
+}
+
+func (s *eventStream) publishLocked(ev Event) {
+	if s.closed {
+		return
+	}
+	for {
+		select {
+		case s.ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+			s.drop()
+		default: // consumer took one meanwhile
+		}
+	}
+}
+
+func (s *eventStream) drop() {
+	s.dropped++
+	if s.dropped&(s.dropped-1) == 0 { // powers of 2 - not on every event of flood
+		log.Warn("[torrent] Events consumer is slow, dropped oldest events", "dropped", s.dropped)
+	}
+}
+
+// queue - for events which happen outside of MainLoop (library callbacks, own goroutines): MainLoop publishes
+// them by flush, so they are ordered with events it publishes itself. Zero hash - not of any torrent.
+func (s *eventStream) queue(hash metainfo.Hash, ev Event) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	if s.nQueued >= cap(s.ch) { // MainLoop is stuck or not running: drop oldest of same torrent, or this one
+		s.drop()
+		if len(s.queued[hash]) == 0 {
+			return
+		}
+		s.queued[hash] = s.queued[hash][1:]
+		s.nQueued--
+	}
+	s.queued[hash] = append(s.queued[hash], ev)
+	s.nQueued++
+}
+
+// flush - publishes queued events of torrent in order they happened, called by MainLoop for every torrent after
+// its TorrentAdded and MetadataResolved and before its TorrentCompleted
+func (s *eventStream) flush(hash metainfo.Hash) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushLocked(hash)
+}
+
+func (s *eventStream) flushLocked(hash metainfo.Hash) {
+	for _, ev := range s.queued[hash] {
+		s.publishLocked(ev)
+	}
+	s.nQueued -= len(s.queued[hash])
+	delete(s.queued, hash)
+}
+
+// flushAll - called by MainLoop at end of tick: events not of torrent, and of torrents which it didn't see
+// (dropped or unhealthy)
+func (s *eventStream) flushAll() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for hash := range s.queued {
+		s.flushLocked(hash)
+	}
+}
+
+func (s *eventStream) close() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		for hash := range s.queued {
+			s.flushLocked(hash)
+		}
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// Events - single stream of lifecycle events, alternative to callbacks of Cfg. MainLoop is the single publisher,
+// events are published once per tick (events of library callbacks and background work are queued until then).
+// Events of same torrent are ordered: TorrentAdded, MetadataResolved, then PieceCompleted, StorageError and
+// VerifyFailed in order they happened, TorrentCompleted after pieces completed before it. Without MainLoop only
+// Close publishes queued events. Buffered, drops oldest events if consumer is slow. Closed by Close.
+func (cli *Client) Events() <-chan Event {
+	return cli.events.ch
+}
+
+// eventsTracker - state of MainLoop for events it publishes by comparing torrents between ticks
+type eventsTracker struct {
+	added, resolved map[metainfo.Hash]struct{}
+	banned          map[string]struct{}
+}
+
+func newEventsTracker() *eventsTracker {
+	return &eventsTracker{added: map[metainfo.Hash]struct{}{}, resolved: map[metainfo.Hash]struct{}{}, banned: map[string]struct{}{}}
+}
+
+// torrent - called by MainLoop every tick for every torrent
+func (e *eventsTracker) torrent(events *eventStream, t *torrent.Torrent) {
+	hash := t.InfoHash()
+	if _, ok := e.added[hash]; !ok {
+		e.added[hash] = struct{}{}
+		events.publish(TorrentAdded{InfoHash: hash})
+	}
+	if _, ok := e.resolved[hash]; ok || t.Info() == nil {
+		return
+	}
+	e.resolved[hash] = struct{}{}
+	events.publish(MetadataResolved{InfoHash: hash, Name: t.Name()})
+}
+
+// prune - forgets dropped torrents (they are TorrentAdded again if re-added) and unbanned IPs
+func (e *eventsTracker) prune(events *eventStream, torrents []*torrent.Torrent, bannedIPs []string) {
+	alive := make(map[metainfo.Hash]struct{}, len(torrents))
+	for _, t := range torrents {
+		alive[t.InfoHash()] = struct{}{}
+	}
+	for hash := range e.added {
+		if _, ok := alive[hash]; !ok {
+			delete(e.added, hash)
+			delete(e.resolved, hash)
+		}
+	}
+	banned := make(map[string]struct{}, len(bannedIPs))
+	for _, ip := range bannedIPs {
+		banned[ip] = struct{}{}
+		if _, ok := e.banned[ip]; !ok {
+			events.publish(PeerBanned{IP: net.ParseIP(ip)})
+		}
+	}
+	e.banned = banned
+}
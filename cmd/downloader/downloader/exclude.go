@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// ExcludeFiles - files of torrent which path (inside torrent, see torrent.File.DisplayPath) matches any of glob
+// patterns (path.Match syntax) are never downloaded: their pieces get priority None. Pieces shared with
+// not excluded files are still downloaded. Excluded files don't count in torrent's completeness (MainLoop,
+// Stats). Applied immediately if metadata is known, otherwise by MainLoop once it resolved.
+// Replaces previous patterns of torrent, nil - download all files again (on next DownloadAll).
+func (cli *Client) ExcludeFiles(hash metainfo.Hash, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+	cli.lock.Lock()
+	if len(patterns) == 0 {
+		delete(cli.excluded, hash)
+	} else {
+		cli.excluded[hash] = patterns
+	}
+	cli.lock.Unlock()
+	if t, ok := cli.TorrentClient().Torrent(hash); ok && t.Info() != nil {
+		cli.applyExcluded(t)
+	}
+	return nil
+}
+
+func (cli *Client) excludedPatterns(hash metainfo.Hash) []string {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	return cli.excluded[hash]
+}
+
+func isExcluded(f *torrent.File, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, f.DisplayPath()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyExcluded - torrent must have metadata. Called by MainLoop every tick: DownloadAll raises priority
+// of all pieces - it's lowered back.
+func (cli *Client) applyExcluded(t *torrent.Torrent) {
+	patterns := cli.excludedPatterns(t.InfoHash())
+	if len(patterns) == 0 {
+		return
+	}
+	pieceLength := t.Info().PieceLength
+	for _, f := range t.Files() {
+		if !isExcluded(f, patterns) {
+			// piece's effective priority is max of its own and of its files - keeps shared pieces
+			if f.Priority() != torrent.PiecePriorityNormal {
+				f.SetPriority(torrent.PiecePriorityNormal)
+			}
+			continue
+		}
+		if f.Priority() != torrent.PiecePriorityNone {
+			f.SetPriority(torrent.PiecePriorityNone)
+		}
+		if f.Length() == 0 {
+			continue
+		}
+		first, end := int(f.Offset()/pieceLength), int((f.Offset()+f.Length()+pieceLength-1)/pieceLength)
+		for i := first; i < end; i++ {
+			if st := t.PieceState(i); !st.Complete && st.Priority != torrent.PiecePriorityNone {
+				t.Piece(i).SetPriority(torrent.PiecePriorityNone)
+			}
+		}
+	}
+}
+
+// torrentComplete - all files which are not excluded are complete
+func (cli *Client) torrentComplete(t *torrent.Torrent) bool {
+	if t.Complete.Bool() {
+		return true
+	}
+	patterns := cli.excludedPatterns(t.InfoHash())
+	if len(patterns) == 0 || t.Info() == nil {
+		return false
+	}
+	for _, f := range t.Files() {
+		if !isExcluded(f, patterns) && f.BytesCompleted() != f.Length() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Downloader - part of Client which embedders use. Allows to test their code with Fake instead of real torrents.
+type Downloader interface {
+	Stats() AggStats
+	List() []metainfo.Hash
+	AddMagnet(magnetURI string) (metainfo.Hash, error)
+	// Completed - closed when all torrents are downloaded first time
+	Completed() <-chan struct{}
+	Close()
+}
+
+var _ Downloader = (*Client)(nil)
+
+// List - infohashes of all torrents
+func (cli *Client) List() []metainfo.Hash {
+	torrents := cli.TorrentClient().Torrents()
+	res := make([]metainfo.Hash, 0, len(torrents))
+	for _, t := range torrents {
+		res = append(res, t.InfoHash())
+	}
+	return res
+}
+
+// AddMagnet - adds torrent, it's downloaded once metadata resolved. Already added torrent is not an error.
+// Hides torrent.Client.AddMagnet: use cli.TorrentClient().AddMagnet to get *torrent.Torrent
+func (cli *Client) AddMagnet(magnetURI string) (metainfo.Hash, error) {
+	t, err := cli.TorrentClient().AddMagnet(magnetURI)
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	return t.InfoHash(), nil
+}
+
+// Fake - in-memory Downloader for embedders' tests: nothing is downloaded, test drives state by
+// SetStats and Complete
+type Fake struct {
+	lock      sync.Mutex
+	torrents  []metainfo.Hash
+	stats     AggStats
+	completed chan struct{}
+	once      sync.Once
+	closed    bool
+}
+
+var _ Downloader = (*Fake)(nil)
+
+func NewFake() *Fake {
+	return &Fake{completed: make(chan struct{})}
+}
+
+func (f *Fake) Stats() AggStats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.stats
+}
+
+func (f *Fake) SetStats(stats AggStats) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stats = stats
+}
+
+func (f *Fake) List() []metainfo.Hash {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]metainfo.Hash{}, f.torrents...)
+}
+
+// AddMagnet - validates magnet like Client does
+func (f *Fake) AddMagnet(magnetURI string) (metainfo.Hash, error) {
+	m, err := metainfo.ParseMagnetUri(magnetURI)
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, h := range f.torrents {
+		if h == m.InfoHash {
+			return h, nil
+		}
+	}
+	f.torrents = append(f.torrents, m.InfoHash)
+	return m.InfoHash, nil
+}
+
+func (f *Fake) Completed() <-chan struct{} { return f.completed }
+
+// Complete - simulates download of all torrents
+func (f *Fake) Complete() {
+	f.once.Do(func() { close(f.completed) })
+}
+
+func (f *Fake) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
+
+// Closed - whether Close was called
+func (f *Fake) Closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package downloader
+
+import "syscall"
+
+// mmapUnfriendlyFilesystems - statfs f_type magic numbers (linux/magic.h)
+var mmapUnfriendlyFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517B:     "smb",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+}
+
+// mmapUnfriendlyFS - name of filesystem of dir if mmap is known to be problematic there, empty otherwise
+func mmapUnfriendlyFS(dir string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", err
+	}
+	return mmapUnfriendlyFilesystems[uint32(st.Type)], nil
+}
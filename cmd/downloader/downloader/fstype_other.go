@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package downloader
+
+// mmapUnfriendlyFS - filesystem detection is implemented only for linux
+func mmapUnfriendlyFS(dir string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,40 @@
+package downloader
+
+import "time"
+
+// logThrottleInterval - repeated identical message is logged at most that often
+const logThrottleInterval = time.Minute
+
+// logThrottle - de-duplicates periodic log lines (MainLoop logs every tick): message is logged when its value
+// changes, identical repeats are collapsed into one summary per interval. Not thread-safe.
+type logThrottle struct {
+	interval time.Duration
+	entries  map[string]*throttledLog
+}
+
+type throttledLog struct {
+	value               string
+	changedAt, loggedAt time.Time
+	repeats             int // suppressed since loggedAt
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{interval: interval, entries: map[string]*throttledLog{}}
+}
+
+// check - whether message of key with value must be logged now. repeats > 0 - it's summary: value didn't change
+// for `unchanged`, and that many identical messages were suppressed since previous one.
+func (lt *logThrottle) check(key, value string, now time.Time) (ok bool, repeats int, unchanged time.Duration) {
+	e, found := lt.entries[key]
+	if !found || e.value != value {
+		lt.entries[key] = &throttledLog{value: value, changedAt: now, loggedAt: now}
+		return true, 0, 0
+	}
+	e.repeats++
+	if now.Sub(e.loggedAt) < lt.interval {
+		return false, 0, 0
+	}
+	repeats = e.repeats
+	e.repeats, e.loggedAt = 0, now
+	return true, repeats, now.Sub(e.changedAt)
+}
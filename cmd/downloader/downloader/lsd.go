@@ -0,0 +1,265 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Local Service Discovery (BEP 14): torrent lib doesn't implement it. Peers of same LAN find each other by
+// multicast announces - in clusters of Erigon nodes snapshots are transferred mostly inside datacenter,
+// saves WAN bandwidth. Works alongside trackers and DHT.
+const (
+	lsdGroup         = "239.192.152.143:6771"
+	lsdAnnounceEvery = 5 * time.Minute
+	lsdMaxHashes     = 20 // per message, to fit into 1 UDP packet
+
+	PeerSourceLsd torrent.PeerSource = "L"
+)
+
+type lsdMessage struct {
+	port       int
+	infoHashes []metainfo.Hash
+	cookie     string
+}
+
+func (m lsdMessage) encode() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", lsdGroup, m.port)
+	for _, h := range m.infoHashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", h.HexString())
+	}
+	if m.cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", m.cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func parseLsdMessage(data []byte) (m lsdMessage, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return m, fmt.Errorf("not a BT-SEARCH message")
+	}
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "port":
+			if m.port, err = strconv.Atoi(v); err != nil || m.port <= 0 || m.port > 65535 {
+				return m, fmt.Errorf("invalid port: %q", v)
+			}
+		case "infohash":
+			var h metainfo.Hash
+			if err := h.FromHexString(v); err != nil {
+				return m, fmt.Errorf("invalid infohash %q: %w", v, err)
+			}
+			m.infoHashes = append(m.infoHashes, h)
+		case "cookie":
+			m.cookie = v
+		}
+	}
+	if m.port == 0 || len(m.infoHashes) == 0 {
+		return m, fmt.Errorf("port or infohash missing")
+	}
+	return m, nil
+}
+
+// runLSD - announces torrents to LAN and adds LAN peers, until ctx done
+func (cli *Client) runLSD(ctx context.Context) error {
+	group, err := net.ResolveUDPAddr("udp4", lsdGroup)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("lsd: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	cookieBytes := make([]byte, 8)
+	if _, err := rand.Read(cookieBytes); err != nil {
+		return err
+	}
+	cookie := hex.EncodeToString(cookieBytes) // to ignore own announces
+
+	go func() {
+		announce := time.NewTicker(lsdAnnounceEvery)
+		defer announce.Stop()
+		for {
+			cli.lsdAnnounce(conn, group, cookie)
+			select {
+			case <-ctx.Done():
+				return
+			case <-announce.C:
+			}
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("lsd: %w", err)
+		}
+		m, err := parseLsdMessage(buf[:n])
+		if err != nil || m.cookie == cookie {
+			continue
+		}
+		peer := torrent.PeerInfo{Addr: &net.TCPAddr{IP: from.IP, Port: m.port}, Source: PeerSourceLsd, Trusted: cli.lan != nil}
+		for _, h := range m.infoHashes {
+			if t, ok := cli.TorrentClient().Torrent(h); ok {
+				t.AddPeers([]torrent.PeerInfo{peer})
+			}
+		}
+	}
+}
+
+func (cli *Client) lsdAnnounce(conn *net.UDPConn, group *net.UDPAddr, cookie string) {
+	torrents := cli.healthyTorrents()
+	for i := 0; i < len(torrents); i += lsdMaxHashes {
+		m := lsdMessage{port: cli.TorrentClient().LocalPort(), cookie: cookie}
+		for _, t := range torrents[i:minInt(i+lsdMaxHashes, len(torrents))] {
+			m.infoHashes = append(m.infoHashes, t.InfoHash())
+		}
+		if _, err := conn.WriteToUDP(m.encode(), group); err != nil {
+			log.Debug("[torrent] LSD announce", "err", err)
+			return
+		}
+	}
+}
+
+// lanNets - RFC 1918 and RFC 4193 (IPv6 unique local) networks
+var lanNets = func() (nets []*net.IPNet) {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isLANIP(ip net.IP) bool {
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lanMaxPeers - per torrent, LAN of one cluster is not big
+const lanMaxPeers = 64
+
+// lanPeers - LAN peers which torrents were connected to, see Cfg.PreferLANPeers
+type lanPeers struct {
+	lock  sync.Mutex
+	peers map[metainfo.Hash]map[string]torrent.PeerInfo
+}
+
+func newLanPeers() *lanPeers {
+	return &lanPeers{peers: map[metainfo.Hash]map[string]torrent.PeerInfo{}}
+}
+
+func (l *lanPeers) remember(hash metainfo.Hash, conns []*torrent.PeerConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, c := range conns {
+		// port of incoming conn is not listen port, and PeerListenPort is written by lib without lock
+		if c.Discovery == torrent.PeerSourceIncoming {
+			continue
+		}
+		addr, ok := c.RemoteAddr.(*net.TCPAddr)
+		if !ok || !isLANIP(addr.IP) {
+			continue
+		}
+		known, ok := l.peers[hash]
+		if !ok {
+			known = map[string]torrent.PeerInfo{}
+			l.peers[hash] = known
+		}
+		if len(known) < lanMaxPeers {
+			known[addr.String()] = torrent.PeerInfo{Addr: addr, Source: c.Discovery, Trusted: true}
+		}
+	}
+}
+
+func (l *lanPeers) of(hash metainfo.Hash) []torrent.PeerInfo {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	res := make([]torrent.PeerInfo, 0, len(l.peers[hash]))
+	for _, p := range l.peers[hash] {
+		res = append(res, p)
+	}
+	return res
+}
+
+// prune - forgets dropped torrents
+func (l *lanPeers) prune(torrents []*torrent.Torrent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	alive := make(map[metainfo.Hash]struct{}, len(torrents))
+	for _, t := range torrents {
+		alive[t.InfoHash()] = struct{}{}
+	}
+	for h := range l.peers {
+		if _, ok := alive[h]; !ok {
+			delete(l.peers, h)
+		}
+	}
+}
+
+// preferLANPeers - torrent lib dials its known peers trusted first, then by BEP 40 priority. LAN peers which
+// torrent was connected to are re-added as trusted (like Cfg.StaticPeers), so after disconnect they are dialed
+// before internet peers. Called by MainLoop every minute if Cfg.PreferLANPeers.
+// Not covered: LAN peers from trackers/DHT/PEX which were never connected - lib gives no safe access to its
+// queue of known peers, they wait in BEP 40 order.
+func (cli *Client) preferLANPeers(torrents []*torrent.Torrent) {
+	for _, t := range torrents {
+		conns := t.PeerConns()
+		cli.lan.remember(t.InfoHash(), conns)
+		connected := make(map[string]struct{}, len(conns))
+		for _, c := range conns {
+			connected[c.RemoteAddr.String()] = struct{}{}
+		}
+		var redial []torrent.PeerInfo
+		for _, p := range cli.lan.of(t.InfoHash()) {
+			if _, ok := connected[p.Addr.String()]; !ok {
+				redial = append(redial, p)
+			}
+		}
+		if len(redial) > 0 {
+			t.AddPeers(redial)
+		}
+	}
+	cli.lan.prune(torrents)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
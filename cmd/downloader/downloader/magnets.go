@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// DefaultMagnetSourceTimeout - how long ResolveAbsentTorrents waits for metadata from one magnet source
+// before trying next one, see AddOptions.Magnets
+const DefaultMagnetSourceTimeout = time.Minute
+
+// parseMagnets - magnets must be of given infohash
+func parseMagnets(infoHash metainfo.Hash, uris []string) ([]metainfo.Magnet, error) {
+	res := make([]metainfo.Magnet, 0, len(uris))
+	for _, uri := range uris {
+		m, err := metainfo.ParseMagnetUri(uri)
+		if err != nil {
+			return nil, fmt.Errorf("magnet %q: %w", uri, err)
+		}
+		if m.InfoHash != infoHash {
+			return nil, fmt.Errorf("magnet %q is not of %s", uri, infoHash)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// addMagnetSource - gives torrent trackers and peer hints ("x.pe") of magnet
+func addMagnetSource(t *torrent.Torrent, m metainfo.Magnet) {
+	if len(m.Trackers) > 0 {
+		t.AddTrackers([][]string{m.Trackers})
+	}
+	var peers []torrent.PeerInfo
+	for _, pe := range m.Params["x.pe"] {
+		addr, err := net.ResolveTCPAddr("tcp", pe)
+		if err != nil {
+			log.Debug("[torrent] Skipping magnet peer hint", "peer", pe, "err", err)
+			continue
+		}
+		peers = append(peers, torrent.PeerInfo{Addr: addr})
+	}
+	t.AddPeers(peers)
+}
+
+// rotateMagnetSources - sources are given to torrent one by one, next one - if metadata is not resolved
+// during timeout. Torrent lib can't remove trackers: sources accumulate, the one added last before
+// resolution is reported as succeeded.
+func rotateMagnetSources(ctx context.Context, t *torrent.Torrent, sources []metainfo.Magnet, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultMagnetSourceTimeout
+	}
+	for i, m := range sources {
+		addMagnetSource(t, m)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.GotInfo():
+			log.Info("[torrent] Metadata resolved", "torrent", t.Name(), "source", m.String(), "sources tried", i+1)
+			return
+		case <-time.After(timeout):
+			if i+1 < len(sources) {
+				log.Debug("[torrent] Metadata not resolved, trying next magnet source", "hash", t.InfoHash(), "tried", i+1)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+var ErrNameMismatch = errors.New("torrent name doesn't match expected name of its infohash")
+
+// namesByHash - inverts list of erigon-snapshots format (file name -> hex infohash). One infohash
+// can't have two names.
+func namesByHash(list map[string]string) (map[metainfo.Hash]string, error) {
+	res := make(map[metainfo.Hash]string, len(list))
+	for name, hexHash := range list {
+		var h metainfo.Hash
+		if err := h.FromHexString(hexHash); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if other, ok := res[h]; ok {
+			return nil, fmt.Errorf("%s has two names: %s, %s", h, other, name)
+		}
+		res[h] = name
+	}
+	return res, nil
+}
+
+// checkName - nil if infohash has no expected name
+func checkName(expected map[metainfo.Hash]string, infoHash metainfo.Hash, name string) error {
+	want, ok := expected[infoHash]
+	if !ok || want == name {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is %q, expected %q", ErrNameMismatch, infoHash, name, want)
+}
+
+// NameForHash - expected name of torrent, see Cfg.ExpectedNames
+func (cli *Client) NameForHash(h metainfo.Hash) (string, bool) {
+	name, ok := cli.names[h]
+	return name, ok
+}
@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pelletier/go-toml/v2"
+)
+
+var ErrHashesNotInOracle = errors.New("infohashes are not in authoritative list")
+
+const (
+	oracleTimeout      = 30 * time.Second
+	oracleMaxListBytes = 16 * 1024 * 1024
+)
+
+var oracleClient = &http.Client{Timeout: oracleTimeout}
+
+// VerifyHashesAgainstOracle - every hash must be in authoritative list served by oracleURL: defends against
+// compromised local preverified list. List has format of erigon-snapshots: toml "file name" = "hex infohash".
+// Transport security (https, signature of endpoint) is up to oracle.
+func VerifyHashesAgainstOracle(ctx context.Context, hashes []metainfo.Hash, oracleURL string) error {
+	authoritative, err := fetchOracleHashes(ctx, oracleURL)
+	if err != nil {
+		return fmt.Errorf("hash oracle %s: %w", oracleURL, err)
+	}
+	var missing []string
+	for _, h := range hashes {
+		if _, ok := authoritative[h]; !ok {
+			missing = append(missing, h.HexString())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w %s: %s", ErrHashesNotInOracle, oracleURL, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func fetchOracleHashes(ctx context.Context, oracleURL string) (map[metainfo.Hash]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oracleURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := oracleClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oracleMaxListBytes))
+	if err != nil {
+		return nil, err
+	}
+	return parseOracleHashes(body)
+}
+
+// parseOracleHashes - hash -> file name
+func parseOracleHashes(body []byte) (map[metainfo.Hash]string, error) {
+	var list map[string]string
+	if err := toml.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return namesByHash(list)
+}
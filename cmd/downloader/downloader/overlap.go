@@ -0,0 +1,68 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// ErrOverlappingPaths - files of different torrents alias each other: they would corrupt each other's data
+var ErrOverlappingPaths = errors.New("torrents have overlapping file paths")
+
+type pathOwner struct {
+	hash metainfo.Hash
+	name string
+	dir  bool // path is parent dir of owner's file
+}
+
+// torrentInfo - metadata of torrent which is added, or about to be added
+type torrentInfo struct {
+	hash metainfo.Hash
+	info *metainfo.Info
+}
+
+// torrentInfos - of torrents which have metadata
+func torrentInfos(torrents []*torrent.Torrent) []torrentInfo {
+	res := make([]torrentInfo, 0, len(torrents))
+	for _, t := range torrents {
+		if info := t.Info(); info != nil {
+			res = append(res, torrentInfo{hash: t.InfoHash(), info: info})
+		}
+	}
+	return res
+}
+
+// checkOverlappingPaths - same file in two torrents, or file of one torrent is a dir of other. Paths are relative
+// to data dir: torrents placed to different dirs by DirSelector are reported too.
+func checkOverlappingPaths(torrents []torrentInfo) error {
+	owners := map[string]pathOwner{}
+	var conflicts []string
+	for _, t := range torrents {
+		info := t.info
+		for _, path := range filesPaths("", info) {
+			path = filepath.Clean(path)
+			if o, ok := owners[path]; ok && o.hash != t.hash {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s and %s", path, o.name, info.Name))
+			} else if !ok {
+				owners[path] = pathOwner{hash: t.hash, name: info.Name}
+			}
+			for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+				if o, ok := owners[dir]; ok && !o.dir && o.hash != t.hash {
+					conflicts = append(conflicts, fmt.Sprintf("%s: file of %s, dir of %s", dir, o.name, info.Name))
+				} else if !ok {
+					owners[dir] = pathOwner{hash: t.hash, name: info.Name, dir: true}
+				}
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sort.Strings(conflicts)
+	return fmt.Errorf("%w: %s", ErrOverlappingPaths, strings.Join(conflicts, "; "))
+}
@@ -0,0 +1,184 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// peerTraffic - per-peer data bytes. torrent library doesn't expose per-peer stats, so it's collected
+// from messages peers send: Piece - data we got, Request minus Cancel - data peer asked us (upper bound of
+// uploaded bytes: rejected, choked and rate limited requests are counted too)
+type peerTraffic struct {
+	lock sync.Mutex
+	live map[*torrent.PeerConn]*peerBytes
+	// totals of closed connections
+	freeloaderBytes int64
+	reciprocalBytes int64
+}
+
+type peerBytes struct {
+	read, requested int64
+	lastActive      time.Time // last data message, or when connection was first seen
+}
+
+func newPeerTraffic() *peerTraffic {
+	return &peerTraffic{live: map[*torrent.PeerConn]*peerBytes{}}
+}
+
+// install - adds callbacks to config, existing callbacks are kept
+func (p *peerTraffic) install(cfg *torrent.ClientConfig) {
+	prevRead, prevClosed := cfg.Callbacks.ReadMessage, cfg.Callbacks.PeerConnClosed
+	cfg.Callbacks.ReadMessage = func(pc *torrent.PeerConn, msg *pp.Message) {
+		p.onReadMessage(pc, msg)
+		if prevRead != nil {
+			prevRead(pc, msg)
+		}
+	}
+	cfg.Callbacks.PeerConnClosed = func(pc *torrent.PeerConn) {
+		p.onClosed(pc)
+		if prevClosed != nil {
+			prevClosed(pc)
+		}
+	}
+}
+
+// onReadMessage - called under torrent client lock, must be fast
+func (p *peerTraffic) onReadMessage(pc *torrent.PeerConn, msg *pp.Message) {
+	if msg.Keepalive {
+		return
+	}
+	switch msg.Type {
+	case pp.Piece, pp.Request, pp.Cancel:
+	default:
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b, ok := p.live[pc]
+	if !ok {
+		b = &peerBytes{}
+		p.live[pc] = b
+	}
+	b.lastActive = time.Now()
+	switch msg.Type {
+	case pp.Piece:
+		b.read += int64(len(msg.Piece))
+	case pp.Request:
+		b.requested += int64(msg.Length)
+	case pp.Cancel:
+		b.requested -= int64(msg.Length)
+	}
+}
+
+func (p *peerTraffic) onClosed(pc *torrent.PeerConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b, ok := p.live[pc]
+	if !ok {
+		return
+	}
+	delete(p.live, pc)
+	if b.read == 0 {
+		p.freeloaderBytes += b.requested
+	} else {
+		p.reciprocalBytes += b.requested
+	}
+}
+
+// split - bytes requested by peers which never sent us any data (freeloaders) and by reciprocal peers
+func (p *peerTraffic) split() (freeloader, reciprocal int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	freeloader, reciprocal = p.freeloaderBytes, p.reciprocalBytes
+	for _, b := range p.live {
+		if b.read == 0 {
+			freeloader += b.requested
+		} else {
+			reciprocal += b.requested
+		}
+	}
+	return freeloader, reciprocal
+}
+
+func resolvePeers(addrs []string) ([]torrent.PeerInfo, error) {
+	res := make([]torrent.PeerInfo, 0, len(addrs))
+	for _, a := range addrs {
+		addr, err := net.ResolveTCPAddr("tcp", a)
+		if err != nil {
+			return nil, fmt.Errorf("static peer %q: %w", a, err)
+		}
+		res = append(res, torrent.PeerInfo{Addr: addr, Trusted: true})
+	}
+	return res, nil
+}
+
+// addStaticPeers - gives Cfg.StaticPeers to all torrents. Called periodically: torrent lib forgets peers
+// which connections were closed
+func (cli *Client) addStaticPeers() {
+	if len(cli.staticPeers) == 0 {
+		return
+	}
+	for _, t := range cli.healthyTorrents() {
+		t.AddPeers(cli.staticPeers)
+	}
+}
+
+// countIdle - connections which didn't send data messages during timeout
+func (p *peerTraffic) countIdle(conns []*torrent.PeerConn, timeout time.Duration) (idle int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for _, pc := range conns {
+		b, ok := p.live[pc]
+		if !ok {
+			p.live[pc] = &peerBytes{lastActive: now}
+			continue
+		}
+		if now.Sub(b.lastActive) > timeout {
+			idle++
+		}
+	}
+	return idle
+}
+
+// dropIdlePeers - closes connections which didn't exchange data during Cfg.PeerIdleTimeout. Torrent lib can't
+// close given connection: max conns is lowered for a moment and lib drops worst ones - which helped least recently.
+func (cli *Client) dropIdlePeers() {
+	for _, t := range cli.healthyTorrents() {
+		conns := t.PeerConns()
+		idle := cli.traffic.countIdle(conns, cli.cfg.PeerIdleTimeout)
+		if idle == 0 {
+			continue
+		}
+		log.Debug("[torrent] Dropping idle peers", "torrent", t.Name(), "idle", idle, "conns", len(conns))
+		t.SetMaxEstablishedConns(t.SetMaxEstablishedConns(len(conns) - idle))
+	}
+}
+
+// installMaxRequests - caps outstanding piece requests to each peer (Cfg.MaxRequestsPerPeer): peer's limit
+// is torrent lib's default (250) until peer tells own one in extended handshake - both are replaced by max,
+// but peer's own limit is never exceeded. Existing callbacks are kept.
+func installMaxRequests(cfg *torrent.ClientConfig, max int) {
+	if max <= 0 {
+		return
+	}
+	cfg.Callbacks.NewPeer = append(cfg.Callbacks.NewPeer, func(p *torrent.Peer) {
+		p.PeerMaxRequests = max
+	})
+	prev := cfg.Callbacks.ReadExtendedHandshake
+	cfg.Callbacks.ReadExtendedHandshake = func(pc *torrent.PeerConn, msg *pp.ExtendedHandshakeMessage) {
+		// called before lib applies msg.Reqq
+		if msg.Reqq == 0 || msg.Reqq > max {
+			msg.Reqq = max
+		}
+		if prev != nil {
+			prev(pc, msg)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// pieceEventsBuffer - completed pieces queued for Cfg.OnPieceComplete and Events, events beyond it are dropped
+const pieceEventsBuffer = 1024
+
+type pieceEvent struct {
+	hash  metainfo.Hash
+	index int
+}
+
+// pieceEvents - delivers completed pieces to Cfg.OnPieceComplete from own goroutine: slow consumer never blocks
+// storage (and download). Events are dropped while buffer is full, amount is logged once consumer catches up.
+// PieceCompleted is queued to Events right away: before torrent lib sees piece complete, so before TorrentCompleted.
+type pieceEvents struct {
+	ch     chan pieceEvent
+	events *eventStream
+
+	lock    sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// newPieceEvents - consumer is nil if there is no Cfg.OnPieceComplete
+func newPieceEvents(events *eventStream, consumer func(hash metainfo.Hash, pieceIndex int)) *pieceEvents {
+	e := &pieceEvents{ch: make(chan pieceEvent, pieceEventsBuffer), events: events}
+	if consumer == nil {
+		e.ch = nil
+		return e
+	}
+	go func() {
+		for ev := range e.ch {
+			consumer(ev.hash, ev.index)
+			e.lock.Lock()
+			dropped := e.dropped
+			e.dropped = 0
+			e.lock.Unlock()
+			if dropped > 0 {
+				log.Warn("[torrent] OnPieceComplete is slow, dropped events", "dropped", dropped)
+			}
+		}
+	}()
+	return e
+}
+
+func (e *pieceEvents) notify(hash metainfo.Hash, index int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return
+	}
+	e.events.queue(hash, PieceCompleted{InfoHash: hash, Index: index})
+	if e.ch == nil {
+		return
+	}
+	select {
+	case e.ch <- pieceEvent{hash: hash, index: index}:
+	default:
+		e.dropped++
+	}
+}
+
+// close - queued events are still delivered, nil-safe
+func (e *pieceEvents) close() {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.closed {
+		e.closed = true
+		if e.ch != nil {
+			close(e.ch)
+		}
+	}
+}
+
+// notifyingStorage - custom ClientConfig.DefaultStorage, own storage notifies by routedStorage
+type notifyingStorage struct {
+	storage.ClientImpl
+	events *pieceEvents
+}
+
+func (s notifyingStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.ClientImpl.OpenTorrent(info, infoHash)
+	if err != nil || t.Piece == nil {
+		return t, err
+	}
+	piece := t.Piece
+	t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+		return notifyingPiece{PieceImpl: piece(p), events: s.events, hash: infoHash, index: p.Index()}
+	}
+	return t, nil
+}
+
+// Close - closes wrapped storage if it's closer, see closeTorrentClient
+func (s notifyingStorage) Close() error {
+	if closer, ok := s.ClientImpl.(storage.ClientImplCloser); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type notifyingPiece struct {
+	storage.PieceImpl
+	events *pieceEvents
+	hash   metainfo.Hash
+	index  int
+}
+
+func (p notifyingPiece) MarkComplete() error {
+	wasComplete := p.PieceImpl.Completion().Complete
+	if err := p.PieceImpl.MarkComplete(); err != nil || wasComplete {
+		return err
+	}
+	p.events.notify(p.hash, p.index)
+	return nil
+}
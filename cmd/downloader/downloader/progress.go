@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+var ErrNoProgress = errors.New("download makes no progress")
+
+// NoProgressError - MainLoop gave up, see Cfg.NoProgressDeadline
+type NoProgressError struct {
+	Since     time.Duration // no progress during
+	PeersSeen int           // max connected peers during that time
+	Stuck     []string      // not complete torrents (infohash if metadata is not resolved)
+}
+
+func (e *NoProgressError) Error() string {
+	return fmt.Sprintf("%s for %s: peers seen %d, stuck torrents: %s", ErrNoProgress, e.Since.Round(time.Second), e.PeersSeen, strings.Join(e.Stuck, ", "))
+}
+
+func (e *NoProgressError) Is(target error) bool { return target == ErrNoProgress }
+
+// progressWatch - tracks last time downloaded bytes increased. Time when nothing is expected to download
+// (all torrents complete, paused, or quota exceeded) doesn't count.
+type progressWatch struct {
+	completed    int64
+	lastProgress time.Time
+	peersSeen    int
+}
+
+// check - called by MainLoop every tick with torrents which are expected to download
+func (w *progressWatch) check(deadline time.Duration, downloading []*torrent.Torrent, now time.Time) error {
+	var completed int64
+	peers := 0
+	for _, t := range downloading {
+		completed += t.BytesCompleted()
+		peers += t.Stats().ActivePeers
+	}
+	if len(downloading) == 0 || completed > w.completed || w.lastProgress.IsZero() {
+		w.completed, w.lastProgress, w.peersSeen = completed, now, peers
+		return nil
+	}
+	w.completed = completed // can decrease: failed piece verification
+	if peers > w.peersSeen {
+		w.peersSeen = peers
+	}
+	if since := now.Sub(w.lastProgress); since >= deadline {
+		stuck := make([]string, 0, len(downloading))
+		for _, t := range downloading {
+			if t.Info() != nil {
+				stuck = append(stuck, t.Name())
+			} else {
+				stuck = append(stuck, t.InfoHash().HexString())
+			}
+		}
+		return &NoProgressError{Since: since, PeersSeen: w.peersSeen, Stuck: stuck}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// quotaPeriod - billing period is calendar month (UTC)
+func quotaPeriod(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+// downloadQuota - bytes downloaded in current period, persisted in db to survive restarts
+type downloadQuota struct {
+	period   string
+	used     uint64
+	exceeded bool
+
+	lock     sync.Mutex // read and carry: watchdog's restart replaces torrent client between MainLoop's checks
+	client   *torrent.Client
+	lastRead int64 // client's BytesReadData at previous check
+	carried  int64 // read by clients closed by restart, not counted yet
+}
+
+// read - bytes downloaded since previous call, torrent client counts since its own start
+func (q *downloadQuota) read(cl *torrent.Client, read int64) int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if cl != q.client {
+		q.client, q.lastRead = cl, 0
+	}
+	delta := read - q.lastRead + q.carried
+	q.lastRead, q.carried = read, 0
+	return delta
+}
+
+// carry - called before torrent client is closed, like sessionTraffic.carry
+func (q *downloadQuota) carry(cl *torrent.Client, read int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if cl != q.client {
+		q.client, q.lastRead = cl, 0
+	}
+	q.carried += read - q.lastRead
+	q.lastRead = read
+}
+
+// checkQuota - called by MainLoop every tick. Once quota exceeded - downloads of all torrents are disallowed
+// until next period
+func (cli *Client) checkQuota(torrents []*torrent.Torrent) error {
+	limit := cli.cfg.DownloadQuota
+	if limit == 0 {
+		return nil
+	}
+	q := &cli.quota
+	torrentClient := cli.TorrentClient()
+	stats := torrentClient.ConnStats()
+	delta := q.read(torrentClient, stats.BytesReadData.Int64())
+
+	if period := quotaPeriod(time.Now()); period != q.period {
+		used, err := readQuotaUsed(cli.db, period)
+		if err != nil {
+			return err
+		}
+		if q.exceeded {
+			log.Info("[torrent] Download quota reset, resuming downloads", "period", period)
+			for _, t := range torrents {
+				if !cli.isPaused(t.InfoHash()) && !cli.isDownloadPaused(t.InfoHash()) {
+					t.AllowDataDownload()
+				}
+			}
+		}
+		q.period, q.used, q.exceeded = period, used, false
+	}
+	if delta > 0 {
+		q.used += uint64(delta)
+		if err := saveQuotaUsed(cli.db, q.period, q.used); err != nil {
+			return err
+		}
+	}
+	if q.used < limit.Bytes() {
+		return nil
+	}
+	if !q.exceeded {
+		log.Warn("[torrent] Download quota exceeded, downloads paused until next period",
+			"used", datasize.ByteSize(q.used).HumanReadable(), "quota", limit.HumanReadable(), "period", q.period)
+		q.exceeded = true
+	}
+	for _, t := range torrents {
+		t.DisallowDataDownload()
+	}
+	return nil
+}
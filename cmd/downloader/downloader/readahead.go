@@ -0,0 +1,59 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// SetReadahead - for consumers which read file while it's downloading: pieces of
+// [cursorOffset, cursorOffset+readaheadBytes) window get higher priority than others. Call it as cursor moves.
+// readaheadBytes <= 0 - removes the window, all pieces get normal priority.
+// Torrent's reader is used only for its priorities, data is not read through it.
+func (cli *Client) SetReadahead(hash metainfo.Hash, cursorOffset, readaheadBytes int64) error {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	r, ok := cli.readers[hash]
+	if readaheadBytes <= 0 {
+		if ok {
+			delete(cli.readers, hash)
+			return r.Close()
+		}
+		return nil
+	}
+	t, err := cli.torrentWithInfo(hash)
+	if err != nil {
+		return err
+	}
+	if cursorOffset < 0 || cursorOffset > t.Length() {
+		return fmt.Errorf("cursor offset %d out of torrent length %d", cursorOffset, t.Length())
+	}
+	if !ok {
+		r = t.NewReader()
+		cli.readers[hash] = r
+	}
+	r.SetReadahead(readaheadBytes)
+	_, err = r.Seek(cursorOffset, io.SeekStart)
+	return err
+}
+
+// closeReader - reader of torrent which is dropped, must not outlive it
+func (cli *Client) closeReader(hash metainfo.Hash) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if r, ok := cli.readers[hash]; ok {
+		_ = r.Close()
+		delete(cli.readers, hash)
+	}
+}
+
+// closeReaders - torrent lib keeps priorities of readers until they closed
+func (cli *Client) closeReaders() {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	for hash, r := range cli.readers {
+		_ = r.Close()
+		delete(cli.readers, hash)
+	}
+}
@@ -0,0 +1,180 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/c2h5oh/datasize"
+	"golang.org/x/time/rate"
+)
+
+var ErrNotRuntimeConfigurable = errors.New("setting can't be changed at runtime, restart required")
+
+// RuntimeConfig - bundle of live-tunable settings for Client.Reconfigure.
+// Zero value of field means "keep current value".
+type RuntimeConfig struct {
+	DownloadRate    datasize.ByteSize
+	UploadRate      datasize.ByteSize
+	ConnsPerTorrent int
+	// Paused - full set of paused torrents: others get resumed. nil - keep, empty - resume all.
+	Paused []metainfo.Hash
+	// Trackers - replaces trackers of this Client (initially package's Trackers) for torrents added later,
+	// existing torrents get them added (torrent library can't remove trackers of torrent)
+	Trackers [][]string
+
+	// can't be changed at runtime: Reconfigure fails if they differ from current values
+	ListenPort int
+	DataDir    string
+}
+
+// rateLimit - rates are divided by 2 - I don't know why it works, maybe bug inside torrent lib accounting
+func rateLimit(r datasize.ByteSize) rate.Limit {
+	return rate.Limit(r.Bytes() / 2)
+}
+
+func (cli *Client) validateRuntimeConfig(cfg RuntimeConfig) error {
+	if cfg.ListenPort != 0 && cfg.ListenPort != cli.cfg.ListenPort {
+		return fmt.Errorf("ListenPort: %w", ErrNotRuntimeConfigurable)
+	}
+	if cfg.DataDir != "" && cfg.DataDir != cli.DataDir() {
+		return fmt.Errorf("DataDir: %w", ErrNotRuntimeConfigurable)
+	}
+	if cfg.ConnsPerTorrent < 0 {
+		return fmt.Errorf("ConnsPerTorrent must be positive: %d", cfg.ConnsPerTorrent)
+	}
+	for _, h := range cfg.Paused {
+		if h == (metainfo.Hash{}) {
+			return errors.New("Paused: zero infohash")
+		}
+	}
+	for _, tier := range cfg.Trackers {
+		for _, tracker := range tier {
+			u, err := url.Parse(tracker)
+			if err != nil {
+				return fmt.Errorf("tracker %q: %w", tracker, err)
+			}
+			switch u.Scheme {
+			case "udp", "http", "https", "ws", "wss":
+			default:
+				return fmt.Errorf("tracker %q: unsupported scheme %q", tracker, u.Scheme)
+			}
+		}
+	}
+	return nil
+}
+
+// Reconfigure - validates all settings first, nothing is applied if any of them is invalid. Paused set is
+// persisted before anything is applied - the only step which can fail, then new settings are set under cli.lock.
+func (cli *Client) Reconfigure(cfg RuntimeConfig) error {
+	if err := cli.validateRuntimeConfig(cfg); err != nil {
+		return err
+	}
+
+	var pause, resume []metainfo.Hash
+	cli.lock.Lock()
+	if cfg.Paused != nil {
+		want := make(map[metainfo.Hash]struct{}, len(cfg.Paused))
+		for _, h := range cfg.Paused {
+			want[h] = struct{}{}
+			if _, ok := cli.paused[h]; !ok {
+				pause = append(pause, h)
+			}
+		}
+		for h := range cli.paused {
+			if _, ok := want[h]; !ok {
+				resume = append(resume, h)
+			}
+		}
+		if err := savePausedSet(cli.db, pause, resume); err != nil {
+			cli.lock.Unlock()
+			return fmt.Errorf("save paused torrents: %w", err)
+		}
+		for _, h := range pause {
+			cli.paused[h] = struct{}{}
+		}
+		for _, h := range resume {
+			delete(cli.paused, h)
+		}
+	}
+	if cfg.UploadRate > 0 {
+		cli.uploadLimit = rateLimit(cfg.UploadRate)
+	}
+	if cfg.ConnsPerTorrent > 0 {
+		cli.connsPerTorrent = cfg.ConnsPerTorrent
+	}
+	if cfg.Trackers != nil {
+		cli.trackers = cfg.Trackers
+	}
+	cli.lock.Unlock()
+
+	// torrent lib's side, can't fail
+	if cfg.DownloadRate > 0 {
+		cli.cfg.DownloadRateLimiter.SetLimit(rateLimit(cfg.DownloadRate))
+		cli.rebalanceBandwidth()
+	}
+	if cfg.UploadRate > 0 {
+		cli.applyUploadLimit()
+	}
+	for _, t := range cli.TorrentClient().Torrents() {
+		if cfg.ConnsPerTorrent > 0 {
+			t.SetMaxEstablishedConns(cfg.ConnsPerTorrent)
+		}
+		if cfg.Trackers != nil {
+			t.AddTrackers(WithPasskey(cfg.Trackers, cli.cfg.Passkey))
+		}
+	}
+	for _, h := range pause {
+		cli.pauseTorrent(h)
+	}
+	for _, h := range resume {
+		cli.resumeTorrent(h)
+	}
+	return nil
+}
+
+// trackerList - see RuntimeConfig.Trackers
+func (cli *Client) trackerList() [][]string {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	return cli.trackers
+}
+
+func (cli *Client) reconfiguredConns() int {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	return cli.connsPerTorrent
+}
+
+// maxConnsPerTorrent - EstablishedConnsPerTorrent, or RuntimeConfig.ConnsPerTorrent once set
+func (cli *Client) maxConnsPerTorrent() int {
+	if conns := cli.reconfiguredConns(); conns > 0 {
+		return conns
+	}
+	return cli.cfg.EstablishedConnsPerTorrent
+}
+
+// throttleUpload - called by MainLoop: see Cfg.UploadFractionWhileDownloading
+func (cli *Client) throttleUpload(downloading bool) {
+	if cli.cfg.UploadFractionWhileDownloading == 0 {
+		return
+	}
+	cli.lock.Lock()
+	changed := cli.uploadThrottled != downloading
+	cli.uploadThrottled = downloading
+	cli.lock.Unlock()
+	if changed {
+		cli.applyUploadLimit()
+	}
+}
+
+func (cli *Client) applyUploadLimit() {
+	cli.lock.RLock()
+	limit := cli.uploadLimit
+	if cli.uploadThrottled && limit != rate.Inf {
+		limit = rate.Limit(float64(limit) * cli.cfg.UploadFractionWhileDownloading)
+	}
+	cli.lock.RUnlock()
+	cli.cfg.UploadRateLimiter.SetLimit(limit)
+}
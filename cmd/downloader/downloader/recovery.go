@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// RecoveryReport - result of RecoverTorrentFiles, names of torrents
+type RecoveryReport struct {
+	// Recovered - data was on disk, it's adopted after verification - no download
+	Recovered []string
+	// Redownloaded - data was absent or has wrong size
+	Redownloaded []string
+}
+
+// RecoverTorrentFiles - disaster recovery for lost .torrent files: for preverified hashes without .torrent file
+// metadata is taken from db cache or fetched by magnet, .torrent file is written and torrent is added.
+// Existing data files are adopted: torrent lib hashes them into completion store instead of downloading.
+func (cli *Client) RecoverTorrentFiles(ctx context.Context, preverifiedHashes []metainfo.Hash) (report RecoveryReport, err error) {
+	snapshotDir := cli.DataDir()
+	localFiles, err := torrentFilesByHash(snapshotDir)
+	if err != nil {
+		return report, err
+	}
+	for _, hash := range preverifiedHashes {
+		if _, ok := localFiles[hash]; ok {
+			continue
+		}
+		mi, err := cli.recoverMetainfo(ctx, hash)
+		if err != nil {
+			return report, err
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", hash, err)
+		}
+		if err := CreateTorrentFileIfNotExists(snapshotDir, &info, mi); err != nil {
+			return report, err
+		}
+		applyTrackers(mi, cli.addOptions())
+		t, err := cli.TorrentClient().AddTorrent(mi)
+		if err != nil {
+			return report, err
+		}
+		t.DownloadAll()
+		if checkFileSizes(&info, cli.torrentDir(info.Name, hash)) == nil {
+			report.Recovered = append(report.Recovered, info.Name)
+		} else {
+			report.Redownloaded = append(report.Redownloaded, info.Name)
+		}
+	}
+	cli.applyPaused()
+	log.Info("[torrent] Recovered .torrent files", "adopted existing data", report.Recovered, "re-downloading", report.Redownloaded)
+	return report, nil
+}
+
+// recoverMetainfo - from db cache, or from network
+func (cli *Client) recoverMetainfo(ctx context.Context, hash metainfo.Hash) (*metainfo.MetaInfo, error) {
+	infoBytes, err := readInfoBytes(cli.db, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(infoBytes) > 0 {
+		mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+		if mi.HashInfoBytes() == hash {
+			return mi, nil
+		}
+	}
+	magnet := &metainfo.MetaInfo{}
+	applyTrackers(magnet, cli.addOptions())
+	mi, err := cli.FetchMetainfo(ctx, magnet.Magnet(&hash, nil).String())
+	if err != nil {
+		return nil, fmt.Errorf("fetch metadata of %s: %w", hash, err)
+	}
+	if err := saveInfoBytes(cli.db, hash, mi.InfoBytes); err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
@@ -0,0 +1,56 @@
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent"
+)
+
+// SchedulingPolicy - how MainLoop splits download bandwidth between torrents in progress, see Cfg.Scheduling
+type SchedulingPolicy string
+
+const (
+	// SchedulingFair - torrents progress together, by their bandwidth weights (default)
+	SchedulingFair SchedulingPolicy = "fair"
+	// SchedulingFinishLine - torrents which are at least Cfg.FinishLineThreshold complete get finishLineBoost
+	// times their bandwidth weight: they finish (start seeding, free their connections) first instead of all
+	// torrents inching forward. Like SetBandwidthWeight has effect only if download rate is limited and storage
+	// is created by New.
+	SchedulingFinishLine SchedulingPolicy = "finish-line"
+)
+
+const (
+	defaultFinishLineThreshold = 0.9
+	finishLineBoost            = 10
+)
+
+// ParseSchedulingPolicy - empty string is SchedulingFair
+func ParseSchedulingPolicy(s string) (SchedulingPolicy, error) {
+	switch p := SchedulingPolicy(s); p {
+	case "", SchedulingFair:
+		return SchedulingFair, nil
+	case SchedulingFinishLine:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown scheduling policy: %q, expecting fair | finish-line", s)
+	}
+}
+
+func validateFinishLineThreshold(threshold float64) error {
+	if threshold < 0 || threshold >= 1 {
+		return fmt.Errorf("FinishLineThreshold must be in [0, 1): %f", threshold)
+	}
+	return nil
+}
+
+// atFinishLine - torrent must have metadata
+func (cli *Client) atFinishLine(t *torrent.Torrent) bool {
+	if cli.cfg.Scheduling != SchedulingFinishLine || t.Length() == 0 {
+		return false
+	}
+	threshold := cli.cfg.FinishLineThreshold
+	if threshold == 0 {
+		threshold = defaultFinishLineThreshold
+	}
+	return float64(t.BytesCompleted()) >= threshold*float64(t.Length())
+}
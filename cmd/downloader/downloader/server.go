@@ -3,6 +3,8 @@ package downloader
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
@@ -10,6 +12,8 @@ import (
 	proto_downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
 	prototypes "github.com/ledgerwatch/erigon-lib/gointerfaces/types"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	proto_control "github.com/ledgerwatch/erigon/cmd/downloader/downloadercontrol"
+	"github.com/ledgerwatch/log/v3"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -18,38 +22,56 @@ var (
 	ErrNotSupportedSnapshot  = errors.New("not supported snapshot for this network id")
 )
 var (
-	_ proto_downloader.DownloaderServer = &GrpcServer{}
+	_ proto_downloader.DownloaderServer     = &GrpcServer{}
+	_ proto_control.DownloaderControlServer = &GrpcServer{}
 )
 
-func NewGrpcServer(db kv.RwDB, client *Client, snapshotDir string) (*GrpcServer, error) {
+func NewGrpcServer(db kv.RwDB, client *Client) (*GrpcServer, error) {
 	sn := &GrpcServer{
-		db:          db,
-		t:           client,
-		snapshotDir: snapshotDir,
+		db: db,
+		t:  client,
 	}
 	return sn, nil
 }
 
-func CreateTorrentFilesAndAdd(ctx context.Context, snapshotDir string, torrentClient *torrent.Client) error {
-	if err := BuildTorrentFilesIfNeed(ctx, snapshotDir); err != nil {
+func CreateTorrentFilesAndAdd(ctx context.Context, snapshotDir string, cli *Client) error {
+	if cli.cfg.ReadOnlyData {
+		log.Info("[torrent] Read-only data dir: seeding existing .torrent files, not creating new ones", "dir", snapshotDir)
+	} else if err := BuildTorrentFilesIfNeed(ctx, snapshotDir, cli.cfg.Private); err != nil {
 		return err
 	}
-	if err := AddTorrentFiles(snapshotDir, torrentClient); err != nil {
-		return err
+	existing := map[metainfo.Hash]struct{}{}
+	for _, t := range cli.TorrentClient().Torrents() {
+		existing[t.InfoHash()] = struct{}{}
 	}
-	for _, t := range torrentClient.Torrents() {
-		t.AllowDataDownload()
-		t.AllowDataUpload()
+	if err := AddTorrentFiles(ctx, snapshotDir, cli.TorrentClient(), cli.addOptions()); err != nil {
+		var failed AddErrors
+		if !errors.As(err, &failed) {
+			return err
+		}
+		// run with snapshots which could be loaded
+		for _, e := range failed {
+			log.Warn("[torrent] Skipping broken .torrent file", "err", e)
+		}
+	}
+	for _, t := range cli.TorrentClient().Torrents() {
+		if _, ok := existing[t.InfoHash()]; !ok {
+			audit(cli.db, AuditAdded, t.InfoHash(), SourceTorrentFile, nil)
+		}
+	}
+	for _, t := range cli.TorrentClient().Torrents() {
 		t.DownloadAll()
 	}
-	return nil
+	cli.applyPaused()
+	cli.addStaticPeers()
+	return cli.startupVerify(ctx)
 }
 
 type GrpcServer struct {
 	proto_downloader.UnimplementedDownloaderServer
-	t           *Client
-	db          kv.RwDB
-	snapshotDir string
+	proto_control.UnimplementedDownloaderControlServer
+	t  *Client
+	db kv.RwDB
 }
 
 func (s *GrpcServer) Download(ctx context.Context, request *proto_downloader.DownloadRequest) (*emptypb.Empty, error) {
@@ -58,19 +80,24 @@ func (s *GrpcServer) Download(ctx context.Context, request *proto_downloader.Dow
 		//TODO: if hash is empty - create .torrent file from path file (if it exists)
 		infoHashes[i] = gointerfaces.ConvertH160toAddress(it.TorrentHash)
 	}
-	if err := ResolveAbsentTorrents(ctx, s.t.Client, infoHashes, s.snapshotDir); err != nil {
+	if s.t.cfg.HashOracleURL != "" {
+		if err := VerifyHashesAgainstOracle(ctx, infoHashes, s.t.cfg.HashOracleURL); err != nil {
+			return nil, err
+		}
+	}
+	if err := ResolveAbsentTorrents(ctx, s.t.TorrentClient(), s.db, infoHashes, s.t.DataDir(), s.t.addOptions()); err != nil {
 		return nil, err
 	}
-	for _, t := range s.t.Client.Torrents() {
-		t.AllowDataDownload()
-		t.AllowDataUpload()
+	for _, t := range s.t.TorrentClient().Torrents() {
 		t.DownloadAll()
 	}
+	s.t.applyPaused()
+	s.t.addStaticPeers()
 	return &emptypb.Empty{}, nil
 }
 
 func (s *GrpcServer) Stats(ctx context.Context, request *proto_downloader.StatsRequest) (*proto_downloader.StatsReply, error) {
-	torrents := s.t.Client.Torrents()
+	torrents := s.t.TorrentClient().Torrents()
 	reply := &proto_downloader.StatsReply{Completed: true, Torrents: int32(len(torrents))}
 
 	peers := map[torrent.PeerID]struct{}{}
@@ -82,7 +109,7 @@ func (s *GrpcServer) Stats(ctx context.Context, request *proto_downloader.StatsR
 		case <-t.GotInfo():
 			reply.BytesCompleted += uint64(t.BytesCompleted())
 			reply.BytesTotal += uint64(t.Info().TotalLength())
-			reply.Completed = reply.Completed && t.Complete.Bool()
+			reply.Completed = reply.Completed && s.t.torrentComplete(t)
 			for _, peer := range t.PeerConns() {
 				peers[peer.PeerID] = struct{}{}
 			}
@@ -108,3 +135,78 @@ func Proto2InfoHashes(in []*prototypes.H160) []metainfo.Hash {
 	}
 	return infoHashes
 }
+
+// Add - same as Download
+func (s *GrpcServer) Add(ctx context.Context, request *proto_downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return s.Download(ctx, request)
+}
+
+// List - torrents with their progress
+func (s *GrpcServer) List(ctx context.Context, _ *emptypb.Empty) (*proto_control.ListReply, error) {
+	res := &proto_control.ListReply{}
+	for _, t := range s.t.TorrentClient().Torrents() {
+		item := &proto_control.Torrent{
+			InfoHash:       gointerfaces.ConvertAddressToH160(t.InfoHash()),
+			Paused:         s.t.isPaused(t.InfoHash()),
+			DownloadPaused: s.t.isDownloadPaused(t.InfoHash()),
+			Peers:          int32(len(t.PeerConns())),
+		}
+		if t.Info() != nil {
+			item.Name = t.Name()
+			item.BytesCompleted = uint64(t.BytesCompleted())
+			item.BytesTotal = uint64(t.Length())
+			item.Completed = s.t.torrentComplete(t)
+		}
+		res.Torrents = append(res.Torrents, item)
+	}
+	return res, nil
+}
+
+func (s *GrpcServer) Remove(ctx context.Context, request *proto_downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return s.forEachHash(request, s.t.Remove)
+}
+
+func (s *GrpcServer) Pause(ctx context.Context, request *proto_downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return s.forEachHash(request, s.t.Pause)
+}
+
+func (s *GrpcServer) Resume(ctx context.Context, request *proto_downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return s.forEachHash(request, s.t.Resume)
+}
+
+// forEachHash - all hashes are checked before f is called
+func (s *GrpcServer) forEachHash(request *proto_downloader.DownloadRequest, f func(metainfo.Hash) error) (*emptypb.Empty, error) {
+	hashes := make([]metainfo.Hash, len(request.Items))
+	for i, it := range request.Items {
+		if it.TorrentHash == nil {
+			return nil, fmt.Errorf("item %d: torrent hash is required", i)
+		}
+		hashes[i] = gointerfaces.ConvertH160toAddress(it.TorrentHash)
+	}
+	for _, h := range hashes {
+		if err := f(h); err != nil {
+			return nil, fmt.Errorf("%s: %w", h, err)
+		}
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Progress - Stats now and every statsInterval until client disconnects
+func (s *GrpcServer) Progress(request *proto_downloader.StatsRequest, stream proto_control.DownloaderControl_ProgressServer) error {
+	every := time.NewTicker(statsInterval)
+	defer every.Stop()
+	for {
+		reply, err := s.Stats(stream.Context(), request)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-every.C:
+		}
+	}
+}
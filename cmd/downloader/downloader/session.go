@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"math"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+)
+
+// sessionTraffic - payload bytes of torrent clients closed by watchdog's restart, minus what was
+// transferred before ResetSession. Torrent client counts since its own start.
+type sessionTraffic struct {
+	lock                 sync.Mutex
+	uploaded, downloaded int64
+}
+
+// carry - called before torrent client is closed
+func (s *sessionTraffic) carry(stats torrent.ConnStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.uploaded += stats.BytesWrittenData.Int64()
+	s.downloaded += stats.BytesReadData.Int64()
+}
+
+// SessionBytes - payload uploaded and downloaded since start or ResetSession, all torrents (dropped too)
+func (cli *Client) SessionBytes() (uploaded, downloaded int64) {
+	stats := cli.TorrentClient().ConnStats()
+	cli.session.lock.Lock()
+	defer cli.session.lock.Unlock()
+	return stats.BytesWrittenData.Int64() + cli.session.uploaded, stats.BytesReadData.Int64() + cli.session.downloaded
+}
+
+// SessionRatio - uploaded / downloaded since start or ResetSession. +Inf if only uploaded (seeding of
+// existing files), 0 if nothing transferred.
+func (cli *Client) SessionRatio() float64 {
+	return sessionRatio(cli.SessionBytes())
+}
+
+func sessionRatio(uploaded, downloaded int64) float64 {
+	if downloaded == 0 {
+		if uploaded == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return float64(uploaded) / float64(downloaded)
+}
+
+// ResetSession - SessionRatio and SessionBytes count from now
+func (cli *Client) ResetSession() {
+	stats := cli.TorrentClient().ConnStats()
+	cli.session.lock.Lock()
+	defer cli.session.lock.Unlock()
+	cli.session.uploaded, cli.session.downloaded = -stats.BytesWrittenData.Int64(), -stats.BytesReadData.Int64()
+}
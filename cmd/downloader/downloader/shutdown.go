@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const drainPollInterval = 50 * time.Millisecond
+
+// storageWrites - chunk writes to storage created by New, see throttledPiece
+type storageWrites struct {
+	inFlight int64 // atomic
+	bytes    int64 // atomic, written since start
+	busy     int64 // atomic, nanoseconds in writes since start - summed over concurrent ones
+
+	sampledBusy int64 // used only by MainLoop, see sample
+}
+
+// ShutdownSummary - what CloseGracefully did
+type ShutdownSummary struct {
+	Drain        time.Duration // from call until torrent client closed
+	BytesFlushed int64         // chunks received before drain, written to storage during it
+	ActivePeers  int           // connections at moment of call
+	TimedOut     bool          // ctx was done before in-flight writes finished - they are lost
+}
+
+// CloseGracefully - Close, but first drains: downloads are stopped, chunks already received are written to
+// storage and piece completion state flushed. Drain waits for writes until ctx is done.
+// In-flight writes are known only for storage created by New (Cfg.DefaultStorage is not set), otherwise
+// drain doesn't wait for them.
+func (cli *Client) CloseGracefully(ctx context.Context) ShutdownSummary {
+	start := time.Now()
+	cli.closeOnce.Do(func() { close(cli.closing) })
+	cli.restartLock.Lock()
+	defer cli.restartLock.Unlock()
+
+	var res ShutdownSummary
+	for _, t := range cli.TorrentClient().Torrents() {
+		res.ActivePeers += t.Stats().ActivePeers
+		t.DisallowDataDownload()
+	}
+	writtenBefore := atomic.LoadInt64(&cli.writes.bytes)
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+	for atomic.LoadInt64(&cli.writes.inFlight) > 0 && !res.TimedOut {
+		select {
+		case <-ctx.Done():
+			res.TimedOut = true
+		case <-poll.C:
+		}
+	}
+	res.BytesFlushed = atomic.LoadInt64(&cli.writes.bytes) - writtenBefore
+	if err := cli.completions.Flush(); err != nil {
+		log.Warn("[torrent] Flush piece completion", "err", err)
+	}
+	cli.closeTorrentClient()
+	res.Drain = time.Since(start)
+
+	log.Info("[torrent] Closed gracefully", "drain", res.Drain.Round(time.Millisecond),
+		"flushed", datasize.ByteSize(res.BytesFlushed).HumanReadable(), "peers", res.ActivePeers, "timed out", res.TimedOut)
+	return res
+}
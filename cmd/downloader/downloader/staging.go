@@ -0,0 +1,39 @@
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent"
+)
+
+// promoteStaged - moves files of complete torrent from Cfg.StagingDir to its data dir and re-adds torrent:
+// storage must re-open files in new place. Piece completion db is shared - no re-verification happens.
+// Returns torrent which must be used instead of t.
+func (cli *Client) promoteStaged(t *torrent.Torrent) (*torrent.Torrent, error) {
+	info := t.Info()
+	if cli.cfg.StagingDir == "" || !filesExist(cli.cfg.StagingDir, info) {
+		return t, nil
+	}
+	root := cli.torrentDir(info.Name, t.InfoHash())
+	mi := t.Metainfo()
+	cli.closeReader(t.InfoHash())
+	t.Drop()
+	moveErr := moveFiles(cli.cfg.StagingDir, root, info)
+	// re-add even if move failed: torrent must not disappear, not moved files will be downloaded again
+	nt, err := cli.TorrentClient().AddTorrent(&mi)
+	if err != nil {
+		return t, fmt.Errorf("re-add torrent: %w", err)
+	}
+	applyAllow(nt, cli.addOptions())
+	if cli.isPaused(nt.InfoHash()) {
+		nt.DisallowDataDownload()
+		nt.DisallowDataUpload()
+	}
+	if cli.isDownloadPaused(nt.InfoHash()) {
+		nt.DisallowDataDownload()
+	}
+	if moveErr != nil {
+		return nt, fmt.Errorf("move from staging dir: %w", moveErr)
+	}
+	return nt, nil
+}
@@ -0,0 +1,153 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const stateVersion = 1
+
+// DownloaderState - portable snapshot of downloader for failover: SaveState on active node, LoadState on standby
+// which shares data dir with it
+type DownloaderState struct {
+	Version  int
+	PeerID   []byte
+	Torrents []TorrentState
+}
+
+type TorrentState struct {
+	InfoHash  metainfo.Hash
+	InfoBytes []byte `json:",omitempty"` // nil - metadata not resolved yet
+	Paused    bool
+	// DownloadPaused - see PauseDownload
+	DownloadPaused bool
+	// CompletePieces - bitmap, bit i (of byte i/8) - piece i is verified. Applied to piece completion store of standby.
+	CompletePieces []byte `json:",omitempty"`
+	// VerifiedAt - see StartupVerifyPolicy, zero if unknown
+	VerifiedAt time.Time
+}
+
+// SaveState - torrents (with metadata), their pause flags and completion, peer ID - as JSON
+func (cli *Client) SaveState(w io.Writer) error {
+	state := DownloaderState{Version: stateVersion}
+	peerID := cli.TorrentClient().PeerID()
+	state.PeerID = peerID[:]
+	for _, t := range cli.TorrentClient().Torrents() {
+		ts := TorrentState{
+			InfoHash:       t.InfoHash(),
+			Paused:         cli.isPaused(t.InfoHash()),
+			DownloadPaused: cli.isDownloadPaused(t.InfoHash()),
+		}
+		if t.Info() != nil {
+			ts.InfoBytes = t.Metainfo().InfoBytes
+			ts.CompletePieces = completePieces(t)
+		}
+		verifiedAt, err := readVerifiedAt(cli.db, t.InfoHash())
+		if err != nil {
+			return err
+		}
+		ts.VerifiedAt = verifiedAt
+		state.Torrents = append(state.Torrents, ts)
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+func completePieces(t *torrent.Torrent) []byte {
+	bitmap := make([]byte, (t.NumPieces()+7)/8)
+	for i := 0; i < t.NumPieces(); i++ {
+		if t.PieceState(i).Complete {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	return bitmap
+}
+
+// LoadState - New with state of SaveState: peer ID, metadata and pause flags go to db, piece completion - to
+// completion stores of data dirs, then torrents are added. No metadata resolution, no re-verification of data:
+// standby must use same data (shared or replicated dir). Completion is restored only with own storage
+// (ClientConfig.DefaultStorage is nil).
+func LoadState(r io.Reader, cfg *Cfg, db kv.RwDB) (*Client, error) {
+	var state DownloaderState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, fmt.Errorf("decode state: %w", err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version: %d, expecting %d", state.Version, stateVersion)
+	}
+	if err := SetPeerID(db, state.PeerID); err != nil {
+		return nil, err
+	}
+	torrents := torrentsList{known: map[metainfo.Hash]*metainfo.MetaInfo{}}
+	infos := map[metainfo.Hash]*metainfo.Info{}
+	for _, ts := range state.Torrents {
+		torrents.hashes = append(torrents.hashes, ts.InfoHash)
+		if len(ts.InfoBytes) > 0 {
+			mi := &metainfo.MetaInfo{InfoBytes: ts.InfoBytes}
+			if mi.HashInfoBytes() != ts.InfoHash {
+				return nil, fmt.Errorf("metadata of %s has wrong hash", ts.InfoHash)
+			}
+			info, err := mi.UnmarshalInfo()
+			if err != nil {
+				return nil, fmt.Errorf("metadata of %s: %w", ts.InfoHash, err)
+			}
+			torrents.known[ts.InfoHash] = mi
+			infos[ts.InfoHash] = &info
+			if err := saveInfoBytes(db, ts.InfoHash, ts.InfoBytes); err != nil {
+				return nil, err
+			}
+		}
+		if err := savePaused(db, ts.InfoHash, ts.Paused); err != nil {
+			return nil, err
+		}
+		if err := saveDownloadPaused(db, ts.InfoHash, ts.DownloadPaused); err != nil {
+			return nil, err
+		}
+		if !ts.VerifiedAt.IsZero() {
+			if err := saveVerifiedAt(db, ts.InfoHash, ts.VerifiedAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cli, err := New(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+	if cli.ownStorage {
+		for _, ts := range state.Torrents {
+			if info, ok := infos[ts.InfoHash]; ok {
+				if err := cli.restoreCompletion(ts.InfoHash, info, ts.CompletePieces); err != nil {
+					cli.Close()
+					return nil, fmt.Errorf("restore completion of %s: %w", info.Name, err)
+				}
+			}
+		}
+	}
+	if err := torrents.addTo(cli.TorrentClient(), db, cli.addOptions(), cli.isPaused, cli.isDownloadPaused); err != nil {
+		cli.Close()
+		return nil, err
+	}
+	cli.applyPaused()
+	log.Info("[torrent] Loaded state", "torrents", len(state.Torrents), "with metadata", len(infos))
+	return cli, nil
+}
+
+// restoreCompletion - before torrent is added: torrent lib reads completion once, when opens torrent storage
+func (cli *Client) restoreCompletion(hash metainfo.Hash, info *metainfo.Info, bitmap []byte) error {
+	pc := cli.completions.open(cli.torrentDir(info.Name, hash))
+	defer pc.Close()
+	for i := 0; i < info.NumPieces(); i++ {
+		complete := i/8 < len(bitmap) && bitmap[i/8]&(1<<(i%8)) != 0
+		if err := pc.Set(metainfo.PieceKey{InfoHash: hash, Index: i}, complete); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// StorageBackend - how torrents data is stored, see Cfg.Storage
+type StorageBackend string
+
+const (
+	// StorageAuto - StorageMMap, or StorageFile if data dir is on filesystem where mmap is known to be
+	// problematic (network/FUSE mounts: SIGBUS on server errors, poor page cache coherency). Default.
+	StorageAuto StorageBackend = "auto"
+	StorageMMap StorageBackend = "mmap"
+	// StorageFile - plain read/write syscalls, slower than mmap on local disks
+	StorageFile StorageBackend = "file"
+	// StorageDedup - StorageFile, plus identical files of different torrents (same snapshot in few snapshot
+	// versions) are hardlinks of one inode, see dedupStorage
+	StorageDedup StorageBackend = "dedup"
+)
+
+func validBackend(backend StorageBackend) bool {
+	switch backend {
+	case "", StorageAuto, StorageMMap, StorageFile, StorageDedup:
+		return true
+	}
+	return false
+}
+
+// BackendSelector - chooses storage backend per torrent: access patterns differ (state is read randomly,
+// headers sequentially). Empty result means default backend (Cfg.Storage).
+type BackendSelector func(name string, infoHash metainfo.Hash) StorageBackend
+
+func torrentBackend(def StorageBackend, backends BackendSelector, name string, infoHash metainfo.Hash) StorageBackend {
+	if backends != nil {
+		if b := backends(name, infoHash); b != "" {
+			return b
+		}
+	}
+	return def
+}
+
+// resolveBackend - StorageAuto (or empty) resolved by filesystem of dir, fs - name of mmap-unfriendly filesystem
+func resolveBackend(backend StorageBackend, dir string) (res StorageBackend, fs string) {
+	if backend != "" && backend != StorageAuto {
+		return backend, ""
+	}
+	fs, err := mmapUnfriendlyFS(dir)
+	if err != nil {
+		log.Warn("[torrent] Can't detect filesystem, using mmap storage", "dir", dir, "err", err)
+	}
+	if fs != "" {
+		return StorageFile, fs
+	}
+	return StorageMMap, ""
+}
+
+// newStorageBackend - storage of one data dir, StorageAuto resolved by filesystem of dir
+func newStorageBackend(backend StorageBackend, dir string, completion storage.PieceCompletion) storage.ClientImplCloser {
+	backend, fs := resolveBackend(backend, dir)
+	switch backend {
+	case StorageDedup:
+		return newDedupStorage(dir, completion)
+	case StorageFile:
+		if fs != "" {
+			log.Info("[torrent] Using file storage: mmap is unreliable on this filesystem", "dir", dir, "fs", fs)
+		}
+		return storage.NewFileOpts(storage.NewFileClientOpts{ClientBaseDir: dir, PieceCompletion: completion})
+	}
+	return storage.NewMMapWithCompletion(dir, completion)
+}
+
+// DirSelector - maps torrent to data directory where its files are stored, allows to spread
+// snapshots across disks. Empty result means default dir (snapshots dir).
+// .torrent files are always stored in snapshots dir.
+type DirSelector func(name string, infoHash metainfo.Hash) string
+
+func dataDir(snapshotsDir string, dirs DirSelector, name string, infoHash metainfo.Hash) string {
+	if dirs == nil {
+		return snapshotsDir
+	}
+	if dir := dirs(name, infoHash); dir != "" {
+		return dir
+	}
+	return snapshotsDir
+}
+
+// routedStorage - opens each torrent in storage of directory chosen by DirSelector, of backend chosen by
+// BackendSelector. One backend per directory and backend type, backends of directory share its piece completion db
+type routedStorage struct {
+	snapshotsDir string
+	dirs         DirSelector
+	backendOf    BackendSelector
+	stagingDir   string // see Cfg.StagingDir
+	bandwidth    *bandwidthShares
+	writes       *storageWrites
+	durability   DurabilityMode
+	events       *pieceEvents // nil - pieces are not notified
+	newBackend   func(dir, completionDir string, backend StorageBackend) storage.ClientImplCloser
+
+	lock     sync.Mutex
+	backends map[backendKey]storage.ClientImplCloser
+}
+
+// backendKey - staged torrents are stored in staging dir, but use piece completion db of their final dir:
+// once moved there - no re-verification needed
+type backendKey struct {
+	dir, completionDir string
+	backend            StorageBackend // "" - default
+}
+
+func newRoutedStorage(snapshotsDir string, dirs DirSelector, backendOf BackendSelector, stagingDir string, bandwidth *bandwidthShares, writes *storageWrites, durability DurabilityMode, newBackend func(dir, completionDir string, backend StorageBackend) storage.ClientImplCloser) *routedStorage {
+	return &routedStorage{
+		snapshotsDir: snapshotsDir,
+		dirs:         dirs,
+		backendOf:    backendOf,
+		stagingDir:   stagingDir,
+		bandwidth:    bandwidth,
+		writes:       writes,
+		durability:   durability,
+		newBackend:   newBackend,
+		backends:     map[backendKey]storage.ClientImplCloser{},
+	}
+}
+
+func (s *routedStorage) backend(key backendKey) storage.ClientImplCloser {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.backends[key]
+	if !ok {
+		b = s.newBackend(key.dir, key.completionDir, key.backend)
+		s.backends[key] = b
+	}
+	return b
+}
+
+func (s *routedStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	s.lock.Lock()
+	snapshotsDir, dirs := s.snapshotsDir, s.dirs
+	s.lock.Unlock()
+	dir := dataDir(snapshotsDir, dirs, info.Name, infoHash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return storage.TorrentImpl{}, err
+	}
+	key := backendKey{dir: dir, completionDir: dir, backend: torrentBackend("", s.backendOf, info.Name, infoHash)}
+	if !validBackend(key.backend) {
+		return storage.TorrentImpl{}, fmt.Errorf("unknown storage backend of %s: %q", info.Name, key.backend)
+	}
+	if s.stagingDir != "" && !filesExist(dir, info) {
+		if err := os.MkdirAll(s.stagingDir, 0755); err != nil {
+			return storage.TorrentImpl{}, err
+		}
+		key.dir = s.stagingDir
+	}
+	t, err := s.backend(key).OpenTorrent(info, infoHash)
+	if err != nil {
+		return t, err
+	}
+	if s.durability != "" && s.durability != DurabilityNone {
+		durable := newDurableTorrent(s.durability, key.dir, info)
+		piece := t.Piece
+		if s.durability == DurabilityFile {
+			durable.initRemaining(func(i int) storage.PieceImpl { return piece(info.Piece(i)) }, info.NumPieces())
+		}
+		t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+			return durablePiece{PieceImpl: piece(p), t: durable, index: p.Index()}
+		}
+	}
+	if s.events != nil {
+		piece := t.Piece
+		t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+			return notifyingPiece{PieceImpl: piece(p), events: s.events, hash: infoHash, index: p.Index()}
+		}
+	}
+	if s.bandwidth == nil {
+		return t, nil
+	}
+	limiter := s.bandwidth.limiter(infoHash)
+	piece := t.Piece
+	t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+		return throttledPiece{PieceImpl: piece(p), limiter: limiter, writes: s.writes}
+	}
+	return t, nil
+}
+
+// filesPaths - where storage keeps files of torrent
+func filesPaths(root string, info *metainfo.Info) []string {
+	files := info.UpvertedFiles()
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		res = append(res, filepath.Join(append([]string{root, info.Name}, f.Path...)...))
+	}
+	return res
+}
+
+// filesExist - all files of torrent are in root and have expected size
+func filesExist(root string, info *metainfo.Info) bool {
+	files := info.UpvertedFiles()
+	for i, path := range filesPaths(root, info) {
+		st, err := os.Stat(path)
+		if err != nil || st.Size() != files[i].Length {
+			return false
+		}
+	}
+	return true
+}
+
+// moveFiles - moves files of torrent from one root to another. Each file is renamed atomically,
+// if roots are on different filesystems - it's copied to temporary file which is renamed.
+func moveFiles(fromRoot, toRoot string, info *metainfo.Info) error {
+	to := filesPaths(toRoot, info)
+	for i, from := range filesPaths(fromRoot, info) {
+		if err := os.MkdirAll(filepath.Dir(to[i]), 0755); err != nil {
+			return err
+		}
+		err := os.Rename(from, to[i])
+		if err == nil {
+			continue
+		}
+		var linkErr *os.LinkError
+		if !errors.As(err, &linkErr) || !errors.Is(linkErr.Err, syscall.EXDEV) {
+			return err
+		}
+		if err := copyFile(from, to[i]); err != nil {
+			return err
+		}
+		if err := os.Remove(from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile - copy+fsync+rename: dst is either absent or complete
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, st.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Close - closes backends, storage still can be used: backends are re-opened on demand
+func (s *routedStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var firstErr error
+	for key, b := range s.backends {
+		if err := b.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("close %s storage of %s: %w", key.backend, key.dir, err)
+		}
+		delete(s.backends, key)
+	}
+	return firstErr
+}
+
+// setSnapshotsDir - for torrents opened after call, see MigrateDataDir
+func (s *routedStorage) setSnapshotsDir(dir string, dirs DirSelector) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshotsDir = dir
+	s.dirs = dirs
+}
+
+// DataDirs - all directories which have data of torrents from snapshotsDir
+func DataDirs(snapshotsDir string, dirs DirSelector) ([]string, error) {
+	res := []string{snapshotsDir}
+	if dirs == nil {
+		return res, nil
+	}
+	files, err := AllTorrentPaths(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]struct{}{snapshotsDir: {}}
+	for _, f := range files {
+		mi, err := metainfo.LoadFromFile(f)
+		if err != nil {
+			return nil, err
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			return nil, err
+		}
+		dir := dataDir(snapshotsDir, dirs, info.Name, mi.HashInfoBytes())
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		res = append(res, dir)
+	}
+	return res, nil
+}
+
+// RemoveChunksStorage - removes piece completion db's of all data dirs, of any CompletionFormat
+func RemoveChunksStorage(snapshotsDir string, dirs DirSelector) error {
+	all, err := DataDirs(snapshotsDir, dirs)
+	if err != nil {
+		return err
+	}
+	for _, dir := range all {
+		_ = os.RemoveAll(filepath.Join(dir, ".torrent.db"))
+		_ = os.RemoveAll(filepath.Join(dir, ".torrent.bolt.db"))
+		_ = os.RemoveAll(filepath.Join(dir, ".torrent.db-shm"))
+		_ = os.RemoveAll(filepath.Join(dir, ".torrent.db-wal"))
+		_ = os.RemoveAll(filepath.Join(dir, bitfieldCompletionDir))
+	}
+	return nil
+}
+
+// setFilesPermissions - chmod/chown data files of torrent, for multi-user hosts where downloader's umask or
+// user differ from Erigon's
+func setFilesPermissions(root string, t *torrent.Torrent, mode os.FileMode, owner *FileOwner) error {
+	for _, f := range t.Files() {
+		path := filepath.Join(root, filepath.FromSlash(f.Path()))
+		if mode != 0 {
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+		if owner != nil {
+			if err := os.Chown(path, owner.UID, owner.GID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
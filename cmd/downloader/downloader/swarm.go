@@ -0,0 +1,64 @@
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// SwarmHealth - at-a-glance picture of all torrents' swarms, logged by MainLoop once a minute
+type SwarmHealth struct {
+	Peers, Incoming, Outgoing int
+	Webseeds                  int // webseed urls of not complete torrents - used for download
+	TrackersOK                int // announces (tracker of torrent) succeeded last time
+	TrackersFailed            int
+	// StuckPieces - not complete pieces which no connected peer has: only webseeds or new peers can give them
+	StuckPieces int
+}
+
+// SwarmHealth - heavier than Stats: walks all connections and pieces
+func (cli *Client) SwarmHealth() SwarmHealth {
+	var res SwarmHealth
+	for _, t := range cli.TorrentClient().Torrents() {
+		for _, pc := range t.PeerConns() {
+			res.Peers++
+			if pc.Discovery == torrent.PeerSourceIncoming {
+				res.Incoming++
+			} else {
+				res.Outgoing++
+			}
+		}
+		if t.Info() == nil || t.Complete.Bool() {
+			continue
+		}
+		res.Webseeds += len(t.Metainfo().UrlList)
+		availability, err := cli.PieceAvailability(t.InfoHash())
+		if err != nil {
+			continue
+		}
+		for i, peers := range availability {
+			if peers == 0 && !t.PieceState(i).Complete {
+				res.StuckPieces++
+			}
+		}
+	}
+	ok, errs := cli.trackerResults()
+	res.TrackersOK, res.TrackersFailed = ok, len(errs)
+	return res
+}
+
+func (cli *Client) logSwarmHealth() {
+	h := cli.SwarmHealth()
+	stats := cli.Stats()
+	bottleneck := stats.Bottleneck
+	if bottleneck == BottleneckNone {
+		bottleneck = "none"
+	}
+	log.Info("[torrent] Swarm health",
+		"peers", h.Peers, "incoming", h.Incoming, "outgoing", h.Outgoing,
+		"webseeds", h.Webseeds,
+		"trackers ok", h.TrackersOK, "trackers failed", h.TrackersFailed,
+		"stuck pieces", h.StuckPieces,
+		"bottleneck", bottleneck, "pending writes", stats.PendingWrites, "write load", fmt.Sprintf("%.2f", stats.WriteLoad))
+}
@@ -0,0 +1,295 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/tracker/udp"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// TrackerErrorClass - bucket of tracker announce error
+type TrackerErrorClass string
+
+const (
+	TrackerErrAuth        TrackerErrorClass = "auth"
+	TrackerErrRateLimited TrackerErrorClass = "rate_limited"
+	TrackerErrNetwork     TrackerErrorClass = "network"
+	TrackerErrClock       TrackerErrorClass = "clock"
+	TrackerErrOther       TrackerErrorClass = "other"
+)
+
+// clockSkewWarnAfter - amount of consecutive checks with clock-related rejections before warning
+const clockSkewWarnAfter = 3
+
+var trackerErrPatterns = []struct {
+	class    TrackerErrorClass
+	patterns []string
+}{
+	// TLS certificate "expired or is not yet valid" is usual symptom of badly skewed clock
+	{TrackerErrClock, []string{"not yet valid", "certificate has expired", "clock", "timestamp", "time skew"}},
+	{TrackerErrAuth, []string{"unregistered", "not registered", "passkey", "unauthorized", "forbidden", "401", "403"}},
+	{TrackerErrRateLimited, []string{"429", "too many", "rate limit", "slow down"}},
+	{TrackerErrNetwork, []string{"timeout", "deadline exceeded", "connection refused", "connection reset", "no such host", "no ips", "network is unreachable", "i/o"}},
+}
+
+// classifyTrackerError - buckets announce error message by substring match, first matching class wins
+func classifyTrackerError(msg string) TrackerErrorClass {
+	msg = strings.ToLower(msg)
+	for _, c := range trackerErrPatterns {
+		for _, p := range c.patterns {
+			if strings.Contains(msg, p) {
+				return c.class
+			}
+		}
+	}
+	return TrackerErrOther
+}
+
+// announceResults - amount of succeeded and errors of failed last announces to trackers of all torrents.
+// Torrent lib doesn't expose them in API, only in status dump: `"<url>"  next ann: <duration>, last ann: <error or "N peers">`
+// Format is pinned by TestAnnounceResults: update parsing with torrent lib.
+func announceResults(torrentClient *torrent.Client) (ok int, errs []string) {
+	var buf bytes.Buffer
+	torrentClient.WriteStatus(&buf)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "last ann: ")
+		if i < 0 {
+			continue
+		}
+		res := line[i+len("last ann: "):]
+		if res == "never" {
+			continue
+		}
+		if strings.HasSuffix(res, " peers") {
+			ok++
+			continue
+		}
+		errs = append(errs, res)
+	}
+	return ok, errs
+}
+
+// checkTrackers - refreshes per-class counts of failed announces, warns when trackers persistently
+// reject announces for clock-related reasons
+func (cli *Client) checkTrackers() {
+	counts := map[TrackerErrorClass]int{}
+	_, errs := cli.trackerResults()
+	for _, e := range errs {
+		counts[classifyTrackerError(e)]++
+	}
+	cli.lock.Lock()
+	cli.trackerErrors = counts
+	if counts[TrackerErrClock] > 0 {
+		cli.clockSkewChecks++
+	} else {
+		cli.clockSkewChecks = 0
+	}
+	warn := cli.clockSkewChecks == clockSkewWarnAfter
+	cli.lock.Unlock()
+	if warn {
+		log.Warn("[torrent] Trackers persistently reject announces, system clock may be skewed - check NTP sync", "rejections", counts[TrackerErrClock])
+	}
+}
+
+// TrackerErrors - amount of trackers whose last announce failed, by error class
+func (cli *Client) TrackerErrors() map[TrackerErrorClass]int {
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	res := make(map[TrackerErrorClass]int, len(cli.trackerErrors))
+	for k, v := range cli.trackerErrors {
+		res[k] = v
+	}
+	return res
+}
+
+// trackerTier - failover state of torrent: torrent lib announces to all trackers it has at once,
+// so tiers are given to it one by one
+type trackerTier struct {
+	tier     int       // index of last tier of Trackers added to torrent
+	activeAt time.Time // last time torrent had active peers, or got new tier
+}
+
+// addOptions - options to add torrents with, according to Cfg
+func (cli *Client) addOptions() AddOptions {
+	opts := DefaultAddOptions()
+	opts.FirstTierOnly = cli.cfg.TrackerFailover > 0
+	opts.ExpectedNames = cli.names
+	opts.MaxVerifying = cli.cfg.MaxVerifyingTorrents
+	opts.MaxResolving = cli.cfg.MaxResolvingTorrents
+	opts.RequirePreverified = cli.cfg.RequirePreverified
+	opts.Passkey = cli.cfg.Passkey
+	opts.AnnounceList = cli.trackerList()
+	opts.Magnets = cli.cfg.Magnets
+	switch {
+	case cli.cfg.MaxTorrents > 0:
+		opts.MaxTorrents = cli.cfg.MaxTorrents
+	case cli.cfg.MaxTorrents < 0:
+		opts.MaxTorrents = 0
+	}
+	if cli.cfg.ReadOnlyData {
+		opts.WriteTorrentFiles = false
+		opts.AllowDownload = false
+	}
+	return opts
+}
+
+// failoverTiers - announce list torrents are added with (trackers mode, passkey), before FirstTierOnly cut
+func (cli *Client) failoverTiers() [][]string {
+	opts := cli.addOptions()
+	opts.FirstTierOnly = false
+	mi := &metainfo.MetaInfo{}
+	applyTrackers(mi, opts)
+	return mi.AnnounceList
+}
+
+// checkTrackerFailover - adds next tier of failoverTiers to torrent which has no active peers for Cfg.TrackerFailover
+func (cli *Client) checkTrackerFailover(t *torrent.Torrent) {
+	if cli.cfg.TrackerFailover <= 0 || t.Complete.Bool() {
+		return
+	}
+	st, ok := cli.failover[t.InfoHash()]
+	if !ok {
+		st = &trackerTier{activeAt: time.Now()}
+		cli.failover[t.InfoHash()] = st
+	}
+	if t.Stats().ActivePeers > 0 {
+		st.activeAt = time.Now()
+		return
+	}
+	tiers := cli.failoverTiers()
+	if st.tier+1 >= len(tiers) || time.Since(st.activeAt) < cli.cfg.TrackerFailover {
+		return
+	}
+	st.tier++
+	st.activeAt = time.Now()
+	t.AddTrackers([][]string{tiers[st.tier]})
+	log.Info("[torrent] No peers, announcing to next trackers tier", "torrent", t.Name(), "tier", st.tier)
+}
+
+// pruneTrackerFailover - forgets failover state of dropped torrents
+func (cli *Client) pruneTrackerFailover(torrents []*torrent.Torrent) {
+	alive := make(map[metainfo.Hash]struct{}, len(torrents))
+	for _, t := range torrents {
+		alive[t.InfoHash()] = struct{}{}
+	}
+	for hash := range cli.failover {
+		if _, ok := alive[hash]; !ok {
+			delete(cli.failover, hash)
+		}
+	}
+}
+
+// withoutPasskey - tracker url as it's in Trackers: passkey is secret, it's not exposed in metrics and logs
+func withoutPasskey(url, passkey string) string {
+	if passkey == "" {
+		return url
+	}
+	return strings.ReplaceAll(url, passkey, PasskeyPlaceholder)
+}
+
+// trackerProbeTimeout - tracker which doesn't answer in this time is considered dead
+const trackerProbeTimeout = 15 * time.Second
+
+// probeTracker - round trip of lightweight request to tracker: UDP - BEP 15 connect + scrape, HTTP - GET of
+// announce url (tracker answers with error, but it's fast path of same server), through httpClient - same proxy as announces
+func probeTracker(ctx context.Context, httpClient *http.Client, rawURL string, infoHash metainfo.Hash) (time.Duration, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, trackerProbeTimeout)
+	defer cancel()
+	switch u.Scheme {
+	case "udp", "udp4", "udp6":
+		cc, err := udp.NewConnClient(udp.NewConnClientOpts{Network: u.Scheme, Host: u.Host})
+		if err != nil {
+			return 0, err
+		}
+		defer cc.Close()
+		start := time.Now()
+		if _, err := cc.Client.Scrape(ctx, []udp.InfoHash{infoHash}); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return time.Since(start), nil
+	default:
+		return 0, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+// trackersUsed - torrents announce to trackers: by torrent lib, or by externalAnnouncer
+func (cli *Client) trackersUsed() bool {
+	return !cli.cfg.Private && (!cli.cfg.DisableTrackers || cli.announcer != nil)
+}
+
+// probeTrackers - measures latency of all Trackers, called by MainLoop on start and every 30 minutes.
+// Torrent lib doesn't expose timing of its announces - then trackers are probed separately, rarely to not add load.
+// Nothing is probed if trackers are not used (Cfg.Private, ClientConfig.DisableTrackers), or if announces are
+// done by externalAnnouncer - it times them itself.
+func (cli *Client) probeTrackers(ctx context.Context) {
+	if !cli.trackersUsed() || cli.announcer != nil {
+		return
+	}
+	var infoHash metainfo.Hash
+	if torrents := cli.TorrentClient().Torrents(); len(torrents) > 0 {
+		infoHash = torrents[0].InfoHash()
+	}
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: cli.cfg.HTTPProxy}}
+	defer httpClient.CloseIdleConnections()
+	latencies := map[string]time.Duration{}
+	for _, tier := range cli.trackerList() {
+		for _, tracker := range tier {
+			if strings.Contains(tracker, PasskeyPlaceholder) && cli.cfg.Passkey == "" {
+				continue
+			}
+			latency, err := probeTracker(ctx, httpClient, strings.ReplaceAll(tracker, PasskeyPlaceholder, cli.cfg.Passkey), infoHash)
+			if err != nil {
+				log.Debug("[torrent] Tracker probe", "tracker", tracker, "err", err)
+				continue
+			}
+			latencies[tracker] = latency
+		}
+	}
+	cli.lock.Lock()
+	cli.trackerProbes = latencies
+	cli.lock.Unlock()
+}
+
+// TrackerLatencies - by tracker url as it's in Trackers (with PasskeyPlaceholder), trackers which didn't answer are absent.
+// If Cfg.ExternalPort is used - round trip of last real announce. Otherwise announces are done by torrent lib, which
+// doesn't expose their timing - then it's round trip of probe request (UDP scrape or HTTP GET, see probeTracker)
+// measured on start and every 30 minutes, not of announce.
+func (cli *Client) TrackerLatencies() map[string]time.Duration {
+	if cli.announcer != nil {
+		return cli.announcer.announceLatencies()
+	}
+	cli.lock.RLock()
+	defer cli.lock.RUnlock()
+	res := make(map[string]time.Duration, len(cli.trackerProbes))
+	for k, v := range cli.trackerProbes {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,399 @@
+package downloader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	lg "github.com/anacrolix/log"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		exp datasize.ByteSize
+		err bool
+	}{
+		{in: "32mb", exp: 32 * datasize.MB},
+		{in: "50MB", exp: 50 * datasize.MB},
+		{in: " 1gb ", exp: datasize.GB},
+		{in: "100", exp: 100},
+		{in: "", err: true},
+		{in: "0", err: true},
+		{in: "-5mb", err: true},
+		{in: "5xyz", err: true},
+		{in: "1.5gb", err: true},
+		{in: "mb", err: true},
+	} {
+		rate, err := ParseRate(tc.in)
+		if tc.err {
+			require.Error(t, err, tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		require.Equal(t, tc.exp, rate, tc.in)
+	}
+}
+
+func createTestSegment(tb testing.TB, dir, name string, size int) {
+	tb.Helper()
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(tb, err)
+	require.NoError(tb, os.WriteFile(filepath.Join(dir, name), data, 0644))
+}
+
+// On page-cache-hot data buffer size barely matters (hashing is CPU-bound),
+// difference shows up on cold HDD reads: run with `echo 3 > /proc/sys/vm/drop_caches` between runs
+func BenchmarkVerifyTorrent(b *testing.B) {
+	dir := b.TempDir()
+	const size = 64 * DefaultPieceSize
+	createTestSegment(b, dir, "v1-000000-000500-bodies.seg", size)
+	info, err := BuildInfoBytesForFile(dir, "v1-000000-000500-bodies.seg")
+	require.NoError(b, err)
+
+	for _, bufSize := range []datasize.ByteSize{32 * datasize.KB, 256 * datasize.KB, 4 * datasize.MB} {
+		b.Run(strconv.Itoa(int(bufSize.KBytes()))+"kb", func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				err := verifyTorrent(context.Background(), info, dir, VerifyOptions{ReadBufSize: int(bufSize.Bytes())}, func(i int, good bool) error {
+					if !good {
+						b.Fatalf("piece %d is bad", i)
+					}
+					return nil
+				})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestBenchTorrentBudget(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 10*DefaultPieceSize)
+	info, err := BuildInfoBytesForFile(dir, "v1-000000-000500-bodies.seg")
+	require.NoError(err)
+
+	var res BenchResult
+	require.NoError(benchTorrent(info, dir, DefaultPieceSize/2, nil, &res))
+	require.Equal(1, res.Pieces)
+	require.Zero(res.BadPieces)
+
+	res = BenchResult{}
+	require.NoError(benchTorrent(info, dir, 5*DefaultPieceSize, nil, &res))
+	require.Equal(5, res.Pieces)
+}
+
+func TestVerifyWorkers(t *testing.T) {
+	require := require.New(t)
+	require.Equal(8, verifyWorkers(8, 2*1024*1024, 256*datasize.MB))
+	require.Equal(4, verifyWorkers(8, 64*1024*1024, 256*datasize.MB))
+	require.Equal(1, verifyWorkers(8, 512*1024*1024, 256*datasize.MB))
+	require.Equal(1, verifyWorkers(0, 2*1024*1024, 0))
+}
+
+func TestVerifyTorrentParallel(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 10*DefaultPieceSize+123)
+	info, err := BuildInfoBytesForFile(dir, "v1-000000-000500-bodies.seg")
+	require.NoError(err)
+
+	seen := map[int]bool{}
+	err = verifyTorrent(context.Background(), info, dir, VerifyOptions{Workers: 4}, func(i int, good bool) error {
+		seen[i] = good
+		return nil
+	})
+	require.NoError(err)
+	require.Len(seen, info.NumPieces())
+	for i, good := range seen {
+		require.True(good, i)
+	}
+}
+
+func TestMoveFiles(t *testing.T) {
+	require := require.New(t)
+	staging, final := t.TempDir(), t.TempDir()
+	createTestSegment(t, staging, "v1-000000-000500-bodies.seg", DefaultPieceSize+1)
+	info, err := BuildInfoBytesForFile(staging, "v1-000000-000500-bodies.seg")
+	require.NoError(err)
+	require.True(filesExist(staging, info))
+	require.False(filesExist(final, info))
+
+	require.NoError(moveFiles(staging, final, info))
+	require.True(filesExist(final, info))
+	require.False(filesExist(staging, info))
+}
+
+func TestMoveDirInterrupted(t *testing.T) {
+	require := require.New(t)
+	src := t.TempDir()
+	createTestSegment(t, src, "v1-000000-000500-bodies.seg", 1024)
+	dst := filepath.Join(t.TempDir(), "new")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(copyDir(ctx, src, dst), context.Canceled)
+
+	require.NoError(moveDir(context.Background(), src, dst))
+	_, err := os.Stat(filepath.Join(dst, "v1-000000-000500-bodies.seg"))
+	require.NoError(err)
+	_, err = os.Stat(src)
+	require.True(os.IsNotExist(err))
+}
+
+func TestVerifyTorrentCancel(t *testing.T) {
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 32*DefaultPieceSize)
+	info, err := BuildInfoBytesForFile(dir, "v1-000000-000500-bodies.seg")
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var cancelledAt time.Time
+		verified := 0
+		err = verifyTorrent(ctx, info, dir, VerifyOptions{Workers: workers}, func(i int, good bool) error {
+			if verified++; verified == 1 { // cancel from another goroutine while next pieces are hashed
+				go func() {
+					cancelledAt = time.Now()
+					cancel()
+				}()
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		})
+		require.ErrorIs(t, err, context.Canceled, workers)
+		require.Less(t, time.Since(cancelledAt), 50*time.Millisecond, workers)
+		require.Less(t, verified, info.NumPieces(), workers)
+		cancel()
+	}
+}
+
+func TestVerifyDtaFilesCheckpoint(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	createTestSegment(t, dir, "v1-000500-001000-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	opts := VerifyOptions{Checkpoint: DefaultVerifyCheckpoint(dir)}
+
+	// corrupt 2nd torrent: verify fails after 1st is recorded
+	second := filepath.Join(dir, "v1-000500-001000-bodies.seg")
+	good, err := os.ReadFile(second)
+	require.NoError(err)
+	bad := append([]byte{}, good...)
+	bad[0]++
+	require.NoError(os.WriteFile(second, bad, 0644))
+	require.Error(VerifyDtaFiles(context.Background(), dir, nil, opts))
+
+	// corrupt 1st torrent keeping its fingerprint: resumed verify doesn't read it again
+	first := filepath.Join(dir, "v1-000000-000500-bodies.seg")
+	fi, err := os.Stat(first)
+	require.NoError(err)
+	data, err := os.ReadFile(first)
+	require.NoError(err)
+	data[0]++
+	require.NoError(os.WriteFile(first, data, 0644))
+	require.NoError(os.Chtimes(first, fi.ModTime(), fi.ModTime()))
+	require.NoError(os.WriteFile(second, good, 0644))
+	require.NoError(VerifyDtaFiles(context.Background(), dir, nil, opts))
+
+	// checkpoint is removed on success: next verify is full
+	_, err = os.Stat(opts.Checkpoint)
+	require.True(os.IsNotExist(err))
+	require.Error(VerifyDtaFiles(context.Background(), dir, nil, opts))
+}
+
+func TestVerifyTorrentFileStorage(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 3*DefaultPieceSize+123)
+	info, err := BuildInfoBytesForFile(dir, "v1-000000-000500-bodies.seg")
+	require.NoError(err)
+
+	verify := func() (bad []int) {
+		err := verifyTorrent(context.Background(), info, dir, VerifyOptions{Storage: StorageFile, ReadBufSize: 1000}, func(i int, good bool) error {
+			if !good {
+				bad = append(bad, i)
+			}
+			return nil
+		})
+		require.NoError(err)
+		return bad
+	}
+	require.Empty(verify())
+
+	f, err := os.OpenFile(filepath.Join(dir, "v1-000000-000500-bodies.seg"), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte{0, 1, 2}, 3*DefaultPieceSize+1)
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.Equal([]int{3}, verify())
+
+	selector := func(name string, _ metainfo.Hash) StorageBackend {
+		if name == "v1-000000-000500-bodies.seg" {
+			return StorageFile
+		}
+		return ""
+	}
+	require.Equal(StorageFile, torrentBackend(StorageMMap, selector, "v1-000000-000500-bodies.seg", metainfo.Hash{}))
+	require.Equal(StorageMMap, torrentBackend(StorageMMap, selector, "v1-000000-000500-headers.seg", metainfo.Hash{}))
+}
+
+func TestVerifyAgainstManifest(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	require.NoError(os.WriteFile(filepath.Join(dir, "a.seg"), []byte("a"), 0644))
+	require.NoError(os.WriteFile(filepath.Join(dir, "b.seg"), []byte("b"), 0644))
+	sumA := sha256.Sum256([]byte("a"))
+	manifest := map[string]string{"a.seg": hex.EncodeToString(sumA[:])}
+	require.NoError(VerifyAgainstManifest(dir, manifest))
+
+	// all problems reported at once, not only first one
+	manifest["b.seg"] = hex.EncodeToString(sumA[:])
+	manifest["c.seg"] = hex.EncodeToString(sumA[:])
+	manifest["d.seg"] = hex.EncodeToString(sumA[:])
+	err := VerifyAgainstManifest(dir, manifest)
+	var manifestErr *ManifestError
+	require.True(errors.As(err, &manifestErr))
+	require.Equal([]string{"c.seg", "d.seg"}, manifestErr.Missing)
+	require.Len(manifestErr.Mismatched, 1)
+	require.Contains(manifestErr.Mismatched[0], "b.seg")
+	require.Empty(manifestErr.Unreadable)
+}
+
+func TestDiffSnapshotDirs(t *testing.T) {
+	require := require.New(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	createTestSegment(t, dirA, "v1-000000-000500-bodies.seg", 1024)
+	createTestSegment(t, dirA, "v1-000500-001000-bodies.seg", 1024)
+	data, err := os.ReadFile(filepath.Join(dirA, "v1-000000-000500-bodies.seg"))
+	require.NoError(err)
+	require.NoError(os.WriteFile(filepath.Join(dirB, "v1-000000-000500-bodies.seg"), data, 0644))
+	createTestSegment(t, dirB, "v1-001000-001500-bodies.seg", 1024)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dirA, false))
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dirB, false))
+
+	hash := func(dir, name string) metainfo.Hash {
+		mi, err := metainfo.LoadFromFile(filepath.Join(dir, name+".torrent"))
+		require.NoError(err)
+		return mi.HashInfoBytes()
+	}
+	onlyA, onlyB, common, err := DiffSnapshotDirs(dirA, dirB)
+	require.NoError(err)
+	require.Equal([]metainfo.Hash{hash(dirA, "v1-000500-001000-bodies.seg")}, onlyA)
+	require.Equal([]metainfo.Hash{hash(dirB, "v1-001000-001500-bodies.seg")}, onlyB)
+	require.Equal([]metainfo.Hash{hash(dirA, "v1-000000-000500-bodies.seg")}, common)
+}
+
+func TestVerifyDtaFilesBudget(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	createTestSegment(t, dir, "v1-000500-001000-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+
+	err := VerifyDtaFiles(context.Background(), dir, nil, VerifyOptions{MaxDuration: time.Nanosecond})
+	require.ErrorIs(err, ErrVerifyIncomplete)
+	var incomplete *VerifyIncompleteError
+	require.True(errors.As(err, &incomplete))
+	require.Equal(0, incomplete.Verified)
+	require.Equal(2, incomplete.Left)
+
+	require.NoError(VerifyDtaFiles(context.Background(), dir, nil, VerifyOptions{MaxDuration: time.Minute}))
+}
+
+func TestVerifyDtaFilesLeastRecentlyVerifiedFirst(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 2*DefaultPieceSize)
+	createTestSegment(t, dir, "v1-000500-001000-bodies.seg", 2*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	db := memdb.NewTestDB(t)
+	require.NoError(VerifyDtaFiles(context.Background(), dir, nil, VerifyOptions{DB: db}))
+	hashes := map[string]metainfo.Hash{}
+	for _, name := range []string{"v1-000000-000500-bodies.seg", "v1-000500-001000-bodies.seg"} {
+		mi, err := metainfo.LoadFromFile(filepath.Join(dir, name+".torrent"))
+		require.NoError(err)
+		hashes[name] = mi.HashInfoBytes()
+		verifiedAt, err := readVerifiedAt(db, hashes[name])
+		require.NoError(err)
+		require.False(verifiedAt.IsZero())
+	}
+
+	// both corrupted: first error is of torrent which was not verified longest
+	require.NoError(saveVerifiedAt(db, hashes["v1-000000-000500-bodies.seg"], time.Now()))
+	require.NoError(saveVerifiedAt(db, hashes["v1-000500-001000-bodies.seg"], time.Now().Add(-time.Hour)))
+	for name := range hashes {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR, 0)
+		require.NoError(err)
+		_, err = f.WriteAt([]byte{1, 2, 3}, 0)
+		require.NoError(err)
+		require.NoError(f.Close())
+	}
+	err := VerifyDtaFiles(context.Background(), dir, nil, VerifyOptions{DB: db})
+	require.ErrorContains(err, "v1-000500-001000-bodies.seg")
+}
+
+func TestSpotCheck(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	createTestSegment(t, dir, "v1-000000-000500-bodies.seg", 4*DefaultPieceSize)
+	createTestSegment(t, dir, "v1-000500-001000-bodies.seg", 4*DefaultPieceSize)
+	require.NoError(BuildTorrentFilesIfNeed(context.Background(), dir, false))
+	// second torrent is placed to other dir by DirSelector
+	other := t.TempDir()
+	require.NoError(os.Rename(filepath.Join(dir, "v1-000500-001000-bodies.seg"), filepath.Join(other, "v1-000500-001000-bodies.seg")))
+	f, err := os.OpenFile(filepath.Join(other, "v1-000500-001000-bodies.seg"), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte{0, 1, 2}, 2*DefaultPieceSize+1)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	cfg, err := TorrentConfig(dir, "", "", false, lg.Warning, 0, 0, 0)
+	require.NoError(err)
+	cfg.DirSelector = func(name string, _ metainfo.Hash) string {
+		if name == "v1-000500-001000-bodies.seg" {
+			return other
+		}
+		return ""
+	}
+	cfg.BackendSelector = func(string, metainfo.Hash) StorageBackend { return StorageFile }
+	cli, err := New(cfg, memdb.NewTestDB(t))
+	require.NoError(err)
+	defer cli.Close()
+
+	_, err = cli.SpotCheck(context.Background(), 0)
+	require.Error(err)
+
+	full, err := cli.SpotCheck(context.Background(), 1)
+	require.NoError(err)
+	require.False(full.OK())
+	require.Equal(8, full.Pieces)
+	require.Equal(8, full.Checked)
+	require.Len(full.Torrents, 2)
+	require.Equal([]int{2}, full.Torrents[1].BadPieces)
+
+	// same seed - same sample
+	half, err := cli.SpotCheckSeed(context.Background(), 0.5, 42)
+	require.NoError(err)
+	require.Equal(4, half.Checked)
+	again, err := cli.SpotCheckSeed(context.Background(), 0.5, 42)
+	require.NoError(err)
+	require.Equal(half.OK(), again.OK())
+	for i := range half.Torrents {
+		require.Equal(half.Torrents[i].Checked, again.Torrents[i].Checked)
+		require.Equal(half.Torrents[i].BadPieces, again.Torrents[i].BadPieces)
+	}
+}
@@ -0,0 +1,380 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// BackgroundVerifyPollInterval - how often BackgroundVerify samples download rate
+var BackgroundVerifyPollInterval = time.Second
+
+// readRateSampler - measures client's download rate between calls
+type readRateSampler struct {
+	cli  *Client
+	last int64
+	at   time.Time
+}
+
+func newReadRateSampler(cli *Client) *readRateSampler {
+	connStats := cli.TorrentClient().ConnStats()
+	return &readRateSampler{cli: cli, last: connStats.BytesReadData.Int64(), at: time.Now()}
+}
+
+// rate - bytes per second since previous call
+func (s *readRateSampler) rate() uint64 {
+	connStats := s.cli.TorrentClient().ConnStats()
+	now, read := time.Now(), connStats.BytesReadData.Int64()
+	elapsed := now.Sub(s.at)
+	delta := read - s.last
+	s.last, s.at = read, now
+	if elapsed <= 0 || delta <= 0 {
+		return 0
+	}
+	return uint64(float64(delta) / elapsed.Seconds())
+}
+
+// BackgroundVerify - re-hashes already completed pieces of all torrents, but only while download rate is below
+// idleRate: when downloads are active hashing is paused, so verification doesn't compete with sync for disk.
+// Pieces which fail verification are marked incomplete by torrent lib and will be downloaded again.
+func BackgroundVerify(ctx context.Context, cli *Client, idleRate datasize.ByteSize) error {
+	logEvery := time.NewTicker(20 * time.Second)
+	defer logEvery.Stop()
+	sampler := newReadRateSampler(cli)
+
+	waitIdle := func() error {
+		for {
+			if time.Since(sampler.at) < BackgroundVerifyPollInterval || sampler.rate() <= idleRate.Bytes() {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(BackgroundVerifyPollInterval):
+			}
+		}
+	}
+
+	for _, t := range cli.healthyTorrents() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.GotInfo():
+		default: // no metadata yet - nothing to verify
+			continue
+		}
+		for i := 0; i < t.NumPieces(); i++ {
+			if err := waitIdle(); err != nil {
+				return err
+			}
+			p := t.Piece(i)
+			if !p.State().Complete {
+				continue
+			}
+			p.VerifyData()
+			select {
+			case <-logEvery.C:
+				log.Info("[torrent] Background verify", "torrent", t.Name(), "progress", fmt.Sprintf("%.2f%%", 100*float64(i+1)/float64(t.NumPieces())))
+			default:
+			}
+		}
+	}
+	log.Info("[torrent] Background verify done")
+	return nil
+}
+
+// VerifyReport - result of Client.VerifyTorrent, or of SpotCheck: totals of all torrents, details in Torrents
+type VerifyReport struct {
+	InfoHash  metainfo.Hash
+	Name      string
+	Pieces    int
+	Checked   int // hashed pieces, less than Pieces if sampled by SpotCheck
+	BadPieces []int
+	Took      time.Duration
+
+	Torrents []VerifyReport // SpotCheck: torrents which pieces were sampled
+	Seed     int64          // SpotCheck: seed of sampling, see SpotCheckSeed
+}
+
+func (r VerifyReport) OK() bool {
+	for _, t := range r.Torrents {
+		if !t.OK() {
+			return false
+		}
+	}
+	return len(r.BadPieces) == 0
+}
+
+// VerifyTorrent - hashes on-disk data of one torrent, unlike VerifyDtaFiles doesn't stop on first bad piece
+func (cli *Client) VerifyTorrent(ctx context.Context, hash metainfo.Hash) (VerifyReport, error) {
+	t, err := cli.torrentWithInfo(hash)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	info := t.Info()
+	report := VerifyReport{InfoHash: hash, Name: info.Name, Pieces: info.NumPieces(), Checked: info.NumPieces()}
+	start := time.Now()
+	root := cli.torrentDir(info.Name, hash)
+	opts := VerifyOptions{Storage: torrentBackend(cli.cfg.Storage, cli.cfg.BackendSelector, info.Name, hash)}
+	err = verifyTorrent(ctx, info, root, opts, func(i int, good bool) error {
+		if !good {
+			report.BadPieces = append(report.BadPieces, i)
+		}
+		return ctx.Err()
+	})
+	report.Took = time.Since(start)
+	if err != nil {
+		return report, err
+	}
+	if !report.OK() {
+		log.Warn("[torrent] Verify found bad pieces", "torrent", info.Name, "bad", len(report.BadPieces), "of", report.Pieces)
+	}
+	return report, nil
+}
+
+// SpotCheck - hashes random fraction (0, 1] of pieces of all torrents of .torrent files in data dir: cheap periodic
+// check that data didn't rot. Data is read where storage keeps it (Cfg.DirSelector, Cfg.BackendSelector).
+// Doesn't stop on bad piece, see VerifyReport.OK. Seed is in report: SpotCheckSeed repeats the sample.
+func (cli *Client) SpotCheck(ctx context.Context, fraction float64) (VerifyReport, error) {
+	return cli.SpotCheckSeed(ctx, fraction, time.Now().UnixNano())
+}
+
+// SpotCheckSeed - SpotCheck with given seed of sampling
+func (cli *Client) SpotCheckSeed(ctx context.Context, fraction float64, seed int64) (VerifyReport, error) {
+	report := VerifyReport{Seed: seed}
+	if fraction <= 0 || fraction > 1 {
+		return report, fmt.Errorf("spot-check fraction must be in (0, 1]: %f", fraction)
+	}
+	start := time.Now()
+	files, err := AllTorrentPaths(cli.DataDir())
+	if err != nil {
+		return report, err
+	}
+	torrents := make([]VerifyReport, 0, len(files))
+	infos := make([]*metainfo.Info, 0, len(files))
+	for _, f := range files {
+		mi, err := metainfo.LoadFromFile(f)
+		if err != nil {
+			return report, err
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			return report, err
+		}
+		torrents = append(torrents, VerifyReport{InfoHash: mi.HashInfoBytes(), Name: info.Name, Pieces: info.NumPieces()})
+		infos = append(infos, &info)
+		report.Pieces += info.NumPieces()
+	}
+	sample := int(math.Ceil(fraction * float64(report.Pieces)))
+	picked := rand.New(rand.NewSource(seed)).Perm(report.Pieces)[:sample]
+	sort.Ints(picked)
+
+	first := 0 // global index of first piece of torrent i
+	for i, info := range infos {
+		var pieces []int
+		for len(picked) > 0 && picked[0] < first+info.NumPieces() {
+			pieces, picked = append(pieces, picked[0]-first), picked[1:]
+		}
+		first += info.NumPieces()
+		if len(pieces) == 0 {
+			continue
+		}
+		tr := &torrents[i]
+		root := cli.torrentDir(info.Name, tr.InfoHash)
+		backend := torrentBackend(cli.cfg.Storage, cli.cfg.BackendSelector, info.Name, tr.InfoHash)
+		if err := spotCheckTorrent(ctx, info, root, backend, pieces, tr); err != nil {
+			return report, fmt.Errorf("%s: %w", info.Name, err)
+		}
+		report.Checked += tr.Checked
+		report.Torrents = append(report.Torrents, *tr)
+	}
+	report.Took = time.Since(start)
+	if !report.OK() {
+		log.Warn("[torrent] Spot-check found bad pieces", "seed", seed)
+	}
+	return report, nil
+}
+
+func spotCheckTorrent(ctx context.Context, info *metainfo.Info, root string, backend StorageBackend, pieces []int, report *VerifyReport) error {
+	start := time.Now()
+	span, closeSpan, err := openReader(info, root, backend)
+	if err != nil {
+		return err
+	}
+	defer closeSpan()
+	buf := make([]byte, DefaultVerifyReadBufSize)
+	for _, i := range pieces {
+		p := info.Piece(i)
+		hash := sha1.New()
+		if _, err := io.CopyBuffer(hash, ctxReader{ctx, io.NewSectionReader(span, p.Offset(), p.Length())}, buf); err != nil {
+			return err
+		}
+		report.Checked++
+		if sum := hash.Sum(nil); !bytes.Equal(sum, p.Hash().Bytes()) {
+			logBadPiece(info, root, i, sum)
+			report.BadPieces = append(report.BadPieces, i)
+		}
+	}
+	report.Took = time.Since(start)
+	return nil
+}
+
+// StartupVerifyMode - whether to trust piece completion store on startup, or re-hash existing data
+type StartupVerifyMode int
+
+const (
+	StartupVerifyTrust   StartupVerifyMode = iota // trust completion store, default
+	StartupVerifyAlways                           // re-hash all data on every start
+	StartupVerifyIfStale                          // re-hash torrents which completion was recorded more than MaxAge ago
+)
+
+type StartupVerifyPolicy struct {
+	Mode   StartupVerifyMode
+	MaxAge time.Duration // for StartupVerifyIfStale
+}
+
+// ParseStartupVerifyPolicy - "trust", "always" or max age like "720h"
+func ParseStartupVerifyPolicy(s string) (StartupVerifyPolicy, error) {
+	switch strings.TrimSpace(s) {
+	case "", "trust":
+		return StartupVerifyPolicy{Mode: StartupVerifyTrust}, nil
+	case "always":
+		return StartupVerifyPolicy{Mode: StartupVerifyAlways}, nil
+	}
+	maxAge, err := time.ParseDuration(s)
+	if err != nil || maxAge <= 0 {
+		return StartupVerifyPolicy{}, fmt.Errorf("invalid startup verify policy %q, expected: trust | always | max age (example: 720h)", s)
+	}
+	return StartupVerifyPolicy{Mode: StartupVerifyIfStale, MaxAge: maxAge}, nil
+}
+
+// needVerify - decides by time when torrent's completion was recorded, zero if never
+func (p StartupVerifyPolicy) needVerify(verifiedAt time.Time) bool {
+	switch p.Mode {
+	case StartupVerifyAlways:
+		return true
+	case StartupVerifyIfStale:
+		return !verifiedAt.IsZero() && time.Since(verifiedAt) > p.MaxAge
+	default:
+		return false
+	}
+}
+
+// startupVerify - re-hashes torrents according to Cfg.StartupVerify, in background.
+// Torrents without recorded completion time are verified by torrent lib anyway (completion store has nothing).
+func (cli *Client) startupVerify(ctx context.Context) error {
+	var toVerify []*torrent.Torrent
+	for _, t := range cli.healthyTorrents() {
+		if t.Info() == nil {
+			continue
+		}
+		verifiedAt, err := readVerifiedAt(cli.db, t.InfoHash())
+		if err != nil {
+			return err
+		}
+		if cli.cfg.StartupVerify.needVerify(verifiedAt) {
+			toVerify = append(toVerify, t)
+		}
+	}
+	if len(toVerify) == 0 {
+		return nil
+	}
+	log.Info("[torrent] Startup verification", "torrents", len(toVerify))
+	go func() {
+		for _, t := range toVerify {
+			for i := 0; i < t.NumPieces(); i++ {
+				if ctx.Err() != nil {
+					return
+				}
+				t.Piece(i).VerifyData()
+			}
+			if err := saveVerifiedAt(cli.db, t.InfoHash(), time.Now()); err != nil {
+				log.Warn("[torrent] Save verification time", "torrent", t.Name(), "err", err)
+			}
+		}
+		log.Info("[torrent] Startup verification done", "torrents", len(toVerify))
+	}()
+	return nil
+}
+
+// RequestReverify - enqueues torrent for re-verification and repair, returns immediately: for consumer which
+// found bad data (failed snapshot read). MainLoop re-hashes complete pieces of torrent in background, pieces
+// which fail are marked incomplete and downloaded again. Torrent without metadata waits for it in queue.
+func (cli *Client) RequestReverify(hash metainfo.Hash) error {
+	if _, ok := cli.TorrentClient().Torrent(hash); !ok {
+		return fmt.Errorf("%w: %s", ErrTorrentNotFound, hash)
+	}
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	cli.reverifyQueue[hash] = struct{}{}
+	return nil
+}
+
+// processReverify - called by MainLoop every tick: starts re-verification of queued torrents which have
+// metadata and aren't being re-verified already
+func (cli *Client) processReverify(ctx context.Context) {
+	cli.lock.RLock()
+	queued := make([]metainfo.Hash, 0, len(cli.reverifyQueue))
+	for hash := range cli.reverifyQueue {
+		queued = append(queued, hash)
+	}
+	cli.lock.RUnlock()
+	for _, hash := range queued {
+		t, ok := cli.TorrentClient().Torrent(hash)
+		if ok && t.Info() == nil {
+			continue
+		}
+		cli.lock.Lock()
+		_, busy := cli.reverifying[hash]
+		if !busy {
+			delete(cli.reverifyQueue, hash)
+			if ok {
+				cli.reverifying[hash] = struct{}{}
+			}
+		}
+		cli.lock.Unlock()
+		if ok && !busy {
+			go cli.reverify(ctx, t)
+		}
+	}
+}
+
+func (cli *Client) reverify(ctx context.Context, t *torrent.Torrent) {
+	defer func() {
+		cli.lock.Lock()
+		delete(cli.reverifying, t.InfoHash())
+		cli.lock.Unlock()
+	}()
+	log.Info("[torrent] Re-verification requested", "torrent", t.Name())
+	bad := 0
+	for i := 0; i < t.NumPieces(); i++ {
+		if ctx.Err() != nil {
+			return
+		}
+		if !t.PieceState(i).Complete {
+			continue
+		}
+		t.Piece(i).VerifyData()
+		if !t.PieceState(i).Complete {
+			bad++
+		}
+	}
+	if bad > 0 {
+		log.Warn("[torrent] Re-verification found bad pieces, downloading them again", "torrent", t.Name(), "bad", bad)
+		cli.events.queue(t.InfoHash(), VerifyFailed{InfoHash: t.InfoHash(), Pieces: bad})
+		return
+	}
+	log.Info("[torrent] Re-verification done, data is good", "torrent", t.Name())
+}
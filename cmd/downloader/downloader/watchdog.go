@@ -0,0 +1,191 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// AutoRestartGracePeriod - how long torrent client must stay dead before watchdog re-creates it
+var AutoRestartGracePeriod = 2 * time.Minute
+
+const autoRestartCheckInterval = 15 * time.Second
+
+// EnableAutoRestart - starts watchdog: if torrent client is dead (closed, or its listener doesn't accept
+// connections) during AutoRestartGracePeriod - it's re-created by New with same cfg and db, all torrents re-added.
+// cfg and db must be the ones Client was created with. Watchdog stops on Close.
+// Calls which are in-flight during restart may fail: they hold old torrent client.
+func (cli *Client) EnableAutoRestart(cfg *Cfg, db kv.RwDB) {
+	go func() {
+		check := time.NewTicker(autoRestartCheckInterval)
+		defer check.Stop()
+		lastAlive := time.Now()
+		for {
+			select {
+			case <-cli.closing:
+				return
+			case <-check.C:
+			}
+			err := cli.clientAlive()
+			if err == nil {
+				lastAlive = time.Now()
+				continue
+			}
+			if time.Since(lastAlive) < AutoRestartGracePeriod {
+				continue
+			}
+			log.Warn("[torrent] Restarting dead torrent client", "reason", err, "dead for", time.Since(lastAlive).Round(time.Second))
+			if err := cli.restart(cfg, db); err != nil {
+				log.Error("[torrent] Restart torrent client", "err", err)
+				continue
+			}
+			lastAlive = time.Now()
+		}
+	}()
+}
+
+// clientAlive - nil if torrent client is open and accepts connections on its listen port
+func (cli *Client) clientAlive() error {
+	torrentClient := cli.TorrentClient()
+	select {
+	case <-torrentClient.Closed():
+		return errors.New("torrent client closed")
+	default:
+	}
+	if cli.cfg.DisableTCP {
+		return nil
+	}
+	for _, addr := range torrentClient.ListenAddrs() {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		ip := tcpAddr.IP // ListenHost may be specific interface, loopback is used only for all-interfaces listener
+		if ip.IsUnspecified() {
+			ip = net.IPv6loopback
+			if tcpAddr.IP.To4() != nil {
+				ip = net.IPv4(127, 0, 0, 1)
+			}
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port)), 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("listener doesn't accept: %w", err)
+		}
+		return conn.Close()
+	}
+	return errors.New("no tcp listener")
+}
+
+// restart - closes old torrent client and creates new one, torrents are re-added with same metadata
+func (cli *Client) restart(cfg *Cfg, db kv.RwDB) error {
+	cli.restartLock.Lock()
+	defer cli.restartLock.Unlock()
+	select {
+	case <-cli.closing:
+		return nil
+	default:
+	}
+
+	torrents := cli.torrentsList()
+	stats := cli.TorrentClient().ConnStats()
+	cli.session.carry(stats)
+	cli.quota.carry(cli.TorrentClient(), stats.BytesReadData.Int64())
+	cli.closeTorrentClient()
+
+	cfg.Callbacks = cli.callbacks
+	if cli.ownStorage {
+		cfg.DefaultStorage = nil
+	} else if s, ok := cfg.DefaultStorage.(notifyingStorage); ok { // newClient wraps it again
+		cfg.DefaultStorage = s.ClientImpl
+	}
+	fresh, err := newClient(cfg, db, cli.events)
+	if err != nil {
+		return fmt.Errorf("new torrent client: %w", err)
+	}
+	cli.bandwidth.lock.Lock()
+	for h, w := range cli.bandwidth.weights {
+		fresh.bandwidth.weights[h] = w
+	}
+	cli.bandwidth.lock.Unlock()
+	if err := torrents.addTo(fresh.TorrentClient(), db, cli.addOptions(), cli.isPaused, cli.isDownloadPaused); err != nil {
+		fresh.closeTorrentClient()
+		return err
+	}
+
+	cli.setTorrentClient(fresh.TorrentClient())
+	cli.lock.Lock()
+	cli.completions = fresh.completions
+	cli.traffic = fresh.traffic
+	cli.bandwidth = fresh.bandwidth
+	cli.writes = fresh.writes
+	cli.pieceEvents = fresh.pieceEvents
+	cli.lock.Unlock()
+	cli.applyPaused()
+	cli.addStaticPeers()
+	log.Info("[torrent] Torrent client restarted", "torrents", len(torrents.hashes))
+	return nil
+}
+
+// torrentsList - what's needed to re-add torrents to new torrent client or storage
+type torrentsList struct {
+	hashes []metainfo.Hash
+	known  map[metainfo.Hash]*metainfo.MetaInfo // torrents which metadata is known
+}
+
+func (cli *Client) torrentsList() torrentsList {
+	torrents := cli.TorrentClient().Torrents()
+	res := torrentsList{hashes: make([]metainfo.Hash, 0, len(torrents)), known: make(map[metainfo.Hash]*metainfo.MetaInfo, len(torrents))}
+	for _, t := range torrents {
+		res.hashes = append(res.hashes, t.InfoHash())
+		select {
+		case <-t.GotInfo():
+			mi := t.Metainfo()
+			res.known[t.InfoHash()] = &mi
+		default:
+		}
+	}
+	return res
+}
+
+// addTo - torrents without known metadata are taken from db cache, or added as magnets. Data download/upload
+// of paused torrents is not allowed, all pieces are marked for download (DownloadAll) as soon as metadata is known.
+func (l torrentsList) addTo(torrentClient *torrent.Client, db kv.RwDB, opts AddOptions, isPaused, isDownloadPaused func(metainfo.Hash) bool) error {
+	for _, hash := range l.hashes {
+		hash := hash
+		opts := opts
+		if isPaused(hash) {
+			opts.AllowDownload, opts.AllowUpload = false, false
+		} else if isDownloadPaused(hash) {
+			opts.AllowDownload = false
+		}
+		var t *torrent.Torrent
+		var err error
+		if mi, ok := l.known[hash]; ok {
+			applyTrackers(mi, opts)
+			t, err = torrentClient.AddTorrent(mi)
+		} else if t, err = addCachedInfo(torrentClient, db, hash, opts); err == nil && t == nil {
+			mi := &metainfo.MetaInfo{}
+			applyTrackers(mi, opts)
+			t, err = torrentClient.AddMagnet(mi.Magnet(&hash, nil).String())
+		}
+		if err != nil {
+			return fmt.Errorf("re-add torrent %s: %w", hash, err)
+		}
+		applyAllow(t, opts)
+		go func() {
+			select {
+			case <-t.GotInfo():
+				t.DownloadAll()
+			case <-t.Closed():
+			}
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+const (
+	WebhookTorrentCompleted = "torrent_completed"
+	WebhookAllCompleted     = "all_completed"
+)
+
+// WebhookPayload - JSON body POSTed to Cfg.WebhookURL
+type WebhookPayload struct {
+	Event       string   `json:"event"`
+	InfoHashes  []string `json:"infohashes"`
+	TotalBytes  int64    `json:"total_bytes"`
+	DurationSec float64  `json:"duration_sec"` // since downloader start
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// sendWebhook - doesn't block caller, delivery failures only logged
+func sendWebhook(url string, payload WebhookPayload) {
+	go func() {
+		if err := postWebhook(url, payload); err != nil {
+			log.Warn("[torrent] Webhook delivery failed", "event", payload.Event, "err", err)
+		}
+	}()
+}
+
+func postWebhook(url string, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = postWebhookOnce(url, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func postWebhookOnce(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
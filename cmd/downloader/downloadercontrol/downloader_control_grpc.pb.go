@@ -0,0 +1,355 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package downloadercontrol
+
+import (
+	context "context"
+	downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DownloaderControlClient is the client API for DownloaderControl service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DownloaderControlClient interface {
+	// Add - same as Downloader.Download
+	Add(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	List(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListReply, error)
+	// Stats - same as Downloader.Stats
+	Stats(ctx context.Context, in *downloader.StatsRequest, opts ...grpc.CallOption) (*downloader.StatsReply, error)
+	// Remove - only items' torrent_hash is used, same for Pause and Resume
+	Remove(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Pause(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Resume(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Progress - StatsReply now and every 5 seconds, until client disconnects
+	Progress(ctx context.Context, in *downloader.StatsRequest, opts ...grpc.CallOption) (DownloaderControl_ProgressClient, error)
+}
+
+type downloaderControlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDownloaderControlClient(cc grpc.ClientConnInterface) DownloaderControlClient {
+	return &downloaderControlClient{cc}
+}
+
+func (c *downloaderControlClient) Add(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/downloader.DownloaderControl/Add", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderControlClient) List(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListReply, error) {
+	out := new(ListReply)
+	err := c.cc.Invoke(ctx, "/downloader.DownloaderControl/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderControlClient) Stats(ctx context.Context, in *downloader.StatsRequest, opts ...grpc.CallOption) (*downloader.StatsReply, error) {
+	out := new(downloader.StatsReply)
+	err := c.cc.Invoke(ctx, "/downloader.DownloaderControl/Stats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderControlClient) Remove(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/downloader.DownloaderControl/Remove", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderControlClient) Pause(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/downloader.DownloaderControl/Pause", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderControlClient) Resume(ctx context.Context, in *downloader.DownloadRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/downloader.DownloaderControl/Resume", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderControlClient) Progress(ctx context.Context, in *downloader.StatsRequest, opts ...grpc.CallOption) (DownloaderControl_ProgressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DownloaderControl_ServiceDesc.Streams[0], "/downloader.DownloaderControl/Progress", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &downloaderControlProgressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DownloaderControl_ProgressClient interface {
+	Recv() (*downloader.StatsReply, error)
+	grpc.ClientStream
+}
+
+type downloaderControlProgressClient struct {
+	grpc.ClientStream
+}
+
+func (x *downloaderControlProgressClient) Recv() (*downloader.StatsReply, error) {
+	m := new(downloader.StatsReply)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DownloaderControlServer is the server API for DownloaderControl service.
+// All implementations must embed UnimplementedDownloaderControlServer
+// for forward compatibility
+type DownloaderControlServer interface {
+	// Add - same as Downloader.Download
+	Add(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error)
+	List(context.Context, *emptypb.Empty) (*ListReply, error)
+	// Stats - same as Downloader.Stats
+	Stats(context.Context, *downloader.StatsRequest) (*downloader.StatsReply, error)
+	// Remove - only items' torrent_hash is used, same for Pause and Resume
+	Remove(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error)
+	Pause(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error)
+	Resume(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error)
+	// Progress - StatsReply now and every 5 seconds, until client disconnects
+	Progress(*downloader.StatsRequest, DownloaderControl_ProgressServer) error
+	mustEmbedUnimplementedDownloaderControlServer()
+}
+
+// UnimplementedDownloaderControlServer must be embedded to have forward compatible implementations.
+type UnimplementedDownloaderControlServer struct {
+}
+
+func (UnimplementedDownloaderControlServer) Add(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedDownloaderControlServer) List(context.Context, *emptypb.Empty) (*ListReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedDownloaderControlServer) Stats(context.Context, *downloader.StatsRequest) (*downloader.StatsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedDownloaderControlServer) Remove(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedDownloaderControlServer) Pause(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Pause not implemented")
+}
+func (UnimplementedDownloaderControlServer) Resume(context.Context, *downloader.DownloadRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resume not implemented")
+}
+func (UnimplementedDownloaderControlServer) Progress(*downloader.StatsRequest, DownloaderControl_ProgressServer) error {
+	return status.Errorf(codes.Unimplemented, "method Progress not implemented")
+}
+func (UnimplementedDownloaderControlServer) mustEmbedUnimplementedDownloaderControlServer() {}
+
+// UnsafeDownloaderControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DownloaderControlServer will
+// result in compilation errors.
+type UnsafeDownloaderControlServer interface {
+	mustEmbedUnimplementedDownloaderControlServer()
+}
+
+func RegisterDownloaderControlServer(s grpc.ServiceRegistrar, srv DownloaderControlServer) {
+	s.RegisterService(&DownloaderControl_ServiceDesc, srv)
+}
+
+func _DownloaderControl_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(downloader.DownloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderControlServer).Add(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloader.DownloaderControl/Add",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderControlServer).Add(ctx, req.(*downloader.DownloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DownloaderControl_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderControlServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloader.DownloaderControl/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderControlServer).List(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DownloaderControl_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(downloader.StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderControlServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloader.DownloaderControl/Stats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderControlServer).Stats(ctx, req.(*downloader.StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DownloaderControl_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(downloader.DownloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderControlServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloader.DownloaderControl/Remove",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderControlServer).Remove(ctx, req.(*downloader.DownloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DownloaderControl_Pause_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(downloader.DownloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderControlServer).Pause(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloader.DownloaderControl/Pause",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderControlServer).Pause(ctx, req.(*downloader.DownloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DownloaderControl_Resume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(downloader.DownloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderControlServer).Resume(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloader.DownloaderControl/Resume",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderControlServer).Resume(ctx, req.(*downloader.DownloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DownloaderControl_Progress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(downloader.StatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DownloaderControlServer).Progress(m, &downloaderControlProgressServer{stream})
+}
+
+type DownloaderControl_ProgressServer interface {
+	Send(*downloader.StatsReply) error
+	grpc.ServerStream
+}
+
+type downloaderControlProgressServer struct {
+	grpc.ServerStream
+}
+
+func (x *downloaderControlProgressServer) Send(m *downloader.StatsReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// DownloaderControl_ServiceDesc is the grpc.ServiceDesc for DownloaderControl service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DownloaderControl_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "downloader.DownloaderControl",
+	HandlerType: (*DownloaderControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Add",
+			Handler:    _DownloaderControl_Add_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _DownloaderControl_List_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _DownloaderControl_Stats_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _DownloaderControl_Remove_Handler,
+		},
+		{
+			MethodName: "Pause",
+			Handler:    _DownloaderControl_Pause_Handler,
+		},
+		{
+			MethodName: "Resume",
+			Handler:    _DownloaderControl_Resume_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Progress",
+			Handler:       _DownloaderControl_Progress_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "downloader_control.proto",
+}
@@ -0,0 +1,5 @@
+// Package downloadercontrol - Go code of DownloaderControl service (torrents management), generated from
+// downloader_control.proto. Imported messages are of erigon-interfaces, see "gRPC API" of cmd/downloader/readme.md
+package downloadercontrol
+
+//go:generate protoc --proto_path=. --proto_path=./../../../interfaces --go_out=. --go-grpc_out=. -I=./../../../build/include/google --go_opt=paths=source_relative --go-grpc_opt=paths=source_relative --go_opt=Mtypes/types.proto=github.com/ledgerwatch/erigon-lib/gointerfaces/types --go_opt=Mdownloader/downloader.proto=github.com/ledgerwatch/erigon-lib/gointerfaces/downloader --go-grpc_opt=Mtypes/types.proto=github.com/ledgerwatch/erigon-lib/gointerfaces/types --go-grpc_opt=Mdownloader/downloader.proto=github.com/ledgerwatch/erigon-lib/gointerfaces/downloader downloader_control.proto
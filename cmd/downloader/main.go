@@ -7,7 +7,6 @@ import (
 	"net"
 	"os"
 	"path"
-	"path/filepath"
 	"time"
 
 	lg "github.com/anacrolix/log"
@@ -19,6 +18,7 @@ import (
 	proto_downloader "github.com/ledgerwatch/erigon-lib/gointerfaces/downloader"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon/cmd/downloader/downloader"
+	proto_control "github.com/ledgerwatch/erigon/cmd/downloader/downloadercontrol"
 	"github.com/ledgerwatch/erigon/cmd/utils"
 	"github.com/ledgerwatch/erigon/common/paths"
 	"github.com/ledgerwatch/erigon/internal/debug"
@@ -34,15 +34,46 @@ import (
 )
 
 var (
-	datadir                       string
-	seeding                       bool
-	asJson                        bool
-	forceRebuild                  bool
-	forceVerify                   bool
-	downloaderApiAddr             string
-	torrentVerbosity              string
-	downloadRateStr, uploadRteStr string
-	torrentPort                   int
+	datadir                        string
+	seeding                        bool
+	downloadOnly                   bool
+	requirePreverified             bool
+	passkey                        string
+	maxTorrents                    int
+	stagingDir                     string
+	readOnlyData                   bool
+	completionDir                  string
+	proxyURL                       string
+	hashOracleURL                  string
+	peerIdleTimeout                time.Duration
+	peerChurnInterval              time.Duration
+	maxRequestsPerPeer             int
+	storageBackend                 string
+	durability                     string
+	scheduling                     string
+	completionFormat               string
+	lsd                            bool
+	preferLAN                      bool
+	uploadFractionWhileDownloading float64
+	startupVerifyStr               string
+	asJson                         bool
+	forceRebuild                   bool
+	forceVerify                    bool
+	verifyBufStr                   string
+	verifyWorkers                  int
+	maxVerifyingTorrents           int
+	maxResolvingTorrents           int
+	verifyMemStr                   string
+	verifyBudget                   time.Duration
+	benchVerify                    bool
+	downloaderApiAddr              string
+	torrentVerbosity               string
+	downloadRateStr, uploadRteStr  string
+	torrentPort                    int
+	torrentExternalPort            int
+	torrentAnyPort                 bool
+	dialReuseAddr, dialReusePort   bool
+	dialPortMin, dialPortMax       int
 )
 
 func init() {
@@ -52,16 +83,49 @@ func init() {
 	withDatadir(rootCmd)
 
 	rootCmd.PersistentFlags().BoolVar(&seeding, "seeding", true, "Seed snapshots")
+	rootCmd.Flags().BoolVar(&downloadOnly, "download.only", false, "Stop any BitTorrent activity (no seeding) once all snapshots downloaded")
+	rootCmd.Flags().StringVar(&passkey, "torrent.passkey", "", "private trackers auth: substituted to {passkey} of trackers urls")
+	rootCmd.Flags().IntVar(&maxTorrents, "torrent.max", downloader.DefaultMaxTorrents, "fail adding torrents of snapshots dir beyond this amount (stray .torrent files). -1 - unlimited")
+	rootCmd.Flags().BoolVar(&requirePreverified, "download.strict", false, "fail download requests with empty list of snapshots (catches config bugs) instead of downloading nothing")
+	rootCmd.Flags().BoolVar(&readOnlyData, "torrent.readonly", false, "snapshots dir is read-only (shared volume of seed-only node): seed existing .torrent files, no download, completion store in --torrent.completion.dir")
+	rootCmd.Flags().StringVar(&completionDir, "torrent.completion.dir", "", "writable dir of piece completion store, required by --torrent.readonly")
+	rootCmd.Flags().StringVar(&stagingDir, "torrent.staging.dir", "", "download to this dir and move files to snapshots dir once complete and verified: Erigon never sees half-written files")
+	rootCmd.Flags().StringVar(&proxyURL, "torrent.proxy", "", "http(s) proxy of HTTP trackers and webseeds, example: http://proxy:3128. Empty - HTTP_PROXY/HTTPS_PROXY env. Peers connections stay direct")
+	rootCmd.Flags().StringVar(&hashOracleURL, "torrent.hash.oracle", "", "url of authoritative list of snapshots hashes (erigon-snapshots toml format), requested infohashes must be there")
+	rootCmd.Flags().DurationVar(&peerIdleTimeout, "torrent.peer.idle", 0, "close peer connections which don't exchange data that long, example: 10m. 0 - keep them")
+	rootCmd.Flags().DurationVar(&peerChurnInterval, "torrent.peer.churn", 0, "how often torrent with all connection slots busy drops slowest peer to dial new ones, example: 2m. 0 - never")
+	rootCmd.Flags().IntVar(&maxRequestsPerPeer, "torrent.peer.requests", 0, "max outstanding piece requests per peer: more - faster on high-latency links, costs memory (16KiB per request). 0 - library default")
+	rootCmd.Flags().StringVar(&storageBackend, "torrent.storage", string(downloader.StorageAuto), "auto (mmap, file on network filesystems) | mmap | file | dedup - file, plus hardlinks of identical files of different torrents (costs re-hashing of linked files)")
+	rootCmd.Flags().StringVar(&durability, "torrent.durability", string(downloader.DurabilityNone), "fsync verified data before marking it complete: none | file (once file complete) | piece (slowest, nothing lost on power loss)")
+	rootCmd.Flags().StringVar(&scheduling, "torrent.scheduling", string(downloader.SchedulingFair), "split of download.rate between torrents: fair | finish-line (torrents over 90% complete get 10x share and finish first)")
+	rootCmd.Flags().StringVar(&completionFormat, "torrent.completion.format", string(downloader.CompletionDefault), "piece completion store: default | bitfield - compact, for thousands of pieces (pieces are re-verified once after switching)")
+	rootCmd.Flags().BoolVar(&lsd, "torrent.lsd", false, "Find peers in local network (BEP 14), saves WAN bandwidth when many nodes are in same datacenter")
+	rootCmd.Flags().BoolVar(&preferLAN, "torrent.lan.prefer", false, "Dial peers with private (RFC 1918) addresses before internet peers")
+	rootCmd.Flags().IntVar(&maxResolvingTorrents, "torrent.resolve.torrents", 0, "how many magnets resolve metadata at once, next ones are added as earlier resolve. 0 - all at once")
+	rootCmd.Flags().IntVar(&maxVerifyingTorrents, "verify.startup.torrents", 0, "how many torrents verify existing data at once on startup (smooths disk IO). 0 - all at once")
+	rootCmd.Flags().StringVar(&startupVerifyStr, "verify.startup", "trust", "re-hash existing data on start: trust (completion store) | always | max age of completion, example: 720h")
 	rootCmd.Flags().StringVar(&downloaderApiAddr, "downloader.api.addr", "127.0.0.1:9093", "external downloader api network address, for example: 127.0.0.1:9093 serves remote downloader interface")
 	rootCmd.Flags().StringVar(&torrentVerbosity, "torrent.verbosity", lg.Warning.LogString(), "DEBUG | INFO | WARN | ERROR")
 	rootCmd.Flags().StringVar(&downloadRateStr, "download.rate", "8mb", "bytes per second, example: 32mb")
 	rootCmd.Flags().StringVar(&uploadRteStr, "upload.rate", "8mb", "bytes per second, example: 32mb")
+	rootCmd.Flags().Float64Var(&uploadFractionWhileDownloading, "upload.rate.downloading", 0, "fraction of --upload.rate used while download is in progress (asymmetric uplinks), example: 0.25. 0 - disabled")
 	rootCmd.Flags().IntVar(&torrentPort, "torrent.port", 42069, "port to listen and serve BitTorrent protocol")
+	rootCmd.Flags().BoolVar(&torrentAnyPort, "torrent.port.any", false, "if torrent.port is in use - listen on free port chosen by OS instead of failing")
+	rootCmd.Flags().IntVar(&torrentExternalPort, "torrent.port.external", 0, "port announced to trackers if it differs from torrent.port (NAT with static port forward). 0 - torrent.port")
+	rootCmd.Flags().BoolVar(&dialReuseAddr, "torrent.dial.reuseaddr", false, "set SO_REUSEADDR on outbound peer connections (linux only)")
+	rootCmd.Flags().BoolVar(&dialReusePort, "torrent.dial.reuseport", false, "set SO_REUSEPORT on outbound peer connections (linux only)")
+	rootCmd.Flags().IntVar(&dialPortMin, "torrent.dial.port.min", 0, "source ports range of outbound peer connections, with torrent.dial.port.max (linux only). 0 - OS ephemeral range")
+	rootCmd.Flags().IntVar(&dialPortMax, "torrent.dial.port.max", 0, "see torrent.dial.port.min")
 
 	withDatadir(printTorrentHashes)
 	printTorrentHashes.PersistentFlags().BoolVar(&asJson, "json", false, "Print in json format (default: toml)")
 	printTorrentHashes.PersistentFlags().BoolVar(&forceRebuild, "rebuild", false, "Force re-create .torrent files")
 	printTorrentHashes.PersistentFlags().BoolVar(&forceVerify, "verify", false, "Force verify data files if have .torrent files")
+	printTorrentHashes.PersistentFlags().BoolVar(&benchVerify, "verify.bench", false, "Measure disk read and hashing speed of verification on part of data files")
+	printTorrentHashes.PersistentFlags().StringVar(&verifyBufStr, "verify.buf", "256kb", "read buffer size of --verify, bigger is better for HDD, example: 4mb")
+	printTorrentHashes.PersistentFlags().IntVar(&verifyWorkers, "verify.workers", 1, "amount of pieces hashed in parallel by --verify")
+	printTorrentHashes.PersistentFlags().DurationVar(&verifyBudget, "verify.budget", 0, "time limit of --verify: stop and report incomplete verification once spent, next run continues with not verified torrents. 0 - no limit")
+	printTorrentHashes.PersistentFlags().StringVar(&verifyMemStr, "verify.mem", "256mb", "memory budget of --verify.workers: each holds piece-sized buffer, workers reduced to fit")
 
 	rootCmd.AddCommand(printTorrentHashes)
 }
@@ -112,35 +176,82 @@ func Downloader(ctx context.Context, cmd *cobra.Command) error {
 		panic(fmt.Errorf("unexpected torrent.verbosity level: %s", torrentVerbosity))
 	}
 
-	var downloadRate, uploadRate datasize.ByteSize
-	if err := downloadRate.UnmarshalText([]byte(downloadRateStr)); err != nil {
-		return err
+	downloadRate, err := downloader.ParseRate(downloadRateStr)
+	if err != nil {
+		return fmt.Errorf("download.rate: %w", err)
 	}
-	if err := uploadRate.UnmarshalText([]byte(uploadRteStr)); err != nil {
-		return err
+	uploadRate, err := downloader.ParseRate(uploadRteStr)
+	if err != nil {
+		return fmt.Errorf("upload.rate: %w", err)
 	}
 
 	log.Info("Run snapshot downloader", "addr", downloaderApiAddr, "datadir", datadir, "seeding", seeding, "download.rate", downloadRate.String(), "upload.rate", uploadRate.String())
 
-	downloaderDB := mdbx.MustOpen(snapshotDir + "/db")
+	dbDir := snapshotDir
+	if readOnlyData { // nothing is written to snapshots dir
+		dbDir = completionDir
+	}
+	downloaderDB := mdbx.MustOpen(dbDir + "/db")
 	var dl *downloader.Client
 
-	cfg, err := downloader.TorrentConfig(snapshotDir, seeding, torrentLogLevel, downloadRate, uploadRate, torrentPort)
+	cfg, err := downloader.Config{
+		SnapshotsDir:  snapshotDir,
+		StagingDir:    stagingDir,
+		ReadOnlyData:  readOnlyData,
+		CompletionDir: completionDir,
+		ProxyURL:      proxyURL,
+		Seeding:       seeding,
+		Verbosity:     torrentLogLevel,
+		ListenPort:    torrentPort,
+		DialSocket:    downloader.DialSocket{ReuseAddr: dialReuseAddr, ReusePort: dialReusePort, PortMin: dialPortMin, PortMax: dialPortMax},
+		DownloadRate:  downloadRate,
+		UploadRate:    uploadRate,
+	}.Cfg()
 	if err != nil {
-		return fmt.Errorf("TorrentConfig: %w", err)
+		return fmt.Errorf("config: %w", err)
+	}
+	cfg.DownloadOnly = downloadOnly
+	cfg.RequirePreverified = requirePreverified
+	cfg.Passkey = passkey
+	cfg.MaxTorrents = maxTorrents
+	cfg.LocalServiceDiscovery = lsd
+	cfg.PreferLANPeers = preferLAN
+	cfg.DBPath = dbDir + "/db"
+	cfg.UploadFractionWhileDownloading = uploadFractionWhileDownloading
+	cfg.HashOracleURL = hashOracleURL
+	cfg.PeerIdleTimeout = peerIdleTimeout
+	cfg.PeerChurnInterval = peerChurnInterval
+	cfg.MaxRequestsPerPeer = maxRequestsPerPeer
+	cfg.Storage = downloader.StorageBackend(storageBackend)
+	cfg.MaxVerifyingTorrents = maxVerifyingTorrents
+	cfg.MaxResolvingTorrents = maxResolvingTorrents
+	cfg.ExternalPort = torrentExternalPort
+	cfg.AnyPortIfBusy = torrentAnyPort
+	if cfg.Durability, err = downloader.ParseDurabilityMode(durability); err != nil {
+		return fmt.Errorf("torrent.durability: %w", err)
+	}
+	if cfg.Scheduling, err = downloader.ParseSchedulingPolicy(scheduling); err != nil {
+		return fmt.Errorf("torrent.scheduling: %w", err)
+	}
+	if cfg.CompletionFormat, err = downloader.ParseCompletionFormat(completionFormat); err != nil {
+		return fmt.Errorf("torrent.completion.format: %w", err)
+	}
+	if cfg.StartupVerify, err = downloader.ParseStartupVerifyPolicy(startupVerifyStr); err != nil {
+		return fmt.Errorf("verify.startup: %w", err)
 	}
 	dl, err = downloader.New(cfg, downloaderDB)
 	if err != nil {
 		return err
 	}
-	log.Info("[torrent] Start", "seeding", cfg.Seed, "my peerID", dl.Client.PeerID())
-	if err = downloader.CreateTorrentFilesAndAdd(ctx, snapshotDir, dl.Client); err != nil {
+	log.Info("[torrent] Start", "seeding", cfg.Seed, "my peerID", dl.TorrentClient().PeerID())
+	if err = downloader.CreateTorrentFilesAndAdd(ctx, snapshotDir, dl); err != nil {
 		return fmt.Errorf("CreateTorrentFilesAndAdd: %w", err)
 	}
 
-	go downloader.MainLoop(ctx, dl.Client)
+	dl.EnableAutoRestart(cfg, downloaderDB)
+	go downloader.MainLoop(ctx, dl, false)
 
-	bittorrentServer, err := downloader.NewGrpcServer(downloaderDB, dl, snapshotDir)
+	bittorrentServer, err := downloader.NewGrpcServer(downloaderDB, dl)
 	if err != nil {
 		return fmt.Errorf("new server: %w", err)
 	}
@@ -151,6 +262,9 @@ func Downloader(ctx context.Context, cmd *cobra.Command) error {
 	}
 	<-cmd.Context().Done()
 	grpcServer.GracefulStop()
+	closeCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	dl.CloseGracefully(closeCtx)
 	return nil
 }
 
@@ -161,12 +275,45 @@ var printTorrentHashes = &cobra.Command{
 		snapshotDir := path.Join(datadir, "snapshots")
 		ctx := cmd.Context()
 
+		if benchVerify {
+			res, err := downloader.BenchmarkVerify(snapshotDir)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", res)
+			return nil
+		}
+
 		if forceVerify { // remove and create .torrent files (will re-read all snapshots)
-			return downloader.VerifyDtaFiles(ctx, snapshotDir)
+			var verifyBuf datasize.ByteSize
+			if err := verifyBuf.UnmarshalText([]byte(verifyBufStr)); err != nil {
+				return err
+			}
+			var verifyMem datasize.ByteSize
+			if err := verifyMem.UnmarshalText([]byte(verifyMemStr)); err != nil {
+				return err
+			}
+			opts := downloader.VerifyOptions{
+				ReadBufSize:  int(verifyBuf.Bytes()),
+				Workers:      verifyWorkers,
+				MemoryBudget: verifyMem,
+				MaxDuration:  verifyBudget,
+				Checkpoint:   downloader.DefaultVerifyCheckpoint(snapshotDir),
+				Storage:      downloader.StorageBackend(storageBackend),
+			}
+			dbPath := snapshotDir + "/db"
+			if _, err := os.Stat(dbPath); err == nil { // downloader's db: least recently verified torrents go first
+				db := mdbx.MustOpen(dbPath)
+				defer db.Close()
+				opts.DB = db
+			}
+			return downloader.VerifyDtaFiles(ctx, snapshotDir, nil, opts)
 		}
 
 		if forceRebuild { // remove and create .torrent files (will re-read all snapshots)
-			removeChunksStorage(snapshotDir)
+			if err := downloader.RemoveChunksStorage(snapshotDir, nil); err != nil {
+				return err
+			}
 
 			files, err := downloader.AllTorrentPaths(snapshotDir)
 			if err != nil {
@@ -177,7 +324,7 @@ var printTorrentHashes = &cobra.Command{
 					return err
 				}
 			}
-			if err := downloader.BuildTorrentFilesIfNeed(ctx, snapshotDir); err != nil {
+			if err := downloader.BuildTorrentFilesIfNeed(ctx, snapshotDir, false); err != nil {
 				return err
 			}
 		}
@@ -215,13 +362,6 @@ var printTorrentHashes = &cobra.Command{
 	},
 }
 
-func removeChunksStorage(snapshotDir string) {
-	_ = os.RemoveAll(filepath.Join(snapshotDir, ".torrent.db"))
-	_ = os.RemoveAll(filepath.Join(snapshotDir, ".torrent.bolt.db"))
-	_ = os.RemoveAll(filepath.Join(snapshotDir, ".torrent.db-shm"))
-	_ = os.RemoveAll(filepath.Join(snapshotDir, ".torrent.db-wal"))
-}
-
 func StartGrpc(snServer *downloader.GrpcServer, addr string, creds *credentials.TransportCredentials) (*grpc.Server, error) {
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -258,6 +398,7 @@ func StartGrpc(snServer *downloader.GrpcServer, addr string, creds *credentials.
 	reflection.Register(grpcServer) // Register reflection service on gRPC server.
 	if snServer != nil {
 		proto_downloader.RegisterDownloaderServer(grpcServer, snServer)
+		proto_control.RegisterDownloaderControlServer(grpcServer, snServer)
 	}
 
 	//if metrics.Enabled {